@@ -0,0 +1,698 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// maxArchiveSize is the maximum total size of the files extracted from a
+// stack archive or an OCI stack artifact, which only hold the stack files.
+// Bundles also hold the saved images of the stack and are not limited.
+var maxArchiveSize int64 = 1 << 30
+
+// maxLinkHops is the maximum number of symbolic links followed when resolving
+// a path, as with ELOOP.
+const maxLinkHops = 40
+
+var (
+	errChecksumMismatch = errors.New("archive checksum mismatch")
+	errUnsafeArchive    = errors.New("archive entry escapes the destination directory")
+	errArchiveTooLarge  = errors.New("archive content exceeds the size limit")
+	errTooManyLinks     = errors.New("too many levels of symbolic links")
+)
+
+// archiveSource downloads a .tar.gz or .zip archive over HTTP(S) and
+// extracts it.
+type archiveSource struct {
+	url             string
+	sha256          string
+	stripComponents int
+	transport       TransportOptions
+}
+
+func (s *archiveSource) Name() string {
+	return archiveName(s.url)
+}
+
+func (s *archiveSource) Fetch(ctx context.Context, clonePath string) error {
+	httpClient, err := newHTTPClient(s.transport)
+	if err != nil {
+		return err
+	}
+
+	log.Info().
+		Str("url", s.url).
+		Str("path", clonePath).
+		Msg("Downloading stack archive")
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to download %s: %s", s.url, resp.Status)
+	}
+
+	f, err := os.CreateTemp("", "unpacker-archive-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, hash), resp.Body)
+	if err != nil {
+		return err
+	}
+
+	err = verifyChecksum(hash.Sum(nil), s.sha256)
+	if err != nil {
+		return err
+	}
+
+	return extractArchive(f.Name(), archiveSuffix(s.url), clonePath, s.stripComponents, maxArchiveSize)
+}
+
+// localSource copies a directory, or extracts an archive, available on the
+// local file system.
+type localSource struct {
+	path            string
+	sha256          string
+	stripComponents int
+}
+
+func (s *localSource) Name() string {
+	if archiveSuffix(s.path) != "" {
+		return archiveName(s.path)
+	}
+
+	return filepath.Base(filepath.Clean(s.path))
+}
+
+func (s *localSource) Fetch(ctx context.Context, clonePath string) error {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+
+	if info.IsDir() {
+		log.Info().
+			Str("source", s.path).
+			Str("path", clonePath).
+			Msg("Copying local stack directory")
+
+		return copyDir(s.path, clonePath)
+	}
+
+	suffix := archiveSuffix(s.path)
+	if suffix == "" {
+		return fmt.Errorf("%w: %s is neither a directory nor a .tar.gz/.zip archive", errInvalidSource, s.path)
+	}
+
+	if s.sha256 != "" {
+		sum, err := fileChecksum(s.path)
+		if err != nil {
+			return err
+		}
+
+		err = verifyChecksum(sum, s.sha256)
+		if err != nil {
+			return err
+		}
+	}
+
+	log.Info().
+		Str("archive", s.path).
+		Str("path", clonePath).
+		Msg("Extracting local stack archive")
+
+	return extractArchive(s.path, suffix, clonePath, s.stripComponents, maxArchiveSize)
+}
+
+func fileChecksum(p string) ([]byte, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	_, err = io.Copy(hash, f)
+	if err != nil {
+		return nil, err
+	}
+
+	return hash.Sum(nil), nil
+}
+
+// verifyChecksum compares sum with the expected hex encoded sha256, an empty
+// expected value disables the check.
+func verifyChecksum(sum []byte, expected string) error {
+	if expected == "" {
+		return nil
+	}
+
+	actual := hex.EncodeToString(sum)
+	if !strings.EqualFold(actual, strings.TrimPrefix(expected, "sha256:")) {
+		return fmt.Errorf("%w: expected %s, got %s", errChecksumMismatch, expected, actual)
+	}
+
+	return nil
+}
+
+// extractArchive extracts the archive into destination. The total size of the
+// extracted files is limited to maxSize, when positive.
+func extractArchive(archivePath, suffix, destination string, stripComponents int, maxSize int64) error {
+	err := os.MkdirAll(destination, 0755)
+	if err != nil {
+		return err
+	}
+
+	if suffix == ".zip" {
+		return extractZip(archivePath, destination, stripComponents, maxSize)
+	}
+
+	return extractTarGz(archivePath, destination, stripComponents, maxSize)
+}
+
+// extractionRoot returns destination with its symbolic links resolved, the
+// link targets of the entries being compared to it.
+func extractionRoot(destination string) (string, error) {
+	err := os.MkdirAll(destination, 0755)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.EvalSymlinks(destination)
+}
+
+// archiveEntryPath returns the path on disk of the archive entry name, or an
+// empty string when the entry is dropped by stripComponents. Absolute names
+// and names escaping destination are rejected.
+func archiveEntryPath(destination, name string, stripComponents int) (string, error) {
+	name = strings.ReplaceAll(name, `\`, "/")
+	if path.IsAbs(name) || filepath.IsAbs(name) || filepath.VolumeName(name) != "" {
+		return "", fmt.Errorf("%w: %s", errUnsafeArchive, name)
+	}
+
+	parts := strings.Split(path.Clean(name), "/")
+	if len(parts) <= stripComponents {
+		return "", nil
+	}
+
+	cleaned := path.Join(parts[stripComponents:]...)
+	if cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", fmt.Errorf("%w: %s", errUnsafeArchive, name)
+	}
+
+	target := filepath.Join(destination, filepath.FromSlash(cleaned))
+	if !isWithin(destination, target) {
+		return "", fmt.Errorf("%w: %s", errUnsafeArchive, name)
+	}
+
+	return target, nil
+}
+
+// isWithin reports whether target is root or one of its descendants.
+func isWithin(root, target string) bool {
+	rel, err := filepath.Rel(root, target)
+	if err != nil {
+		return false
+	}
+
+	return rel == "." || (rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)))
+}
+
+// checkLinkTarget rejects the symbolic link target, created with linkName,
+// when it points outside of destination. The link name is resolved against
+// the links already extracted, ".." applying to the resolved parent as it
+// does when the link is followed.
+func checkLinkTarget(destination, target, linkName string) error {
+	linkName = filepath.FromSlash(linkName)
+	if !filepath.IsAbs(linkName) {
+		// Not joined, cleaning would apply ".." before the links are
+		// resolved
+		linkName = filepath.Dir(target) + string(filepath.Separator) + linkName
+	}
+
+	resolved, err := resolvePath(linkName)
+	if err != nil {
+		return fmt.Errorf("%w: link %s: %s", errUnsafeArchive, target, err)
+	}
+
+	if !isWithin(destination, resolved) {
+		return fmt.Errorf("%w: link %s resolves to %s", errUnsafeArchive, target, resolved)
+	}
+
+	return nil
+}
+
+// checkExtractedLinks checks every symbolic link under destination once the
+// extraction is complete, a link created later in the archive changing where
+// the links pointing through it resolve.
+func checkExtractedLinks(destination string) error {
+	return filepath.WalkDir(destination, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.Type()&fs.ModeSymlink == 0 {
+			return err
+		}
+
+		link, err := os.Readlink(p)
+		if err != nil {
+			return err
+		}
+
+		return checkLinkTarget(destination, p, link)
+	})
+}
+
+// resolvePath resolves the absolute path p the way the kernel does when
+// following it: symbolic links are followed element by element and ".."
+// applies to the resolved parent. Missing elements are kept as is.
+func resolvePath(p string) (string, error) {
+	hops := 0
+	return resolvePathFrom(string(filepath.Separator), p, &hops)
+}
+
+func resolvePathFrom(resolved, p string, hops *int) (string, error) {
+	if filepath.IsAbs(p) {
+		resolved = filepath.VolumeName(p) + string(filepath.Separator)
+		p = p[len(filepath.VolumeName(p)):]
+	}
+
+	for _, element := range strings.Split(p, string(filepath.Separator)) {
+		switch element {
+		case "", ".":
+			continue
+		case "..":
+			resolved = filepath.Dir(resolved)
+			continue
+		}
+
+		next := filepath.Join(resolved, element)
+		info, err := os.Lstat(next)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return "", err
+		}
+		if err != nil || info.Mode()&fs.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		*hops++
+		if *hops > maxLinkHops {
+			return "", errTooManyLinks
+		}
+
+		link, err := os.Readlink(next)
+		if err != nil {
+			return "", err
+		}
+
+		resolved, err = resolvePathFrom(resolved, link, hops)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return resolved, nil
+}
+
+// ensureNoSymlinkParent makes sure no parent directory of target inside
+// destination is a symbolic link, which a crafted archive could use to write
+// outside of destination.
+func ensureNoSymlinkParent(destination, target string) error {
+	for dir := filepath.Dir(target); dir != destination && isWithin(destination, dir); dir = filepath.Dir(dir) {
+		info, err := os.Lstat(dir)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if info.Mode()&fs.ModeSymlink != 0 {
+			return fmt.Errorf("%w: %s traverses a symbolic link", errUnsafeArchive, target)
+		}
+	}
+
+	return nil
+}
+
+func extractTarGz(archivePath, destination string, stripComponents int, maxSize int64) error {
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	destination, err = extractionRoot(destination)
+	if err != nil {
+		return err
+	}
+
+	remaining := sizeLimit(maxSize)
+
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return checkExtractedLinks(destination)
+		}
+		if err != nil {
+			return err
+		}
+
+		target, err := archiveEntryPath(destination, header.Name, stripComponents)
+		if err != nil {
+			return err
+		}
+		if target == "" {
+			continue
+		}
+
+		err = ensureNoSymlinkParent(destination, target)
+		if err != nil {
+			return err
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, 0755)
+		case tar.TypeReg:
+			err = writeArchiveFile(target, tr, fs.FileMode(header.Mode).Perm(), remaining)
+		case tar.TypeSymlink:
+			err = checkLinkTarget(destination, target, header.Linkname)
+			if err == nil {
+				err = createSymlink(target, header.Linkname)
+			}
+		case tar.TypeLink:
+			var linkTarget string
+			linkTarget, err = archiveEntryPath(destination, header.Linkname, stripComponents)
+			if err == nil && linkTarget != "" {
+				err = ensureNoSymlinkParent(destination, linkTarget)
+			}
+			if err == nil && linkTarget != "" {
+				err = checkNotExists(target)
+			}
+			if err == nil && linkTarget != "" {
+				// The link is not followed, a hard link to a symbolic
+				// link is a symbolic link checked like the others
+				err = os.Link(linkTarget, target)
+			}
+		default:
+			log.Debug().
+				Str("entry", header.Name).
+				Msg("Skipping unsupported archive entry")
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func extractZip(archivePath, destination string, stripComponents int, maxSize int64) error {
+	reader, err := zip.OpenReader(archivePath)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	destination, err = extractionRoot(destination)
+	if err != nil {
+		return err
+	}
+
+	remaining := sizeLimit(maxSize)
+
+	for _, file := range reader.File {
+		target, err := archiveEntryPath(destination, file.Name, stripComponents)
+		if err != nil {
+			return err
+		}
+		if target == "" {
+			continue
+		}
+
+		err = ensureNoSymlinkParent(destination, target)
+		if err != nil {
+			return err
+		}
+
+		if file.FileInfo().IsDir() {
+			err = os.MkdirAll(target, 0755)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		rc, err := file.Open()
+		if err != nil {
+			return err
+		}
+
+		if file.Mode()&fs.ModeSymlink != 0 {
+			var link []byte
+			link, err = io.ReadAll(io.LimitReader(rc, 4096))
+			if err == nil {
+				err = checkLinkTarget(destination, target, string(link))
+			}
+			if err == nil {
+				err = createSymlink(target, string(link))
+			}
+		} else {
+			err = writeArchiveFile(target, rc, file.Mode().Perm(), remaining)
+		}
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return checkExtractedLinks(destination)
+}
+
+// sizeLimit returns the remaining size counter of an extraction limited to
+// maxSize, nil when it is not limited.
+func sizeLimit(maxSize int64) *int64 {
+	if maxSize <= 0 {
+		return nil
+	}
+
+	return &maxSize
+}
+
+// writeArchiveFile writes the content of r to target, a new file, deducting
+// its size from remaining when not nil. Existing entries are never written
+// through, an archive could otherwise write to the target of a symbolic
+// link.
+func writeArchiveFile(target string, r io.Reader, perm fs.FileMode, remaining *int64) error {
+	err := os.MkdirAll(filepath.Dir(target), 0755)
+	if err != nil {
+		return err
+	}
+
+	err = checkNotExists(target)
+	if err != nil {
+		return err
+	}
+
+	if perm == 0 {
+		perm = 0644
+	}
+
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, perm)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if remaining == nil {
+		_, err = io.Copy(f, r)
+		return err
+	}
+
+	n, err := io.Copy(f, io.LimitReader(r, *remaining+1))
+	*remaining -= n
+	if err == nil && *remaining < 0 {
+		err = errArchiveTooLarge
+	}
+
+	return err
+}
+
+// checkNotExists rejects duplicate archive entries, a later entry replacing
+// a file or link extracted before it.
+func checkNotExists(target string) error {
+	_, err := os.Lstat(target)
+	if err == nil {
+		return fmt.Errorf("%w: duplicate entry %s", errUnsafeArchive, target)
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+func createSymlink(target, linkName string) error {
+	err := os.MkdirAll(filepath.Dir(target), 0755)
+	if err != nil {
+		return err
+	}
+
+	return os.Symlink(linkName, target)
+}
+
+// createTarGz packages the content of dir, without its .git directory, into
+// a gzipped tarball.
+func createTarGz(dir string) ([]byte, error) {
+	var buf bytes.Buffer
+
+	err := writeTarGz(&buf, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// writeTarGz streams the content of dir, without its .git directories, to w
+// as a gzipped tarball.
+func writeTarGz(w io.Writer, dir string) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, p)
+		if err != nil || rel == "." {
+			return err
+		}
+
+		if d.IsDir() && d.Name() == ".git" {
+			return filepath.SkipDir
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		link := ""
+		if info.Mode()&fs.ModeSymlink != 0 {
+			link, err = os.Readlink(p)
+			if err != nil {
+				return err
+			}
+		}
+
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(rel)
+		if d.IsDir() {
+			header.Name += "/"
+		}
+
+		err = tw.WriteHeader(header)
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	err = tw.Close()
+	if err != nil {
+		return err
+	}
+
+	return gz.Close()
+}
+
+// copyDir recursively copies the regular files, directories and symbolic
+// links of source into destination.
+func copyDir(source, destination string) error {
+	return filepath.WalkDir(source, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(source, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(destination, rel)
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case d.IsDir():
+			return os.MkdirAll(target, 0755)
+		case info.Mode()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case info.Mode().IsRegular():
+			f, err := os.Open(p)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+
+			return writeArchiveFile(target, f, info.Mode().Perm(), nil)
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// archiveEntry is a tar or zip entry, a symbolic link when link is set.
+type archiveEntry struct {
+	name    string
+	content string
+	link    string
+	dir     bool
+}
+
+func writeTestTarGz(t *testing.T, entries []archiveEntry) string {
+	t.Helper()
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+
+	for _, entry := range entries {
+		header := &tar.Header{Name: entry.name, Mode: 0644, Typeflag: tar.TypeReg, Size: int64(len(entry.content))}
+		switch {
+		case entry.dir:
+			header = &tar.Header{Name: entry.name, Mode: 0755, Typeflag: tar.TypeDir}
+		case entry.link != "":
+			header = &tar.Header{Name: entry.name, Mode: 0777, Typeflag: tar.TypeSymlink, Linkname: entry.link}
+		}
+
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if header.Typeflag == tar.TypeReg {
+			if _, err := tw.Write([]byte(entry.content)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	archivePath := filepath.Join(t.TempDir(), "stack.tar.gz")
+	if err := os.WriteFile(archivePath, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return archivePath
+}
+
+func writeTestZip(t *testing.T, entries []archiveEntry) string {
+	t.Helper()
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+
+	for _, entry := range entries {
+		header := &zip.FileHeader{Name: entry.name, Method: zip.Deflate}
+		content := entry.content
+		switch {
+		case entry.dir:
+			header.Name = strings.TrimSuffix(entry.name, "/") + "/"
+			header.SetMode(fs.ModeDir | 0755)
+		case entry.link != "":
+			header.SetMode(fs.ModeSymlink | 0777)
+			content = entry.link
+		default:
+			header.SetMode(0644)
+		}
+
+		w, err := zw.CreateHeader(header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	archivePath := filepath.Join(t.TempDir(), "stack.zip")
+	if err := os.WriteFile(archivePath, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return archivePath
+}
+
+func TestExtractArchive(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []archiveEntry
+		wantErr error
+		files   map[string]string
+	}{
+		{
+			name: "regular files and links",
+			entries: []archiveEntry{
+				{name: "stack/", dir: true},
+				{name: "stack/docker-compose.yml", content: "services: {}"},
+				{name: "stack/compose.yml", link: "docker-compose.yml"},
+				{name: "stack/current", link: "."},
+			},
+			files: map[string]string{
+				"stack/docker-compose.yml": "services: {}",
+				"stack/compose.yml":        "services: {}",
+			},
+		},
+		{
+			name:    "parent path",
+			entries: []archiveEntry{{name: "../outside", content: "pwned"}},
+			wantErr: errUnsafeArchive,
+		},
+		{
+			name:    "absolute link",
+			entries: []archiveEntry{{name: "x", link: "/etc/passwd"}},
+			wantErr: errUnsafeArchive,
+		},
+		{
+			name:    "relative link escaping",
+			entries: []archiveEntry{{name: "x", link: "../outside"}},
+			wantErr: errUnsafeArchive,
+		},
+		{
+			name: "link chain through a link to the destination",
+			entries: []archiveEntry{
+				{name: "b", link: "."},
+				{name: "x", link: "b/b/../../outside"},
+				{name: "x", content: "pwned"},
+			},
+			wantErr: errUnsafeArchive,
+		},
+		{
+			name: "link made unsafe by a later link",
+			entries: []archiveEntry{
+				{name: "x", link: "b/../outside"},
+				{name: "b", link: "."},
+			},
+			wantErr: errUnsafeArchive,
+		},
+		{
+			name: "file written through a link",
+			entries: []archiveEntry{
+				{name: "x", link: "y"},
+				{name: "x", content: "pwned"},
+			},
+			wantErr: errUnsafeArchive,
+		},
+		{
+			name: "file written under a link",
+			entries: []archiveEntry{
+				{name: "dir", link: "."},
+				{name: "dir/x", content: "pwned"},
+			},
+			wantErr: errUnsafeArchive,
+		},
+		{
+			name:    "content over the size limit",
+			entries: []archiveEntry{{name: "big", content: strings.Repeat("a", 2048)}},
+			wantErr: errArchiveTooLarge,
+		},
+	}
+
+	formats := map[string]func(*testing.T, []archiveEntry) string{
+		".tar.gz": writeTestTarGz,
+		".zip":    writeTestZip,
+	}
+
+	for suffix, write := range formats {
+		for _, tt := range tests {
+			t.Run(suffix+" "+tt.name, func(t *testing.T) {
+				// outside is next to the destination and must keep its
+				// content
+				parent := t.TempDir()
+				destination := filepath.Join(parent, "destination")
+				outside := filepath.Join(parent, "outside")
+				if err := os.WriteFile(outside, []byte("original"), 0644); err != nil {
+					t.Fatal(err)
+				}
+
+				err := extractArchive(write(t, tt.entries), suffix, destination, 0, 1024)
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("extractArchive() error = %v, want %v", err, tt.wantErr)
+				}
+
+				content, err := os.ReadFile(outside)
+				if err != nil || string(content) != "original" {
+					t.Errorf("file outside of the destination changed: %q, %v", content, err)
+				}
+
+				for name, want := range tt.files {
+					content, err := os.ReadFile(filepath.Join(destination, name))
+					if err != nil || string(content) != want {
+						t.Errorf("%s = %q, %v, want %q", name, content, err, want)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestResolvePath(t *testing.T) {
+	root, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Mkdir(filepath.Join(root, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(".", filepath.Join(root, "self")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("dir", filepath.Join(root, "down")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("loop", filepath.Join(root, "loop")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path    string
+		want    string
+		wantErr error
+	}{
+		{path: "dir/file", want: "dir/file"},
+		{path: "self/self/dir", want: "dir"},
+		{path: "down/../missing/x", want: "missing/x"},
+		{path: "down/..", want: "."},
+		{path: "self/../x", want: "../x"},
+		{path: "loop/x", wantErr: errTooManyLinks},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			got, err := resolvePath(root + string(filepath.Separator) + filepath.FromSlash(tt.path))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("resolvePath() error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				return
+			}
+
+			if want := filepath.Join(root, filepath.FromSlash(tt.want)); got != want {
+				t.Errorf("resolvePath() = %s, want %s", got, want)
+			}
+		})
+	}
+}
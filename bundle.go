@@ -0,0 +1,338 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	bundleFormatVersion = 1
+	bundleManifestFile  = "manifest.json"
+	bundleImagesFile    = "images.tar"
+	bundleStackDir      = "stack"
+)
+
+var errInvalidBundle = errors.New("invalid stack bundle")
+
+// bundleManifest describes the content of a bundle archive. The archive holds
+// the manifest, the repository tree under the stack directory and the images
+// of the stack saved with docker save.
+type bundleManifest struct {
+	Version      int       `json:"version"`
+	Repository   string    `json:"repository"`
+	Reference    string    `json:"reference"`
+	Commit       string    `json:"commit,omitempty"`
+	ComposeFiles []string  `json:"composeFiles"`
+	Images       []string  `json:"images"`
+	CreatedAt    time.Time `json:"createdAt"`
+}
+
+func (cmd *BundleCommand) gitCloneConfig() GitCloneConfig {
+	return GitCloneConfig{
+		URL:                  cmd.GitRepository,
+		Reference:            cmd.Reference,
+		User:                 cmd.User,
+		Password:             cmd.Password,
+		Depth:                1,
+		RecurseSubmodules:    cmd.RecurseSubmodules,
+		SubmoduleCredentials: cmd.SubmoduleCredential,
+		LFS:                  cmd.LFS,
+		LFSPaths:             composeDirectories(cmd.Workdir, cmd.ComposeRelativeFilePaths),
+		Backend:              cmd.GitBackend,
+		Transport:            cmd.transportOptions(),
+	}
+}
+
+func (cmd *BundleCommand) transportOptions() TransportOptions {
+	return TransportOptions{
+		CAFile:        cmd.CAFile,
+		SkipTLSVerify: cmd.SkipTLSVerify,
+		HTTPProxy:     cmd.HTTPProxy,
+		HTTPSProxy:    cmd.HTTPSProxy,
+		NoProxy:       cmd.NoProxy,
+	}
+}
+
+func (cmd *BundleCommand) Run(cmdCtx *CommandExecutionContext) error {
+	log.Info().
+		Str("repository", cmd.GitRepository).
+		Str("reference", cmd.Reference).
+		Strs("composePath", cmd.ComposeRelativeFilePaths).
+		Str("output", cmd.Output).
+		Msg("Creating stack bundle from Git repository")
+
+	transportOpts := cmd.transportOptions()
+	err := checkStackPaths(cmd.Workdir, cmd.ComposeRelativeFilePaths, nil)
+	if err != nil {
+		return err
+	}
+
+	err = configureGitTransport(transportOpts)
+	if err != nil {
+		return err
+	}
+
+	removeRegistryCA := installRegistryCA(transportOpts, cmd.Registry)
+	defer removeRegistryCA()
+	defer dockerLogout(cmd.Registry, transportOpts)
+	err = dockerLogin(cmd.Registry, transportOpts)
+	if err != nil {
+		return err
+	}
+
+	stagingDir, err := os.MkdirTemp("", "unpacker-bundle-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(stagingDir)
+
+	clonePath := filepath.Join(stagingDir, bundleStackDir)
+	err = cloneRepository(cmdCtx.context, clonePath, cmd.gitCloneConfig())
+	if err != nil {
+		log.Error().
+			Err(err).
+			Msg("Failed to clone Git repository")
+		return err
+	}
+
+	composeRelativeFilePaths, err := resolveComposeFiles(clonePath, cmd.Workdir, cmd.ComposeRelativeFilePaths)
+	if err != nil {
+		log.Error().
+			Err(err).
+			Msg("Failed to resolve compose files")
+		return err
+	}
+
+	composeFilePaths := make([]string, len(composeRelativeFilePaths))
+	for i := 0; i < len(composeRelativeFilePaths); i++ {
+		composeFilePaths[i] = path.Join(clonePath, composeRelativeFilePaths[i])
+	}
+
+	images, err := composeImages(cmdCtx.context, clonePath, composeFilePaths, cmd.Env)
+	if err != nil {
+		log.Error().
+			Err(err).
+			Msg("Failed to resolve the images of the stack")
+		return err
+	}
+
+	log.Info().
+		Strs("images", images).
+		Msg("Pulling stack images")
+
+	env := append(transportOpts.proxyEnv(), cmd.Env...)
+	_, err = runComposeCommand(cmdCtx.context, clonePath, "", composeFilePaths, env, "pull")
+	if err != nil {
+		log.Error().
+			Err(err).
+			Msg("Failed to pull stack images")
+		return err
+	}
+
+	if len(images) > 0 {
+		args := []string{"--config", PORTAINER_DOCKER_CONFIG_PATH, "save", "-o", filepath.Join(stagingDir, bundleImagesFile)}
+		err = runCommandAndCaptureStdErr(getDockerBinaryPath(), append(args, images...), nil, "")
+		if err != nil {
+			log.Error().
+				Err(err).
+				Msg("Failed to save stack images")
+			return err
+		}
+	}
+
+	manifest := bundleManifest{
+		Version:      bundleFormatVersion,
+		Repository:   cmd.GitRepository,
+		Reference:    cmd.Reference,
+		Commit:       headCommit(clonePath),
+		ComposeFiles: composeRelativeFilePaths,
+		Images:       images,
+		CreatedAt:    time.Now().UTC(),
+	}
+
+	content, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = os.WriteFile(filepath.Join(stagingDir, bundleManifestFile), content, 0644)
+	if err != nil {
+		return err
+	}
+
+	err = writeBundle(cmd.Output, stagingDir)
+	if err != nil {
+		log.Error().
+			Err(err).
+			Msg("Failed to write stack bundle")
+		return err
+	}
+
+	log.Info().
+		Str("output", cmd.Output).
+		Str("commit", manifest.Commit).
+		Int("images", len(images)).
+		Msg("Stack bundle created")
+
+	return nil
+}
+
+// writeBundle packages stagingDir into output, through a temporary file so an
+// interrupted run never leaves a truncated bundle behind.
+func writeBundle(output, stagingDir string) error {
+	err := os.MkdirAll(filepath.Dir(output), 0755)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(output), filepath.Base(output)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	err = writeTarGz(f, stagingDir)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), output)
+}
+
+// headCommit returns the commit checked out in clonePath, or an empty string
+// when it cannot be resolved.
+func headCommit(clonePath string) string {
+	repository, err := git.PlainOpen(clonePath)
+	if err != nil {
+		return ""
+	}
+
+	head, err := repository.Head()
+	if err != nil {
+		return ""
+	}
+
+	return head.Hash().String()
+}
+
+// readBundleManifest reads the manifest of the bundle archive at bundlePath.
+func readBundleManifest(bundlePath string) (*bundleManifest, error) {
+	f, err := os.Open(bundlePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("%w: missing %s", errInvalidBundle, bundleManifestFile)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if path.Clean(header.Name) != bundleManifestFile {
+			continue
+		}
+
+		var manifest bundleManifest
+		err = json.NewDecoder(tr).Decode(&manifest)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", errInvalidBundle, err)
+		}
+
+		if manifest.Version != bundleFormatVersion {
+			return nil, fmt.Errorf("%w: unsupported version %d", errInvalidBundle, manifest.Version)
+		}
+
+		return &manifest, nil
+	}
+}
+
+// bundleSource deploys a stack from a bundle archive. The images of the
+// bundle are loaded into the local Docker engine, no Git remote or registry
+// is contacted.
+type bundleSource struct {
+	path     string
+	manifest *bundleManifest
+}
+
+func newBundleSource(bundlePath string) (*bundleSource, error) {
+	manifest, err := readBundleManifest(bundlePath)
+	if err != nil {
+		return nil, err
+	}
+
+	return &bundleSource{path: bundlePath, manifest: manifest}, nil
+}
+
+func (s *bundleSource) Name() string {
+	name := s.manifest.Repository[strings.LastIndex(s.manifest.Repository, "/")+1:]
+	if name = strings.TrimSuffix(name, ".git"); name == "" {
+		return archiveName(s.path)
+	}
+
+	return name
+}
+
+func (s *bundleSource) Fetch(ctx context.Context, clonePath string) error {
+	log.Info().
+		Str("bundle", s.path).
+		Str("repository", s.manifest.Repository).
+		Str("commit", s.manifest.Commit).
+		Msg("Unpacking stack bundle")
+
+	// Extract next to clonePath so that the stack directory can be renamed
+	// into place
+	extractDir, err := os.MkdirTemp(filepath.Dir(clonePath), ".bundle-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(extractDir)
+
+	err = extractTarGz(s.path, extractDir, 0, 0)
+	if err != nil {
+		return err
+	}
+
+	if len(s.manifest.Images) > 0 {
+		log.Info().
+			Strs("images", s.manifest.Images).
+			Msg("Loading stack images")
+
+		args := []string{"--config", PORTAINER_DOCKER_CONFIG_PATH, "load", "-i", filepath.Join(extractDir, bundleImagesFile)}
+		err = runCommandAndCaptureStdErr(getDockerBinaryPath(), args, nil, "")
+		if err != nil {
+			return fmt.Errorf("failed to load bundle images: %w", err)
+		}
+	}
+
+	return os.Rename(filepath.Join(extractDir, bundleStackDir), clonePath)
+}
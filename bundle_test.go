@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBundleSourceFetch(t *testing.T) {
+	// The saved images make bundles larger than the stack archives, they are
+	// not subject to the archive size limit
+	limit := maxArchiveSize
+	maxArchiveSize = 1024
+	defer func() { maxArchiveSize = limit }()
+
+	manifest, err := json.Marshal(bundleManifest{
+		Version:      bundleFormatVersion,
+		Repository:   "https://github.com/org/web.git",
+		ComposeFiles: []string{"docker-compose.yml"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stagingDir := writeTestFiles(t, t.TempDir(), map[string]string{
+		bundleManifestFile:                         string(manifest),
+		bundleImagesFile:                           strings.Repeat("a", 2048),
+		bundleStackDir + "/docker-compose.yml":     "services:\n  web:\n    image: nginx\n",
+		bundleStackDir + "/conf/large-config.conf": strings.Repeat("b", 2048),
+	})
+
+	bundlePath := filepath.Join(t.TempDir(), "web.tar.gz")
+	if err := writeBundle(bundlePath, stagingDir); err != nil {
+		t.Fatal(err)
+	}
+
+	source, err := newBundleSource(bundlePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := source.Name(); name != "web" {
+		t.Errorf("Name() = %s, want web", name)
+	}
+
+	clonePath := filepath.Join(t.TempDir(), "web")
+	if err := source.Fetch(context.Background(), clonePath); err != nil {
+		t.Fatalf("Fetch() error = %v", err)
+	}
+
+	assertTestFiles(t, clonePath, map[string]string{
+		"docker-compose.yml":     "services:\n  web:\n    image: nginx\n",
+		"conf/large-config.conf": strings.Repeat("b", 2048),
+	})
+
+	if _, err := os.Stat(filepath.Join(clonePath, bundleImagesFile)); !os.IsNotExist(err) {
+		t.Errorf("images archive extracted into the stack: %v", err)
+	}
+}
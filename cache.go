@@ -0,0 +1,365 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	cacheLockRetryInterval = 500 * time.Millisecond
+	cacheLockTimeout       = 10 * time.Minute
+	// cacheLockRefreshInterval is the interval at which a held lock is
+	// refreshed, well below cacheLockStaleAge
+	cacheLockRefreshInterval = time.Minute
+	// cacheLockStaleAge is the age after which a lock left behind by a
+	// crashed process is ignored
+	cacheLockStaleAge = 30 * time.Minute
+)
+
+const (
+	// mirrorClonesFile lists, inside a mirror, the repositories created
+	// with alternates pointing to it
+	mirrorClonesFile = "unpacker-clones"
+)
+
+var (
+	errCacheLockTimeout  = errors.New("timed out waiting for the Git cache lock")
+	errReferenceNotFound = errors.New("reference not found in remote repository")
+
+	unsafeCacheNameChars = regexp.MustCompile(`[^a-zA-Z0-9._-]+`)
+)
+
+// normalizeRepositoryURL reduces a repository URL to host and path so that
+// the different spellings of one repository share a mirror: scheme, user
+// info, letter case of the host and a trailing ".git" are ignored.
+func normalizeRepositoryURL(repositoryURL string) string {
+	endpoint, err := transport.NewEndpoint(repositoryURL)
+	if err != nil {
+		return repositoryURL
+	}
+
+	host := strings.ToLower(endpoint.Host)
+	if endpoint.Port != 0 {
+		host += ":" + strconv.Itoa(endpoint.Port)
+	}
+
+	p := strings.TrimSuffix(strings.TrimSuffix(endpoint.Path, "/"), ".git")
+	return host + "/" + strings.TrimPrefix(p, "/")
+}
+
+// mirrorPath returns the location of the bare mirror of repositoryURL inside
+// cacheDir.
+func mirrorPath(cacheDir, repositoryURL string) string {
+	normalized := normalizeRepositoryURL(repositoryURL)
+	sum := sha256.Sum256([]byte(normalized))
+
+	name := unsafeCacheNameChars.ReplaceAllString(filepath.Base(normalized), "_")
+	return filepath.Join(cacheDir, fmt.Sprintf("%s-%s.git", name, hex.EncodeToString(sum[:8])))
+}
+
+// lockMirror takes an exclusive lock on the mirror at mirrorPath, waiting for
+// other unpacker processes to release it. The lock file holds a token
+// identifying its owner and its modification time is refreshed while the lock
+// is held, so that only the locks left behind by crashed processes go stale.
+// The returned function releases it.
+func lockMirror(ctx context.Context, mirrorPath string) (func(), error) {
+	lockPath := mirrorPath + ".lock"
+	deadline := time.Now().Add(cacheLockTimeout)
+
+	token, err := newLockToken()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		f, err := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			_, err = fmt.Fprintln(f, token)
+			f.Close()
+			if err != nil {
+				os.Remove(lockPath)
+				return nil, err
+			}
+
+			return holdLock(lockPath, token), nil
+		}
+
+		if !errors.Is(err, os.ErrExist) {
+			return nil, err
+		}
+
+		info, statErr := os.Stat(lockPath)
+		if statErr == nil && time.Since(info.ModTime()) > cacheLockStaleAge {
+			log.Warn().
+				Str("lock", lockPath).
+				Str("owner", readLockToken(lockPath)).
+				Msg("Removing stale Git cache lock")
+			breakStaleLock(lockPath, token)
+			continue
+		}
+
+		if time.Now().After(deadline) {
+			return nil, errCacheLockTimeout
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(cacheLockRetryInterval):
+		}
+	}
+}
+
+// holdLock refreshes the modification time of the lock file owned by token
+// until the returned function is called, which then removes the lock file if
+// it is still owned by token.
+func holdLock(lockPath, token string) func() {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+
+		ticker := time.NewTicker(cacheLockRefreshInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+
+			if owner := readLockToken(lockPath); owner != token {
+				log.Warn().
+					Str("lock", lockPath).
+					Str("owner", owner).
+					Msg("Git cache lock taken over by another process")
+				return
+			}
+
+			now := time.Now()
+			err := os.Chtimes(lockPath, now, now)
+			if err != nil {
+				log.Warn().
+					Err(err).
+					Str("lock", lockPath).
+					Msg("Failed to refresh Git cache lock")
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+			<-stopped
+
+			if readLockToken(lockPath) == token {
+				os.Remove(lockPath)
+			}
+		})
+	}
+}
+
+// breakStaleLock removes a stale lock file. The lock is first renamed out of
+// the way so that, when another process replaced it after it was found
+// stale, the fresh lock can be put back instead of being removed.
+func breakStaleLock(lockPath, token string) {
+	stalePath := lockPath + "." + token + ".stale"
+	if err := os.Rename(lockPath, stalePath); err != nil {
+		return
+	}
+	defer os.Remove(stalePath)
+
+	info, err := os.Stat(stalePath)
+	if err == nil && time.Since(info.ModTime()) <= cacheLockStaleAge {
+		os.Link(stalePath, lockPath)
+	}
+}
+
+func newLockToken() (string, error) {
+	nonce := make([]byte, 8)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%d-%s", os.Getpid(), hex.EncodeToString(nonce)), nil
+}
+
+func readLockToken(lockPath string) string {
+	content, err := os.ReadFile(lockPath)
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimSpace(string(content))
+}
+
+// cloneFromCache fetches the requested reference into the shared mirror of
+// the repository, then creates the stack repository at clonePath borrowing
+// the objects of the mirror through Git alternates.
+func cloneFromCache(ctx context.Context, backend GitBackend, clonePath string, cfg GitCloneConfig) error {
+	err := os.MkdirAll(cfg.CacheDir, 0755)
+	if err != nil {
+		return err
+	}
+
+	mirror := mirrorPath(cfg.CacheDir, cfg.URL)
+
+	unlock, err := lockMirror(ctx, mirror)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	log.Info().
+		Str("mirror", mirror).
+		Str("reference", cfg.Reference).
+		Int("depth", cfg.Depth).
+		Msg("Fetching into Git cache mirror")
+
+	referenceName, hash, err := backend.Fetch(ctx, mirror, cfg)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	err = os.Chtimes(mirror, now, now)
+	if err != nil {
+		return err
+	}
+
+	return backend.Checkout(ctx, clonePath, mirror, referenceName, hash, cfg)
+}
+
+// writeAlternates makes the repository at clonePath read its missing objects
+// from the mirror, and records clonePath in the mirror so that the mirror is
+// not pruned while the repository borrows its objects. The mirror must be
+// locked.
+func writeAlternates(clonePath, mirror string) error {
+	alternates := filepath.Join(clonePath, ".git", "objects", "info", "alternates")
+	err := os.MkdirAll(filepath.Dir(alternates), 0755)
+	if err != nil {
+		return err
+	}
+
+	err = os.WriteFile(alternates, []byte(filepath.Join(mirror, "objects")+"\n"), 0644)
+	if err != nil {
+		return err
+	}
+
+	absoluteClonePath, err := filepath.Abs(clonePath)
+	if err != nil {
+		return err
+	}
+
+	clones := append(mirrorClones(mirror), absoluteClonePath)
+
+	return os.WriteFile(filepath.Join(mirror, mirrorClonesFile), []byte(strings.Join(uniqueStrings(clones), "\n")+"\n"), 0644)
+}
+
+// mirrorClones returns the recorded repositories still borrowing the objects
+// of the mirror through their alternates. The mirror must be locked.
+func mirrorClones(mirror string) []string {
+	objects := filepath.Join(mirror, "objects")
+
+	clones := []string{}
+	for _, clonePath := range readLines(filepath.Join(mirror, mirrorClonesFile)) {
+		if containsString(readLines(filepath.Join(clonePath, ".git", "objects", "info", "alternates")), objects) {
+			clones = append(clones, clonePath)
+		}
+	}
+
+	return clones
+}
+
+// readLines returns the non empty lines of the file, none when it cannot be
+// read.
+func readLines(name string) []string {
+	content, err := os.ReadFile(name)
+	if err != nil {
+		return nil
+	}
+
+	return strings.FieldsFunc(string(content), func(r rune) bool {
+		return r == '\n' || r == '\r'
+	})
+}
+
+// pruneGitCache removes the mirrors of cacheDir that have not been used for
+// longer than maxAge. Mirrors locked by another process, or whose objects are
+// still borrowed by a stack repository, are left alone.
+func pruneGitCache(ctx context.Context, cacheDir string, maxAge time.Duration) {
+	if maxAge <= 0 {
+		return
+	}
+
+	entries, err := os.ReadDir(cacheDir)
+	if err != nil {
+		log.Warn().
+			Err(err).
+			Str("cacheDir", cacheDir).
+			Msg("Failed to list Git cache")
+		return
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() || !strings.HasSuffix(entry.Name(), ".git") {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < maxAge {
+			continue
+		}
+
+		mirror := filepath.Join(cacheDir, entry.Name())
+		if _, err := os.Stat(mirror + ".lock"); err == nil {
+			continue
+		}
+
+		unlock, err := lockMirror(ctx, mirror)
+		if err != nil {
+			continue
+		}
+
+		if clones := mirrorClones(mirror); len(clones) > 0 {
+			unlock()
+			log.Debug().
+				Str("mirror", mirror).
+				Strs("repositories", clones).
+				Msg("Keeping Git cache mirror used by stack repositories")
+			continue
+		}
+
+		log.Info().
+			Str("mirror", mirror).
+			Time("lastUsed", info.ModTime()).
+			Msg("Removing unused Git cache mirror")
+
+		err = os.RemoveAll(mirror)
+		unlock()
+		if err != nil {
+			log.Warn().
+				Err(err).
+				Str("mirror", mirror).
+				Msg("Failed to remove Git cache mirror")
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPruneGitCache(t *testing.T) {
+	tests := []struct {
+		name     string
+		borrowed bool
+		removed  bool
+		age      time.Duration
+	}{
+		{name: "unused old mirror", age: 48 * time.Hour, removed: true},
+		{name: "recently used mirror", age: time.Hour},
+		{name: "old mirror borrowed by a stack", age: 48 * time.Hour, borrowed: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cacheDir := t.TempDir()
+			mirror := mirrorPath(cacheDir, "https://example.com/org/repo.git")
+			if err := os.MkdirAll(filepath.Join(mirror, "objects"), 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			clonePath := filepath.Join(t.TempDir(), "clone")
+			if err := writeAlternates(clonePath, mirror); err != nil {
+				t.Fatal(err)
+			}
+			if !tt.borrowed {
+				if err := os.RemoveAll(clonePath); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			modTime := time.Now().Add(-tt.age)
+			if err := os.Chtimes(mirror, modTime, modTime); err != nil {
+				t.Fatal(err)
+			}
+
+			pruneGitCache(context.Background(), cacheDir, 24*time.Hour)
+
+			_, err := os.Stat(mirror)
+			if removed := os.IsNotExist(err); removed != tt.removed {
+				t.Errorf("mirror removed = %v, want %v", removed, tt.removed)
+			}
+		})
+	}
+}
+
+// setCacheLockTimings shortens the lock intervals for the duration of the
+// test.
+func setCacheLockTimings(t *testing.T, retry, refresh, stale time.Duration) {
+	t.Helper()
+
+	previousRetry, previousRefresh, previousStale := cacheLockRetryInterval, cacheLockRefreshInterval, cacheLockStaleAge
+	cacheLockRetryInterval, cacheLockRefreshInterval, cacheLockStaleAge = retry, refresh, stale
+	t.Cleanup(func() {
+		cacheLockRetryInterval, cacheLockRefreshInterval, cacheLockStaleAge = previousRetry, previousRefresh, previousStale
+	})
+}
+
+func TestLockMirrorConcurrency(t *testing.T) {
+	setCacheLockTimings(t, time.Millisecond, 5*time.Millisecond, 50*time.Millisecond)
+
+	mirror := filepath.Join(t.TempDir(), "repo.git")
+
+	var holders, maxHolders int32
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for j := 0; j < 5; j++ {
+				unlock, err := lockMirror(context.Background(), mirror)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+
+				n := atomic.AddInt32(&holders, 1)
+				for {
+					highest := atomic.LoadInt32(&maxHolders)
+					if n <= highest || atomic.CompareAndSwapInt32(&maxHolders, highest, n) {
+						break
+					}
+				}
+
+				// Hold the lock longer than the stale age, the refreshes
+				// must keep the waiters from breaking it
+				if j == 0 {
+					time.Sleep(80 * time.Millisecond)
+				}
+
+				atomic.AddInt32(&holders, -1)
+				unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if maxHolders != 1 {
+		t.Errorf("lock held by %d processes at once, want 1", maxHolders)
+	}
+	if _, err := os.Stat(mirror + ".lock"); !os.IsNotExist(err) {
+		t.Errorf("lock file left behind: %v", err)
+	}
+}
+
+func TestLockMirrorStale(t *testing.T) {
+	setCacheLockTimings(t, time.Millisecond, time.Hour, 50*time.Millisecond)
+
+	mirror := filepath.Join(t.TempDir(), "repo.git")
+
+	// A lock left behind by a process that stopped refreshing it
+	crashedUnlock, err := lockMirror(context.Background(), mirror)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crashedToken := readLockToken(mirror + ".lock")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := lockMirror(ctx, mirror); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("lockMirror() on a fresh lock error = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	staleTime := time.Now().Add(-time.Minute)
+	if err := os.Chtimes(mirror+".lock", staleTime, staleTime); err != nil {
+		t.Fatal(err)
+	}
+
+	unlock, err := lockMirror(context.Background(), mirror)
+	if err != nil {
+		t.Fatalf("lockMirror() on a stale lock error = %v", err)
+	}
+
+	token := readLockToken(mirror + ".lock")
+	if token == "" || token == crashedToken {
+		t.Fatalf("lock owner = %q, want a new owner", token)
+	}
+
+	// The previous owner releasing its lock must not remove the new one
+	crashedUnlock()
+	if owner := readLockToken(mirror + ".lock"); owner != token {
+		t.Errorf("lock owner after the previous owner released = %q, want %q", owner, token)
+	}
+
+	unlock()
+	if _, err := os.Stat(mirror + ".lock"); !os.IsNotExist(err) {
+		t.Errorf("lock file left behind: %v", err)
+	}
+
+	matches, _ := filepath.Glob(mirror + ".lock.*")
+	if len(matches) > 0 {
+		t.Errorf("stale lock files left behind: %v", matches)
+	}
+}
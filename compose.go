@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	// composeFileNames and composeOverrideFileNames are the files looked up
+	// by docker compose when no file is given, in order of precedence
+	composeFileNames         = []string{"compose.yaml", "compose.yml", "docker-compose.yml", "docker-compose.yaml"}
+	composeOverrideFileNames = []string{"compose.override.yml", "compose.override.yaml", "docker-compose.override.yml", "docker-compose.override.yaml"}
+
+	errInvalidWorkdir        = errors.New("invalid working directory")
+	errComposeFileNotFound   = errors.New("no compose file found")
+	errAmbiguousComposeFiles = errors.New("ambiguous compose files")
+)
+
+// resolveComposeFiles returns the compose files of the stack, relative to the
+// clone root. The given paths are relative to workdir. When none is given,
+// workdir is searched for the standard compose file names and the matching
+// override file, several candidates being an error rather than a guess.
+func resolveComposeFiles(clonePath, workdir string, composeRelativeFilePaths []string) ([]string, error) {
+	workdir = path.Clean(filepath.ToSlash(workdir))
+	if err := checkPathInside(clonePath, workdir); err != nil {
+		return nil, fmt.Errorf("%w: %s", errInvalidWorkdir, err)
+	}
+
+	if len(composeRelativeFilePaths) > 0 {
+		composeFilePaths := make([]string, len(composeRelativeFilePaths))
+		for i, composeFilePath := range composeRelativeFilePaths {
+			composeFilePaths[i] = path.Join(workdir, composeFilePath)
+
+			err := checkPathInside(clonePath, composeFilePaths[i])
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		return composeFilePaths, nil
+	}
+
+	searchPath := filepath.Join(clonePath, filepath.FromSlash(workdir))
+
+	configFiles, err := findComposeFiles(searchPath, composeFileNames)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(configFiles) == 0 {
+		return nil, fmt.Errorf("%w in %q, expected one of %s", errComposeFileNotFound, workdir, strings.Join(composeFileNames, ", "))
+	}
+	if len(configFiles) > 1 {
+		return nil, fmt.Errorf("%w in %q: %s", errAmbiguousComposeFiles, workdir, strings.Join(configFiles, ", "))
+	}
+
+	overrideFiles, err := findComposeFiles(searchPath, composeOverrideFileNames)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(overrideFiles) > 1 {
+		return nil, fmt.Errorf("%w in %q: %s", errAmbiguousComposeFiles, workdir, strings.Join(overrideFiles, ", "))
+	}
+
+	composeFilePaths := []string{}
+	for _, name := range append(configFiles, overrideFiles...) {
+		composeFilePath := path.Join(workdir, name)
+
+		// The discovered files may be symbolic links too
+		err = checkPathInside(clonePath, composeFilePath)
+		if err != nil {
+			return nil, err
+		}
+
+		composeFilePaths = append(composeFilePaths, composeFilePath)
+	}
+
+	log.Info().
+		Str("workdir", workdir).
+		Strs("composeFilePaths", composeFilePaths).
+		Msg("Discovered compose files")
+
+	return composeFilePaths, nil
+}
+
+// findComposeFiles returns the names of the regular files of dir found in
+// names, keeping their order.
+func findComposeFiles(dir string, names []string) ([]string, error) {
+	found := []string{}
+
+	for _, name := range names {
+		info, err := os.Stat(filepath.Join(dir, name))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if info.Mode().IsRegular() {
+			found = append(found, name)
+		}
+	}
+
+	return found, nil
+}
+
+// runComposeCommand runs the docker-compose binary shipped with the unpacker
+// against composeFilePaths, using the Portainer Docker configuration, and
+// returns its standard output.
+func runComposeCommand(ctx context.Context, workingDir, projectName string, composeFilePaths []string, env []string, args ...string) (string, error) {
+	globalArgs := []string{}
+	for _, composeFilePath := range composeFilePaths {
+		globalArgs = append(globalArgs, "-f", composeFilePath)
+	}
+	if projectName != "" {
+		globalArgs = append(globalArgs, "--project-name", projectName)
+	}
+
+	var stdout, stderr bytes.Buffer
+	command := getDockerComposeBinaryPath()
+	cmd := exec.CommandContext(ctx, command, append(globalArgs, args...)...)
+	cmd.Dir = workingDir
+	cmd.Env = append(os.Environ(), "DOCKER_CONFIG="+PORTAINER_DOCKER_CONFIG_PATH)
+	cmd.Env = append(cmd.Env, env...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	log.Debug().
+		Str("command", command).
+		Strs("args", cmd.Args[1:]).
+		Msg("Running docker compose")
+
+	err := cmd.Run()
+	if err != nil {
+		if stderr.Len() == 0 {
+			return stdout.String(), err
+		}
+		return stdout.String(), errors.New(strings.TrimSpace(stderr.String()))
+	}
+
+	return stdout.String(), nil
+}
+
+// composeImages returns the images used by the services of the compose
+// project.
+func composeImages(ctx context.Context, workingDir string, composeFilePaths []string, env []string) ([]string, error) {
+	output, err := runComposeCommand(ctx, workingDir, "", composeFilePaths, env, "config", "--images")
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]struct{})
+	images := []string{}
+	for _, image := range splitLines(output) {
+		image = strings.TrimSpace(image)
+		if _, ok := seen[image]; ok || image == "" {
+			continue
+		}
+
+		seen[image] = struct{}{}
+		images = append(images, image)
+	}
+
+	return images, nil
+}
+
+func getDockerComposeBinaryPath() string {
+	command := path.Join(BIN_PATH, "docker-compose")
+	if runtime.GOOS == "windows" {
+		command = path.Join(BIN_PATH, "docker-compose.exe")
+	}
+	return command
+}
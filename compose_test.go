@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestResolveComposeFiles(t *testing.T) {
+	const content = "services:\n  web:\n    image: nginx\n"
+
+	tests := []struct {
+		name     string
+		files    map[string]string
+		dirs     []string
+		symlinks map[string]string
+		workdir  string
+		paths    []string
+		want     []string
+		wantErr  error
+	}{
+		{
+			name:    "given paths relative to the working directory",
+			files:   map[string]string{"stacks/web/base.yml": content},
+			workdir: "stacks/web",
+			paths:   []string{"base.yml", "../prod.yml"},
+			want:    []string{"stacks/web/base.yml", "stacks/prod.yml"},
+		},
+		{
+			name:    "given path outside of the repository",
+			workdir: "stacks",
+			paths:   []string{"../../docker-compose.yml"},
+			wantErr: errPathOutsideRepository,
+		},
+		{
+			name:    "working directory outside of the repository",
+			workdir: "../stacks",
+			wantErr: errInvalidWorkdir,
+		},
+		{
+			name:    "compose.yaml discovered",
+			files:   map[string]string{"compose.yaml": content, "README.md": "# web"},
+			workdir: ".",
+			want:    []string{"compose.yaml"},
+		},
+		{
+			name:    "legacy name and override discovered in the working directory",
+			files:   map[string]string{"stacks/web/docker-compose.yml": content, "stacks/web/docker-compose.override.yml": content, "docker-compose.yml": content},
+			workdir: "stacks/web",
+			want:    []string{"stacks/web/docker-compose.yml", "stacks/web/docker-compose.override.yml"},
+		},
+		{
+			name:    "override of another naming scheme",
+			files:   map[string]string{"compose.yml": content, "docker-compose.override.yaml": content},
+			workdir: ".",
+			want:    []string{"compose.yml", "docker-compose.override.yaml"},
+		},
+		{
+			name:    "several compose files",
+			files:   map[string]string{"compose.yaml": content, "docker-compose.yml": content},
+			workdir: ".",
+			wantErr: errAmbiguousComposeFiles,
+		},
+		{
+			name:    "several override files",
+			files:   map[string]string{"compose.yaml": content, "compose.override.yml": content, "compose.override.yaml": content},
+			workdir: ".",
+			wantErr: errAmbiguousComposeFiles,
+		},
+		{
+			name:    "override file alone",
+			files:   map[string]string{"compose.override.yml": content},
+			workdir: ".",
+			wantErr: errComposeFileNotFound,
+		},
+		{
+			name:    "directory named like a compose file",
+			dirs:    []string{"compose.yaml"},
+			workdir: ".",
+			wantErr: errComposeFileNotFound,
+		},
+		{
+			name:    "missing working directory",
+			workdir: "stacks/api",
+			wantErr: errComposeFileNotFound,
+		},
+		{
+			name:     "discovered file linking outside of the repository",
+			symlinks: map[string]string{"compose.yaml": "/etc/hostname"},
+			workdir:  ".",
+			wantErr:  errPathOutsideRepository,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clonePath := writeTestFiles(t, t.TempDir(), tt.files)
+			for _, dir := range tt.dirs {
+				if err := os.MkdirAll(filepath.Join(clonePath, dir), 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for name, target := range tt.symlinks {
+				if err := os.Symlink(target, filepath.Join(clonePath, name)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			got, err := resolveComposeFiles(clonePath, tt.workdir, tt.paths)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("resolveComposeFiles() error = %v, want %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("resolveComposeFiles() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
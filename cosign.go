@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	cosignSignatureSuffix       = ".sig"
+	cosignSignatureAnnotation   = "dev.cosignproject.cosign/signature"
+	cosignSimpleSigningType     = "cosign container image signature"
+	mediaTypeCosignSimpleSigned = "application/vnd.dev.cosign.simplesigning.v1+json"
+	// cosignMaxPayloadSize bounds the signature payloads read from the
+	// registry, simple signing payloads being a few hundred bytes
+	cosignMaxPayloadSize = 1 << 20
+)
+
+var (
+	errInvalidCosignKey        = errors.New("invalid cosign public key")
+	errImageVerificationFailed = errors.New("image signature verification failed")
+)
+
+// cosignPayload is the simple signing payload signed by cosign.
+type cosignPayload struct {
+	Critical struct {
+		Identity struct {
+			DockerReference string `json:"docker-reference"`
+		} `json:"identity"`
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+	Optional map[string]interface{} `json:"optional"`
+}
+
+// cosignVerifier verifies the cosign signatures of images, stored by cosign
+// in the image repository under the sha256-<digest>.sig tag, against public
+// keys. Only the signature artifacts are fetched from the registry, the
+// verification itself is offline.
+type cosignVerifier struct {
+	client      *registryClient
+	keys        []crypto.PublicKey
+	annotations map[string]string
+}
+
+func newCosignVerifier(keyPaths, annotations, registries []string, transport TransportOptions) (*cosignVerifier, error) {
+	if len(keyPaths) == 0 {
+		return nil, fmt.Errorf("%w: --verify-images requires at least one --cosign-key", errInvalidCosignKey)
+	}
+
+	keys := make([]crypto.PublicKey, 0, len(keyPaths))
+	for _, keyPath := range keyPaths {
+		key, err := loadCosignKey(keyPath)
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, key)
+	}
+
+	required := make(map[string]string, len(annotations))
+	for _, annotation := range annotations {
+		key, value, ok := strings.Cut(annotation, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid signature annotation %q, expected key=value", annotation)
+		}
+
+		required[key] = value
+	}
+
+	client, err := newRegistryClient(transport, registries)
+	if err != nil {
+		return nil, err
+	}
+
+	return &cosignVerifier{client: client, keys: keys, annotations: required}, nil
+}
+
+// loadCosignKey reads a PEM encoded public key, as written by cosign
+// generate-key-pair to cosign.pub.
+func loadCosignKey(keyPath string) (crypto.PublicKey, error) {
+	content, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(content)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, fmt.Errorf("%w: %s is not a PEM public key", errInvalidCosignKey, keyPath)
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %s", errInvalidCosignKey, keyPath, err)
+	}
+
+	switch key.(type) {
+	case *ecdsa.PublicKey, *rsa.PublicKey, ed25519.PublicKey:
+		return key, nil
+	}
+
+	return nil, fmt.Errorf("%w: %s: unsupported key type %T", errInvalidCosignKey, keyPath, key)
+}
+
+// Verify returns the digest of the image verified by one of the signatures
+// attached to it.
+func (v *cosignVerifier) Verify(ctx context.Context, image string) (string, error) {
+	ref, err := parseImageReference(image)
+	if err != nil {
+		return "", err
+	}
+
+	digest := ref.Digest
+	if digest == "" {
+		digest, err = v.client.HeadManifest(ctx, ref)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	signatureRef := imageReference{
+		Registry:   ref.Registry,
+		Repository: ref.Repository,
+		Tag:        strings.Replace(digest, ":", "-", 1) + cosignSignatureSuffix,
+	}
+
+	body, _, _, err := v.client.GetManifest(ctx, signatureRef, mediaTypeOCIManifest, mediaTypeDockerManifest)
+	if err != nil {
+		return "", fmt.Errorf("no signature found for %s: %w", ref.Name()+"@"+digest, err)
+	}
+
+	var manifest ociManifest
+	err = json.Unmarshal(body, &manifest)
+	if err != nil {
+		return "", err
+	}
+
+	failures := []string{}
+	for _, layer := range manifest.Layers {
+		signature, ok := layer.Annotations[cosignSignatureAnnotation]
+		if !ok {
+			continue
+		}
+
+		err = v.verifyLayer(ctx, signatureRef, layer, signature, digest)
+		if err == nil {
+			return digest, nil
+		}
+
+		failures = append(failures, err.Error())
+	}
+
+	if len(failures) == 0 {
+		return "", fmt.Errorf("no signature found for %s", ref.Name()+"@"+digest)
+	}
+
+	return "", fmt.Errorf("no valid signature for %s: %s", ref.Name()+"@"+digest, strings.Join(failures, "; "))
+}
+
+// verifyLayer checks a signature layer: the payload must match the layer
+// digest, be signed by one of the keys, reference the image digest and carry
+// the required annotations.
+func (v *cosignVerifier) verifyLayer(ctx context.Context, ref imageReference, layer ociDescriptor, signature, digest string) error {
+	if layer.MediaType != mediaTypeCosignSimpleSigned {
+		return fmt.Errorf("unsupported signature media type %s", layer.MediaType)
+	}
+
+	blob, err := v.client.GetBlob(ctx, ref, layer.Digest)
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+
+	payload, err := io.ReadAll(io.LimitReader(blob, cosignMaxPayloadSize))
+	if err != nil {
+		return err
+	}
+
+	if digestOf(payload) != layer.Digest {
+		return fmt.Errorf("%w: signature payload %s", errDigestMismatch, layer.Digest)
+	}
+
+	rawSignature, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return fmt.Errorf("invalid signature encoding: %w", err)
+	}
+
+	if !v.verifySignature(payload, rawSignature) {
+		return errors.New("signature does not match any of the keys")
+	}
+
+	var signed cosignPayload
+	err = json.Unmarshal(payload, &signed)
+	if err != nil {
+		return fmt.Errorf("invalid signature payload: %w", err)
+	}
+
+	if signed.Critical.Type != cosignSimpleSigningType {
+		return fmt.Errorf("unexpected signature type %q", signed.Critical.Type)
+	}
+
+	if signed.Critical.Image.DockerManifestDigest != digest {
+		return fmt.Errorf("signature is for digest %s", signed.Critical.Image.DockerManifestDigest)
+	}
+
+	for key, value := range v.annotations {
+		if toString(signed.Optional[key]) != value {
+			return fmt.Errorf("annotation %s is %q, expected %q", key, toString(signed.Optional[key]), value)
+		}
+	}
+
+	return nil
+}
+
+func (v *cosignVerifier) verifySignature(payload, signature []byte) bool {
+	sum := sha256.Sum256(payload)
+
+	for _, key := range v.keys {
+		switch key := key.(type) {
+		case *ecdsa.PublicKey:
+			if ecdsa.VerifyASN1(key, sum[:], signature) {
+				return true
+			}
+		case *rsa.PublicKey:
+			if rsa.VerifyPKCS1v15(key, crypto.SHA256, sum[:], signature) == nil {
+				return true
+			}
+		case ed25519.PublicKey:
+			if ed25519.Verify(key, payload, signature) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// verifyStackImages verifies the signatures of the images of the resolved
+// compose project and pins the images to the verified digests, so that a tag
+// moved after the verification is not deployed. It fails listing the services
+// whose image is not signed. See rewriteComposeFiles for the returned paths.
+func verifyStackImages(ctx context.Context, verifier *cosignVerifier, clonePath, workingDir string, composeRelativeFilePaths, env []string) ([]string, error) {
+	composeFilePaths := make([]string, len(composeRelativeFilePaths))
+	for i := 0; i < len(composeRelativeFilePaths); i++ {
+		composeFilePaths[i] = path.Join(clonePath, composeRelativeFilePaths[i])
+	}
+
+	model, err := loadComposeModel(ctx, workingDir, composeFilePaths, env)
+	if err != nil {
+		log.Error().
+			Err(err).
+			Msg("Failed to resolve the stack images")
+		return nil, err
+	}
+
+	lock, err := verifyModelImages(ctx, verifier, model)
+	if err != nil {
+		return nil, err
+	}
+
+	composeRelativeFilePaths, err = pinComposeImages(clonePath, composeRelativeFilePaths, model, lock)
+	if err != nil {
+		log.Error().
+			Err(err).
+			Msg("Failed to pin the verified image digests")
+		return nil, err
+	}
+
+	return composeRelativeFilePaths, nil
+}
+
+// verifyModelImages verifies the image of each service of the model and
+// returns the verified digests as a lock.
+func verifyModelImages(ctx context.Context, verifier *cosignVerifier, model *composeModel) (*composeLock, error) {
+	names := make([]string, 0, len(model.Services))
+	for name := range model.Services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	lock := &composeLock{
+		Version:  composeLockVersion,
+		Services: make(map[string]lockedImage),
+	}
+
+	// Services sharing an image are verified once
+	type verification struct {
+		digest string
+		err    error
+	}
+	verified := make(map[string]verification)
+	unverified := []string{}
+	for _, name := range names {
+		image := model.Services[name].Image
+		if image == "" {
+			continue
+		}
+
+		result, ok := verified[image]
+		if !ok {
+			result.digest, result.err = verifier.Verify(ctx, image)
+			verified[image] = result
+
+			if result.err == nil {
+				log.Info().
+					Str("image", image).
+					Str("digest", result.digest).
+					Msg("Image signature verified")
+			}
+		}
+
+		if result.err != nil {
+			log.Error().
+				Err(result.err).
+				Str("service", name).
+				Str("image", image).
+				Msg("Failed to verify image signature")
+
+			unverified = append(unverified, name)
+			continue
+		}
+
+		lock.Services[name] = lockedImage{Image: image, Digest: result.digest}
+	}
+
+	if len(unverified) > 0 {
+		log.Error().
+			Strs("services", unverified).
+			Msg("Services with unverified images")
+		return nil, errImageVerificationFailed
+	}
+
+	return lock, nil
+}
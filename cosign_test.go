@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+// signTestImage stores a cosign signature of the image digest, with the
+// optional annotations, in the registry.
+func signTestImage(t *testing.T, registry *testRegistry, key *ecdsa.PrivateKey, repository, digest string, annotations map[string]interface{}) {
+	t.Helper()
+
+	var payload cosignPayload
+	payload.Critical.Identity.DockerReference = registry.Ref(repository)
+	payload.Critical.Image.DockerManifestDigest = digest
+	payload.Critical.Type = cosignSimpleSigningType
+	payload.Optional = annotations
+
+	content, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sum := sha256.Sum256(content)
+	signature, err := ecdsa.SignASN1(rand.Reader, key, sum[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manifest, err := json.Marshal(ociManifest{
+		SchemaVersion: ociImageSchemaVersion,
+		MediaType:     mediaTypeOCIManifest,
+		Config:        ociDescriptor{MediaType: "application/vnd.oci.image.config.v1+json", Digest: registry.PutBlob([]byte("{}")), Size: 2},
+		Layers: []ociDescriptor{{
+			MediaType:   mediaTypeCosignSimpleSigned,
+			Digest:      registry.PutBlob(content),
+			Size:        int64(len(content)),
+			Annotations: map[string]string{cosignSignatureAnnotation: base64.StdEncoding.EncodeToString(signature)},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	registry.PutManifest(repository, strings.Replace(digest, ":", "-", 1)+cosignSignatureSuffix, mediaTypeOCIManifest, manifest)
+}
+
+func writeTestCosignKey(t *testing.T, key *ecdsa.PrivateKey) string {
+	t.Helper()
+
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyPath := filepath.Join(t.TempDir(), "cosign.pub")
+	err = os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return keyPath
+}
+
+func TestVerifyAndPinStackImages(t *testing.T) {
+	registry := newTestRegistry(t, "", "")
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	webDigest := registry.PutManifest("web", "1.0", mediaTypeOCIManifest, []byte(`{"schemaVersion":2,"layers":[{"digest":"web"}]}`))
+	signTestImage(t, registry, key, "web", webDigest, map[string]interface{}{"env": "prod"})
+
+	dbDigest := registry.PutManifest("db", "1.0", mediaTypeOCIManifest, []byte(`{"schemaVersion":2,"layers":[{"digest":"db"}]}`))
+	signTestImage(t, registry, otherKey, "db", dbDigest, nil)
+
+	registry.PutManifest("cache", "1.0", mediaTypeOCIManifest, []byte(`{"schemaVersion":2,"layers":[{"digest":"cache"}]}`))
+
+	web := registry.Ref("web") + ":1.0"
+	tests := []struct {
+		name        string
+		services    map[string]string
+		annotations []string
+		want        map[string]string
+		wantErr     error
+	}{
+		{
+			name:     "signed images pinned to the verified digest",
+			services: map[string]string{"web": web, "worker": web},
+			want:     map[string]string{"web": web + "@" + webDigest, "worker": web + "@" + webDigest},
+		},
+		{
+			name:     "image pinned by digest",
+			services: map[string]string{"web": registry.Ref("web") + "@" + webDigest},
+			want:     map[string]string{"web": registry.Ref("web") + "@" + webDigest},
+		},
+		{
+			name:        "required annotation",
+			services:    map[string]string{"web": web},
+			annotations: []string{"env=prod"},
+			want:        map[string]string{"web": web + "@" + webDigest},
+		},
+		{
+			name:        "missing annotation",
+			services:    map[string]string{"web": web},
+			annotations: []string{"env=staging"},
+			wantErr:     errImageVerificationFailed,
+		},
+		{
+			name:     "signed by another key",
+			services: map[string]string{"web": web, "db": registry.Ref("db") + ":1.0"},
+			wantErr:  errImageVerificationFailed,
+		},
+		{
+			name:     "unsigned image",
+			services: map[string]string{"cache": registry.Ref("cache") + ":1.0"},
+			wantErr:  errImageVerificationFailed,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			verifier, err := newCosignVerifier([]string{writeTestCosignKey(t, key)}, tt.annotations, nil, TransportOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			model := &composeModel{Services: make(map[string]composeService)}
+			compose := "services:\n"
+			for name, image := range tt.services {
+				model.Services[name] = composeService{Image: image}
+				compose += "  " + name + ":\n    image: " + image + "\n"
+			}
+
+			lock, err := verifyModelImages(context.Background(), verifier, model)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("verifyModelImages() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			clonePath := writeTestFiles(t, t.TempDir(), map[string]string{"docker-compose.yml": compose})
+			paths, err := pinComposeImages(clonePath, []string{"docker-compose.yml"}, model, lock)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			document, err := parseComposeFile(filepath.Join(clonePath, paths[0]))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := make(map[string]string)
+			forEachService(document.Content[0], func(name string, service *yaml.Node) {
+				got[name] = mappingValue(service, "image").Value
+			})
+
+			for name, want := range tt.want {
+				if got[name] != want {
+					t.Errorf("image of %s = %s, want %s", name, got[name], want)
+				}
+			}
+		})
+	}
+}
@@ -10,9 +10,8 @@ import (
 	"path/filepath"
 	"runtime"
 	"strings"
+	"time"
 
-	"github.com/go-git/go-git/v5"
-	"github.com/go-git/go-git/v5/plumbing"
 	"github.com/go-git/go-git/v5/plumbing/transport/http"
 	"github.com/portainer/portainer/pkg/libstack"
 	"github.com/portainer/portainer/pkg/libstack/compose"
@@ -30,34 +29,70 @@ func (cmd *DeployCommand) Run(cmdCtx *CommandExecutionContext) error {
 		Bool("skipTLSVerify", cmd.SkipTLSVerify).
 		Msg("Deploying Compose stack from Git repository")
 
-	defer dockerLogout(cmd.Registry)
-	err := dockerLogin(cmd.Registry)
+	err := validateProjectName(cmd.ProjectName)
+	if err == nil {
+		err = checkStackPaths(cmd.Workdir, cmd.ComposeRelativeFilePaths, cmd.SparsePath)
+	}
 	if err != nil {
-		return err
+		log.Error().
+			Err(err).
+			Msg("Invalid stack parameters")
+		return errDeployComposeFailure
 	}
 
-	if cmd.User != "" && cmd.Password != "" {
-		log.Info().
-			Str("user", cmd.User).
-			Msg("Using Git authentication")
+	transportOpts := cmd.transportOptions()
+	err = configureGitTransport(transportOpts)
+	if err != nil {
+		return errDeployComposeFailure
 	}
 
-	i := strings.LastIndex(cmd.GitRepository, "/")
-	if i == -1 {
+	// Bundles carry their images, the registries are not reachable
+	if cmd.FromBundle == "" {
+		removeRegistryCA := installRegistryCA(transportOpts, cmd.Registry)
+		defer removeRegistryCA()
+		defer dockerLogout(cmd.Registry, transportOpts)
+		err = dockerLogin(cmd.Registry, transportOpts)
+		if err != nil {
+			return err
+		}
+	}
 
+	source, err := cmd.source()
+	if err != nil {
 		log.Error().
+			Err(err).
 			Str("repository", cmd.GitRepository).
-			Msg("Invalid Git repository URL")
+			Msg("Invalid stack source")
+		return errDeployComposeFailure
+	}
+
+	// The name comes from the repository URL, the archive URL or the bundle
+	// manifest and becomes a directory of the stack
+	err = validateStackName(source.Name())
+	if err != nil {
+		log.Error().
+			Err(err).
+			Str("repository", cmd.GitRepository).
+			Msg("Invalid stack source name")
 		return errDeployComposeFailure
 	}
-	repositoryName := strings.TrimSuffix(cmd.GitRepository[i+1:], ".git")
 
 	log.Info().
 		Str("directory", cmd.Destination).
 		Msg("Checking the file system...")
 
 	mountPath := makeWorkingDir(cmd.Destination, cmd.ProjectName)
-	clonePath := path.Join(mountPath, repositoryName)
+	clonePath := path.Join(mountPath, source.Name())
+	previousLock := readPreviousComposeLock(mountPath)
+
+	unmark, err := markDeployInProgress(mountPath)
+	if err != nil {
+		log.Error().
+			Err(err).
+			Msg("Failed to mark the deployment in progress")
+		return errDeployComposeFailure
+	}
+	defer unmark()
 	if !cmd.Keep { //stack create request
 		_, err := os.Stat(mountPath)
 		if err == nil {
@@ -82,57 +117,167 @@ func (cmd *DeployCommand) Run(cmdCtx *CommandExecutionContext) error {
 			Str("directory", mountPath).
 			Msg("Creating target destination directory on disk")
 
-		gitOptions := git.CloneOptions{
-			URL:             cmd.GitRepository,
-			ReferenceName:   plumbing.ReferenceName(cmd.Reference),
-			Auth:            getAuth(cmd.User, cmd.Password),
-			Depth:           1,
-			InsecureSkipTLS: cmd.SkipTLSVerify,
+		err = source.Fetch(cmdCtx.context, clonePath)
+		if err != nil {
+			log.Error().
+				Err(err).
+				Msg("Failed to fetch stack source")
+			return errDeployComposeFailure
 		}
+	}
 
-		log.Info().
-			Str("repository", cmd.GitRepository).
-			Str("path", clonePath).
-			Str("url", gitOptions.URL).
-			Int("depth", gitOptions.Depth).
-			Msg("Cloning git repository")
+	deployer, err := compose.NewComposeDeployer(BIN_PATH, PORTAINER_DOCKER_CONFIG_PATH)
+	if err != nil {
+		log.Error().
+			Err(err).
+			Msg("Failed to create Compose deployer")
+		return errDeployComposeFailure
+	}
 
-		_, err = git.PlainCloneContext(cmdCtx.context, clonePath, false, &gitOptions)
+	composeRelativeFilePaths, err := resolveComposeFiles(clonePath, cmd.Workdir, cmd.ComposeRelativeFilePaths)
+	if err != nil {
+		log.Error().
+			Err(err).
+			Msg("Failed to resolve compose files")
+		return errDeployComposeFailure
+	}
+
+	if cmd.Template {
+		composeRelativeFilePaths, err = renderTemplates(clonePath, composeRelativeFilePaths, templateFilePaths(cmd.Workdir, cmd.TemplateFile), cmd.Values, cmd.Env)
 		if err != nil {
 			log.Error().
 				Err(err).
-				Msg("Failed to clone Git repository")
+				Msg("Failed to render templates")
 			return errDeployComposeFailure
 		}
 	}
 
-	deployer, err := compose.NewComposeDeployer(BIN_PATH, PORTAINER_DOCKER_CONFIG_PATH)
+	err = checkEnvFilePaths(clonePath, composeRelativeFilePaths)
 	if err != nil {
 		log.Error().
 			Err(err).
-			Msg("Failed to create Compose deployer")
+			Msg("Invalid env_file path")
 		return errDeployComposeFailure
 	}
 
-	composeFilePaths := make([]string, len(cmd.ComposeRelativeFilePaths))
-	for i := 0; i < len(cmd.ComposeRelativeFilePaths); i++ {
-		composeFilePaths[i] = path.Join(clonePath, cmd.ComposeRelativeFilePaths[i])
+	workingDir := path.Join(clonePath, cmd.Workdir)
+
+	if !cmd.SkipValidate {
+		err = preDeployValidation(clonePath, workingDir, composeRelativeFilePaths, cmd.Env)
+		if err != nil {
+			return errDeployComposeFailure
+		}
+	}
+
+	env := cmd.Env
+	if len(cmd.Profile) > 0 {
+		env = append(env, "COMPOSE_PROFILES="+strings.Join(cmd.Profile, ","))
+	}
+
+	// The images are pinned first, the policy and the signatures being
+	// checked against the deployed digests. Bundles carry their images, the
+	// registries are not reachable.
+	if cmd.FromBundle == "" {
+		var client *registryClient
+		if !cmd.Locked {
+			client, err = newRegistryClient(transportOpts, cmd.Registry)
+			if err != nil {
+				log.Error().
+					Err(err).
+					Msg("Failed to create registry client")
+				return errDeployComposeFailure
+			}
+		}
+
+		composeRelativeFilePaths, err = lockStackImages(cmdCtx.context, cmd.Locked, cmd.Lock, client, previousLock, clonePath, workingDir, mountPath, composeRelativeFilePaths, env)
+		if err != nil {
+			log.Error().
+				Err(err).
+				Msg("Failed to lock the stack images")
+			return errDeployComposeFailure
+		}
+	} else {
+		keepComposeLock(mountPath, previousLock)
+	}
+
+	composeFilePaths := make([]string, len(composeRelativeFilePaths))
+	for i := 0; i < len(composeRelativeFilePaths); i++ {
+		composeFilePaths[i] = path.Join(clonePath, composeRelativeFilePaths[i])
+	}
+
+	policy, err := deploymentPolicy(cmd.Policy, cmd.AllowedRegistries, cmd.RequireDigests)
+	if err != nil {
+		log.Error().
+			Err(err).
+			Msg("Failed to load the policy")
+		return errDeployComposeFailure
+	}
+
+	if policy != nil {
+		err = enforcePolicy(cmdCtx.context, policy, workingDir, composeFilePaths, env, []string{mountPath})
+		if err != nil {
+			return errDeployComposeFailure
+		}
+	}
+
+	if cmd.VerifyImages {
+		verifier, err := newCosignVerifier(cmd.CosignKey, cmd.SignatureAnnotation, cmd.Registry, transportOpts)
+		if err != nil {
+			log.Error().
+				Err(err).
+				Msg("Failed to set up image verification")
+			return errDeployComposeFailure
+		}
+
+		composeRelativeFilePaths, err = verifyStackImages(cmdCtx.context, verifier, clonePath, workingDir, composeRelativeFilePaths, env)
+		if err != nil {
+			return errDeployComposeFailure
+		}
+	}
+
+	// The bind mount sources are resolved by the Docker daemon, on the host
+	composeRelativeFilePaths, err = translateBindMounts(clonePath, composeRelativeFilePaths, cmd.Destination, hostDestination(cmd.Destination, cmd.HostDestination))
+	if err != nil {
+		log.Error().
+			Err(err).
+			Msg("Failed to translate the bind mounts to host paths")
+		return errDeployComposeFailure
+	}
+
+	for i := 0; i < len(composeRelativeFilePaths); i++ {
+		composeFilePaths[i] = path.Join(clonePath, composeRelativeFilePaths[i])
 	}
 
 	log.Info().
 		Strs("composeFilePaths", composeFilePaths).
-		Str("workingDirectory", clonePath).
+		Str("workingDirectory", workingDir).
 		Str("projectName", cmd.ProjectName).
+		Strs("profiles", cmd.Profile).
 		Msg("Deploying Compose stack")
 
-	err = deployer.Deploy(cmdCtx.context, composeFilePaths, libstack.DeployOptions{
-		Options: libstack.Options{
-			WorkingDir:  clonePath,
-			ProjectName: cmd.ProjectName,
-			Env:         cmd.Env,
-		},
-		ForceRecreate: true,
-	})
+	// Compose only recreates the containers whose configuration hash changed
+	// unless --force-recreate is given
+	if len(cmd.Service) > 0 {
+		log.Info().
+			Strs("services", cmd.Service).
+			Msg("Deploying selected services and their dependencies")
+
+		args := []string{"up", "-d"}
+		if cmd.ForceRecreate {
+			args = append(args, "--force-recreate")
+		}
+
+		_, err = runComposeCommand(cmdCtx.context, workingDir, cmd.ProjectName, composeFilePaths, env, append(args, cmd.Service...)...)
+	} else {
+		err = deployer.Deploy(cmdCtx.context, composeFilePaths, libstack.DeployOptions{
+			Options: libstack.Options{
+				WorkingDir:  workingDir,
+				ProjectName: cmd.ProjectName,
+				Env:         env,
+			},
+			ForceRecreate: cmd.ForceRecreate,
+		})
+	}
 
 	if err != nil {
 		log.Error().
@@ -141,6 +286,18 @@ func (cmd *DeployCommand) Run(cmdCtx *CommandExecutionContext) error {
 		return errDeployComposeFailure
 	}
 
+	err = writeStackState(mountPath, stackState{
+		Directory:    source.Name(),
+		ComposeFiles: composeRelativeFilePaths,
+		WorkingDir:   cmd.Workdir,
+		Profiles:     cmd.Profile,
+	})
+	if err != nil {
+		log.Warn().
+			Err(err).
+			Msg("Failed to record the stack state")
+	}
+
 	log.Info().Msg("Compose stack deployment complete")
 	return nil
 }
@@ -152,34 +309,67 @@ func (cmd *SwarmDeployCommand) Run(cmdCtx *CommandExecutionContext) error {
 		Str("destination", cmd.Destination).
 		Msg("Deploying Swarm stack from a Git repository")
 
-	defer dockerLogout(cmd.Registry)
-	err := dockerLogin(cmd.Registry)
+	err := validateStackName(cmd.ProjectName)
+	if err == nil {
+		err = checkStackPaths(cmd.Workdir, cmd.ComposeRelativeFilePaths, cmd.SparsePath)
+	}
 	if err != nil {
-		return err
+		log.Error().
+			Err(err).
+			Msg("Invalid stack parameters")
+		return errDeployComposeFailure
 	}
 
-	if cmd.User != "" && cmd.Password != "" {
-		log.Info().
-			Str("user", cmd.User).
-			Msg("Using Git authentication")
+	transportOpts := cmd.transportOptions()
+	err = configureGitTransport(transportOpts)
+	if err != nil {
+		return errDeployComposeFailure
+	}
+
+	removeRegistryCA := installRegistryCA(transportOpts, cmd.Registry)
+	defer removeRegistryCA()
+	defer dockerLogout(cmd.Registry, transportOpts)
+	err = dockerLogin(cmd.Registry, transportOpts)
+	if err != nil {
+		return err
 	}
 
-	i := strings.LastIndex(cmd.GitRepository, "/")
-	if i == -1 {
+	source, err := cmd.source()
+	if err != nil {
 		log.Error().
+			Err(err).
 			Str("repository", cmd.GitRepository).
-			Msg("Invalid Git repository URL")
+			Msg("Invalid stack source")
+		return errDeployComposeFailure
+	}
 
+	// The name comes from the repository URL, the archive URL or the bundle
+	// manifest and becomes a directory of the stack
+	err = validateStackName(source.Name())
+	if err != nil {
+		log.Error().
+			Err(err).
+			Str("repository", cmd.GitRepository).
+			Msg("Invalid stack source name")
 		return errDeployComposeFailure
 	}
-	repositoryName := strings.TrimSuffix(cmd.GitRepository[i+1:], ".git")
 
 	log.Info().
 		Str("directory", cmd.Destination).
 		Msg("Checking the file system...")
 
 	mountPath := makeWorkingDir(cmd.Destination, cmd.ProjectName)
-	clonePath := path.Join(mountPath, repositoryName)
+	clonePath := path.Join(mountPath, source.Name())
+	previousLock := readPreviousComposeLock(mountPath)
+
+	unmark, err := markDeployInProgress(mountPath)
+	if err != nil {
+		log.Error().
+			Err(err).
+			Msg("Failed to mark the deployment in progress")
+		return errDeployComposeFailure
+	}
+	defer unmark()
 
 	// Record running services before deployment/redeployment
 	serviceIDs, err := checkRunningService(cmd.ProjectName)
@@ -224,35 +414,156 @@ func (cmd *SwarmDeployCommand) Run(cmdCtx *CommandExecutionContext) error {
 			Str("directory", mountPath).
 			Msg("Creating target destination directory on disk")
 
-		gitOptions := git.CloneOptions{
-			URL:             cmd.GitRepository,
-			ReferenceName:   plumbing.ReferenceName(cmd.Reference),
-			Auth:            getAuth(cmd.User, cmd.Password),
-			Depth:           100,
-			InsecureSkipTLS: cmd.SkipTLSVerify,
+		err = source.Fetch(cmdCtx.context, clonePath)
+		if err != nil {
+			log.Error().
+				Err(err).
+				Msg("Failed to fetch stack source")
+			return errDeployComposeFailure
 		}
+	}
 
-		log.Info().
-			Str("repository", cmd.GitRepository).
-			Str("path", clonePath).
-			Str("url", gitOptions.URL).
-			Int("depth", gitOptions.Depth).
-			Msg("Cloning git repository")
+	cmd.ComposeRelativeFilePaths, err = resolveComposeFiles(clonePath, cmd.Workdir, cmd.ComposeRelativeFilePaths)
+	if err != nil {
+		log.Error().
+			Err(err).
+			Msg("Failed to resolve compose files")
+		return errDeployComposeFailure
+	}
+
+	if cmd.Template {
+		cmd.ComposeRelativeFilePaths, err = renderTemplates(clonePath, cmd.ComposeRelativeFilePaths, templateFilePaths(cmd.Workdir, cmd.TemplateFile), cmd.Values, cmd.Env)
+		if err != nil {
+			log.Error().
+				Err(err).
+				Msg("Failed to render templates")
+			return errDeployComposeFailure
+		}
+	}
+
+	err = checkEnvFilePaths(clonePath, cmd.ComposeRelativeFilePaths)
+	if err != nil {
+		log.Error().
+			Err(err).
+			Msg("Invalid env_file path")
+		return errDeployComposeFailure
+	}
+
+	if !cmd.SkipValidate {
+		err = preDeployValidation(clonePath, path.Join(clonePath, cmd.Workdir), cmd.ComposeRelativeFilePaths, cmd.Env)
+		if err != nil {
+			return errDeployComposeFailure
+		}
+	}
+
+	policy, err := deploymentPolicy(cmd.Policy, cmd.AllowedRegistries, cmd.RequireDigests)
+	if err != nil {
+		log.Error().
+			Err(err).
+			Msg("Failed to load the policy")
+		return errDeployComposeFailure
+	}
+
+	// The images are pinned first, the policy and the signatures being
+	// checked against the deployed digests
+	var client *registryClient
+	if !cmd.Locked {
+		client, err = newRegistryClient(transportOpts, cmd.Registry)
+		if err != nil {
+			log.Error().
+				Err(err).
+				Msg("Failed to create registry client")
+			return errDeployComposeFailure
+		}
+	}
+
+	cmd.ComposeRelativeFilePaths, err = lockStackImages(cmdCtx.context, cmd.Locked, cmd.Lock, client, previousLock, clonePath, path.Join(clonePath, cmd.Workdir), mountPath, cmd.ComposeRelativeFilePaths, cmd.Env)
+	if err != nil {
+		log.Error().
+			Err(err).
+			Msg("Failed to lock the stack images")
+		return errDeployComposeFailure
+	}
+
+	composeFilePaths := make([]string, len(cmd.ComposeRelativeFilePaths))
+	for i := 0; i < len(cmd.ComposeRelativeFilePaths); i++ {
+		composeFilePaths[i] = path.Join(clonePath, cmd.ComposeRelativeFilePaths[i])
+	}
 
-		_, err = git.PlainCloneContext(cmdCtx.context, clonePath, false, &gitOptions)
+	if policy != nil {
+		err = enforcePolicy(cmdCtx.context, policy, path.Join(clonePath, cmd.Workdir), composeFilePaths, cmd.Env, []string{mountPath})
+		if err != nil {
+			return errDeployComposeFailure
+		}
+	}
+
+	if cmd.VerifyImages {
+		verifier, err := newCosignVerifier(cmd.CosignKey, cmd.SignatureAnnotation, cmd.Registry, transportOpts)
 		if err != nil {
 			log.Error().
 				Err(err).
-				Msg("Failed to clone Git repository")
+				Msg("Failed to set up image verification")
+			return errDeployComposeFailure
+		}
+
+		cmd.ComposeRelativeFilePaths, err = verifyStackImages(cmdCtx.context, verifier, clonePath, path.Join(clonePath, cmd.Workdir), cmd.ComposeRelativeFilePaths, cmd.Env)
+		if err != nil {
 			return errDeployComposeFailure
 		}
 	}
 
+	// The bind mount sources are resolved by the Docker daemon, on the host
+	cmd.ComposeRelativeFilePaths, err = translateBindMounts(clonePath, cmd.ComposeRelativeFilePaths, cmd.Destination, hostDestination(cmd.Destination, cmd.HostDestination))
+	if err != nil {
+		log.Error().
+			Err(err).
+			Msg("Failed to translate the bind mounts to host paths")
+		return errDeployComposeFailure
+	}
+
+	if cmd.VersionObjects {
+		cmd.ComposeRelativeFilePaths, err = versionSwarmObjects(clonePath, cmd.ProjectName, cmd.ComposeRelativeFilePaths)
+		if err != nil {
+			log.Error().
+				Err(err).
+				Msg("Failed to version Swarm secrets and configs")
+			return errDeployComposeFailure
+		}
+	}
+
+	updateConfig, err := cmd.updateConfig()
+	if err != nil {
+		log.Error().
+			Err(err).
+			Msg("Invalid update policy")
+		return errDeployComposeFailure
+	}
+
+	if updateConfig != nil {
+		cmd.ComposeRelativeFilePaths, err = applyUpdatePolicy(clonePath, cmd.ComposeRelativeFilePaths, updateConfig)
+		if err != nil {
+			log.Error().
+				Err(err).
+				Msg("Failed to apply the update policy")
+			return errDeployComposeFailure
+		}
+	}
+
+	deployStart := time.Now()
 	err = deploySwarmStack(*cmd, clonePath)
 	if err != nil {
 		return err
 	}
 
+	if cmd.VersionObjects {
+		err = pruneSwarmObjects(cmd.ProjectName, cmd.ObjectRetention)
+		if err != nil {
+			log.Warn().
+				Err(err).
+				Msg("Failed to prune superseded Swarm secrets and configs")
+		}
+	}
+
 	if forceUpdate {
 		// If the process executes redeployment, the running services need
 		// to be recreated forcibly
@@ -269,66 +580,59 @@ func (cmd *SwarmDeployCommand) Run(cmdCtx *CommandExecutionContext) error {
 		}
 	}
 
+	if cmd.ConvergeTimeout > 0 {
+		err = waitForSwarmUpdates(cmdCtx, cmd.ProjectName, deployStart, cmd.ConvergeTimeout)
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
-func dockerLogin(registries []string) error {
+// dockerLogin logs in to the registries, given as user:password:registry,
+// using the proxies of the transport options.
+func dockerLogin(registries []string, transport TransportOptions) error {
 	command := getDockerBinaryPath()
+	env := transport.proxyEnv()
 
-	for _, registry := range registries {
-		credentials := strings.Split(registry, ":")
-		if len(credentials) != 3 {
-			log.Warn().
-				Str("registry", registry).
-				Msg("registry is malformed. Skip login it.")
-
-			continue
-		}
-
+	for host, credential := range parseRegistryCredentials(registries) {
 		args := make([]string, 0)
-		args = append(args, "--config", PORTAINER_DOCKER_CONFIG_PATH, "login", "--username", credentials[0], "--password", credentials[1], credentials[2])
+		args = append(args, "--config", PORTAINER_DOCKER_CONFIG_PATH, "login", "--username", credential.Username, "--password", credential.Password, host)
 
-		err := runCommandAndCaptureStdErr(command, args, nil, "")
+		err := runCommandAndCaptureStdErr(command, args, env, "")
 		if err != nil {
 			log.Warn().
 				Err(err).
-				Msg(fmt.Sprintf("Docker login %s failed. Skip login it.", credentials[2]))
+				Msg(fmt.Sprintf("Docker login %s failed. Skip login it.", host))
 
 			continue
 		}
 		log.Info().
-			Msg(fmt.Sprintf("Docker login %s successed", credentials[2]))
+			Msg(fmt.Sprintf("Docker login %s successed", host))
 	}
 
 	return nil
 }
 
-func dockerLogout(registries []string) error {
+func dockerLogout(registries []string, transport TransportOptions) error {
 	command := getDockerBinaryPath()
+	env := transport.proxyEnv()
 
-	for _, registry := range registries {
-		credentials := strings.Split(registry, ":")
-		if len(credentials) != 3 {
-			log.Warn().
-				Str("registry", registry).
-				Msg("registry is malformed. Skip logout it.")
-
-			continue
-		}
-
+	for host := range parseRegistryCredentials(registries) {
 		args := make([]string, 0)
-		args = append(args, "--config", PORTAINER_DOCKER_CONFIG_PATH, "logout", credentials[2])
+		args = append(args, "--config", PORTAINER_DOCKER_CONFIG_PATH, "logout", host)
 
-		err := runCommandAndCaptureStdErr(command, args, nil, "")
+		err := runCommandAndCaptureStdErr(command, args, env, "")
 		if err != nil {
 			log.Warn().
 				Err(err).
-				Msg(fmt.Sprintf("Docker logout %s failed. Skip logout it.", credentials[2]))
+				Msg(fmt.Sprintf("Docker logout %s failed. Skip logout it.", host))
 
 			continue
 		}
 		log.Info().
-			Msg(fmt.Sprintf("Docker logout %s successed", credentials[2]))
+			Msg(fmt.Sprintf("Docker logout %s successed", host))
 	}
 
 	return nil
@@ -386,6 +690,27 @@ func makeWorkingDir(target, stackName string) string {
 	return filepath.Join(target, "stacks", stackName)
 }
 
+// deployMarkerSuffix names the file marking, next to a stack directory, a
+// deployment in progress, so that gc leaves the directory alone.
+const deployMarkerSuffix = ".deploying"
+
+// markDeployInProgress marks the deployment of the stack directory mountPath
+// and returns the function removing the marker.
+func markDeployInProgress(mountPath string) (func(), error) {
+	err := os.MkdirAll(filepath.Dir(mountPath), 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	markerPath := mountPath + deployMarkerSuffix
+	err = os.WriteFile(markerPath, []byte(fmt.Sprintf("%d\n", os.Getpid())), 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return func() { os.Remove(markerPath) }, nil
+}
+
 func getDockerBinaryPath() string {
 	command := path.Join(BIN_PATH, "docker")
 	if runtime.GOOS == "windows" {
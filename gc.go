@@ -0,0 +1,446 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// deployMarkerStaleAge is the age after which the marker of a deployment in
+// progress is considered left behind by a crashed process.
+const deployMarkerStaleAge = 24 * time.Hour
+
+// localImage is the subset of docker image inspect used by gc.
+type localImage struct {
+	ID          string `json:"Id"`
+	RepoTags    []string
+	RepoDigests []string
+	Created     time.Time
+	Size        int64
+}
+
+// Repository returns the repository of the image, from its first tag or
+// digest. Dangling images share the <none> repository.
+func (i localImage) Repository() string {
+	for _, ref := range append(i.RepoTags, i.RepoDigests...) {
+		if parsed, err := parseImageReference(ref); err == nil {
+			return parsed.Name()
+		}
+	}
+
+	return "<none>"
+}
+
+func (i localImage) String() string {
+	if len(i.RepoTags) > 0 {
+		return strings.Join(i.RepoTags, ",")
+	}
+	if len(i.RepoDigests) > 0 {
+		return strings.Join(i.RepoDigests, ",")
+	}
+
+	return i.ID
+}
+
+func (cmd *GCCommand) Run(cmdCtx *CommandExecutionContext) error {
+	var reclaimed int64
+
+	root, err := filepath.EvalSymlinks(cmd.Destination)
+	if err != nil {
+		return err
+	}
+
+	orphans, err := orphanedStackDirectories(root, cmd.MinAge)
+	if err != nil {
+		log.Error().
+			Err(err).
+			Msg("Failed to list orphaned stack directories")
+		return err
+	}
+
+	mountPoints, err := readMountPoints()
+	if err != nil {
+		log.Debug().
+			Err(err).
+			Msg("Failed to read the mount points")
+	}
+
+	for _, orphan := range orphans {
+		target, err := checkRemovablePath(orphan, root, mountPoints)
+		if err != nil {
+			log.Warn().
+				Err(err).
+				Str("path", orphan).
+				Msg("Skipping orphaned stack directory")
+			continue
+		}
+
+		size := directorySize(target)
+		fmt.Printf("stack\t%s\t%s\n", target, formatBytes(size))
+
+		if !cmd.Yes {
+			reclaimed += size
+			continue
+		}
+
+		log.Info().
+			Str("path", target).
+			Msg("Removing orphaned stack directory")
+
+		err = os.RemoveAll(target)
+		if err != nil {
+			log.Error().
+				Err(err).
+				Str("path", target).
+				Msg("Failed to remove orphaned stack directory")
+			continue
+		}
+
+		reclaimed += size
+	}
+
+	if cmd.Images {
+		images, err := unusedImages(cmd.KeepImages)
+		if err != nil {
+			log.Error().
+				Err(err).
+				Msg("Failed to list unused images")
+			return err
+		}
+
+		for _, image := range images {
+			fmt.Printf("image\t%s\t%s\n", image, formatBytes(image.Size))
+
+			if !cmd.Yes {
+				reclaimed += image.Size
+				continue
+			}
+
+			// The image is used by no container, the force flag only
+			// removes all of its tags at once
+			_, err := runCommand(getDockerBinaryPath(), []string{"--config", PORTAINER_DOCKER_CONFIG_PATH, "image", "rm", "--force", image.ID})
+			if err != nil {
+				log.Warn().
+					Err(err).
+					Str("image", image.String()).
+					Msg("Failed to remove unused image")
+				continue
+			}
+
+			reclaimed += image.Size
+		}
+	}
+
+	// Image sizes include the layers shared with other images, the actual
+	// space reclaimed may be lower
+	event := log.Info().
+		Int("stacks", len(orphans)).
+		Int64("bytes", reclaimed).
+		Str("size", formatBytes(reclaimed))
+	if cmd.Yes {
+		event.Msg("Garbage collection complete")
+	} else {
+		event.Msg("Dry run, pass --yes to remove")
+	}
+
+	return nil
+}
+
+// orphanedStackDirectories returns the stack directories of destination, see
+// makeWorkingDir, matching neither a Compose project nor a Swarm stack
+// known to the Docker host.
+func orphanedStackDirectories(destination string, minAge time.Duration) ([]string, error) {
+	stacksDir := makeWorkingDir(destination, "")
+
+	if _, err := os.Stat(stacksDir); os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	deployed, err := deployedStacks()
+	if err != nil {
+		return nil, err
+	}
+
+	return orphanedDirectories(stacksDir, deployed, minAge)
+}
+
+// orphanedDirectories returns the directories of stacksDir missing from
+// deployed. The directories modified for less than minAge and the ones of a
+// deployment in progress, see markDeployInProgress, are skipped, their stack
+// may not be created yet.
+func orphanedDirectories(stacksDir string, deployed map[string]struct{}, minAge time.Duration) ([]string, error) {
+	entries, err := os.ReadDir(stacksDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	orphans := []string{}
+	for _, entry := range entries {
+		if _, ok := deployed[entry.Name()]; ok || !entry.IsDir() {
+			continue
+		}
+
+		dir := filepath.Join(stacksDir, entry.Name())
+
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < minAge {
+			log.Debug().
+				Str("path", dir).
+				Msg("Skipping recently modified stack directory")
+			continue
+		}
+
+		if marker, err := os.Stat(dir + deployMarkerSuffix); err == nil && time.Since(marker.ModTime()) < deployMarkerStaleAge {
+			log.Debug().
+				Str("path", dir).
+				Msg("Skipping stack directory of a deployment in progress")
+			continue
+		}
+
+		orphans = append(orphans, dir)
+	}
+
+	return orphans, nil
+}
+
+// deployedStacks returns the names of the Compose projects with containers,
+// stopped ones included, and of the Swarm stacks with services.
+func deployedStacks() (map[string]struct{}, error) {
+	command := getDockerBinaryPath()
+	deployed := make(map[string]struct{})
+
+	output, err := runCommand(command, []string{
+		"--config", PORTAINER_DOCKER_CONFIG_PATH, "ps", "-a",
+		"--filter", "label=" + composeProjectLabel,
+		"--format", fmt.Sprintf("{{.Label %q}}", composeProjectLabel),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range splitLines(output) {
+		deployed[name] = struct{}{}
+	}
+
+	output, err = runCommand(command, []string{
+		"--config", PORTAINER_DOCKER_CONFIG_PATH, "service", "ls",
+		"--filter", "label=" + swarmStackNamespaceLabel,
+		"--format", fmt.Sprintf("{{.Label %q}}", swarmStackNamespaceLabel),
+	})
+	if isNotSwarmManager(err) {
+		log.Debug().
+			Err(err).
+			Msg("Not a Swarm manager, only checking Compose projects")
+		return deployed, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range splitLines(output) {
+		deployed[name] = struct{}{}
+	}
+
+	return deployed, nil
+}
+
+// unusedImages returns the images used by no container nor Swarm service,
+// except the keep most recent ones of each repository.
+func unusedImages(keep int) ([]localImage, error) {
+	command := getDockerBinaryPath()
+
+	output, err := runCommand(command, []string{"--config", PORTAINER_DOCKER_CONFIG_PATH, "image", "ls", "-q", "--no-trunc"})
+	if err != nil {
+		return nil, err
+	}
+
+	imageIDs := uniqueStrings(splitLines(output))
+	if len(imageIDs) == 0 {
+		return nil, nil
+	}
+
+	output, err = runCommand(command, append([]string{"--config", PORTAINER_DOCKER_CONFIG_PATH, "image", "inspect"}, imageIDs...))
+	if err != nil {
+		return nil, err
+	}
+
+	var images []localImage
+	err = json.Unmarshal([]byte(output), &images)
+	if err != nil {
+		return nil, err
+	}
+
+	used, err := usedImages()
+	if err != nil {
+		return nil, err
+	}
+
+	return selectUnusedImages(images, used, keep), nil
+}
+
+// selectUnusedImages returns the images missing from used, except the keep
+// most recent ones of each repository.
+func selectUnusedImages(images []localImage, used map[string]struct{}, keep int) []localImage {
+	byRepository := make(map[string][]localImage)
+	for _, image := range images {
+		if imageInUse(image, used) {
+			continue
+		}
+
+		repository := image.Repository()
+		byRepository[repository] = append(byRepository[repository], image)
+	}
+
+	unused := []localImage{}
+	for _, repositoryImages := range byRepository {
+		sort.Slice(repositoryImages, func(i, j int) bool {
+			return repositoryImages[i].Created.After(repositoryImages[j].Created)
+		})
+
+		if len(repositoryImages) > keep {
+			unused = append(unused, repositoryImages[keep:]...)
+		}
+	}
+
+	sort.Slice(unused, func(i, j int) bool {
+		return unused[i].String() < unused[j].String()
+	})
+
+	return unused
+}
+
+// usedImages returns the image IDs of the containers and the image
+// references of the Swarm services.
+func usedImages() (map[string]struct{}, error) {
+	command := getDockerBinaryPath()
+	used := make(map[string]struct{})
+
+	output, err := runCommand(command, []string{"--config", PORTAINER_DOCKER_CONFIG_PATH, "ps", "-a", "-q", "--no-trunc"})
+	if err != nil {
+		return nil, err
+	}
+
+	if containerIDs := splitLines(output); len(containerIDs) > 0 {
+		output, err = runCommand(command, append([]string{"--config", PORTAINER_DOCKER_CONFIG_PATH, "container", "inspect", "--format", "{{.Image}}"}, containerIDs...))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, imageID := range splitLines(output) {
+			used[imageID] = struct{}{}
+		}
+	}
+
+	// The tasks of the services may not run on this node yet
+	output, err = runCommand(command, []string{"--config", PORTAINER_DOCKER_CONFIG_PATH, "service", "ls", "--format", "{{.Image}}"})
+	if isNotSwarmManager(err) {
+		log.Debug().
+			Err(err).
+			Msg("Not a Swarm manager, only checking containers")
+		return used, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, image := range splitLines(output) {
+		if ref, err := parseImageReference(image); err == nil {
+			used[ref.String()] = struct{}{}
+		}
+	}
+
+	return used, nil
+}
+
+// imageInUse returns whether the image ID, or one of its tags or digests, is
+// in used.
+func imageInUse(image localImage, used map[string]struct{}) bool {
+	if _, ok := used[image.ID]; ok {
+		return true
+	}
+
+	for _, ref := range append(image.RepoTags, image.RepoDigests...) {
+		parsed, err := parseImageReference(ref)
+		if err != nil {
+			continue
+		}
+
+		if _, ok := used[parsed.String()]; ok {
+			return true
+		}
+
+		// Service images are usually pinned by digest
+		for reference := range used {
+			if usedRef, err := parseImageReference(reference); err == nil && usedRef.Digest != "" && usedRef.Name() == parsed.Name() && usedRef.Digest == parsed.Digest {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// isNotSwarmManager returns whether err is the error of the Swarm commands
+// run on a node which is not a Swarm manager.
+func isNotSwarmManager(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "not a swarm manager")
+}
+
+func uniqueStrings(values []string) []string {
+	seen := make(map[string]struct{}, len(values))
+	unique := []string{}
+	for _, value := range values {
+		if _, ok := seen[value]; !ok {
+			seen[value] = struct{}{}
+			unique = append(unique, value)
+		}
+	}
+
+	return unique
+}
+
+// directorySize returns the total size of the regular files under dir,
+// unreadable entries being skipped.
+func directorySize(dir string) int64 {
+	var size int64
+	filepath.WalkDir(dir, func(p string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+
+		if entry.Type().IsRegular() {
+			if info, err := entry.Info(); err == nil {
+				size += info.Size()
+			}
+		}
+
+		return nil
+	})
+
+	return size
+}
+
+func formatBytes(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%dB", size)
+	}
+
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f%ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSelectUnusedImages(t *testing.T) {
+	now := time.Now()
+	image := func(id string, age time.Duration, refs ...string) localImage {
+		img := localImage{ID: id, Created: now.Add(-age)}
+		for _, ref := range refs {
+			if strings.Contains(ref, "@") {
+				img.RepoDigests = append(img.RepoDigests, ref)
+			} else {
+				img.RepoTags = append(img.RepoTags, ref)
+			}
+		}
+		return img
+	}
+
+	const digest = "sha256:1111111111111111111111111111111111111111111111111111111111111111"
+	images := []localImage{
+		image("sha256:nginx1", 1*time.Hour, "nginx:1.27"),
+		image("sha256:nginx2", 2*time.Hour, "nginx:1.26"),
+		image("sha256:nginx3", 3*time.Hour, "nginx:1.25"),
+		image("sha256:nginx4", 4*time.Hour, "nginx:1.24"),
+		image("sha256:app1", 1*time.Hour, "ghcr.io/org/app:2"),
+		image("sha256:app2", 2*time.Hour, "ghcr.io/org/app@"+digest),
+		image("sha256:dangling1", 1*time.Hour),
+		image("sha256:dangling2", 2*time.Hour),
+	}
+
+	tests := []struct {
+		name string
+		used []string
+		keep int
+		want []string
+	}{
+		{
+			name: "keep none",
+			want: []string{"sha256:app1", "sha256:app2", "sha256:nginx4", "sha256:nginx3", "sha256:nginx2", "sha256:nginx1", "sha256:dangling1", "sha256:dangling2"},
+		},
+		{
+			name: "keep the most recent per repository",
+			keep: 2,
+			want: []string{"sha256:nginx4", "sha256:nginx3"},
+		},
+		{
+			name: "used images are not counted",
+			used: []string{"sha256:nginx1", "docker.io/library/nginx:1.26"},
+			keep: 1,
+			want: []string{"sha256:app2", "sha256:nginx4", "sha256:dangling2"},
+		},
+		{
+			name: "service image pinned by digest",
+			used: []string{"ghcr.io/org/app:2@" + digest},
+			keep: 0,
+			want: []string{"sha256:app1", "sha256:nginx4", "sha256:nginx3", "sha256:nginx2", "sha256:nginx1", "sha256:dangling1", "sha256:dangling2"},
+		},
+		{
+			name: "keep more than available",
+			keep: 5,
+			want: []string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Container image IDs and service references, as usedImages
+			// returns them
+			used := make(map[string]struct{})
+			for _, ref := range tt.used {
+				if parsed, err := parseImageReference(ref); err == nil && !strings.HasPrefix(ref, "sha256:") {
+					ref = parsed.String()
+				}
+				used[ref] = struct{}{}
+			}
+
+			got := []string{}
+			for _, image := range selectUnusedImages(images, used, tt.keep) {
+				got = append(got, image.ID)
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("selectUnusedImages() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOrphanedDirectories(t *testing.T) {
+	stacksDir := makeWorkingDir(t.TempDir(), "")
+	writeTestFiles(t, stacksDir, map[string]string{
+		"deployed/docker-compose.yml":    "",
+		"orphan/docker-compose.yml":      "",
+		"recent/docker-compose.yml":      "",
+		"deploying/docker-compose.yml":   "",
+		"crashed/docker-compose.yml":     "",
+		"deploying" + deployMarkerSuffix: "1\n",
+		"crashed" + deployMarkerSuffix:   "1\n",
+		"file":                           "",
+	})
+
+	old := time.Now().Add(-2 * time.Hour)
+	for _, name := range []string{"deployed", "orphan", "deploying", "crashed"} {
+		if err := os.Chtimes(filepath.Join(stacksDir, name), old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stale := time.Now().Add(-deployMarkerStaleAge - time.Hour)
+	if err := os.Chtimes(filepath.Join(stacksDir, "crashed"+deployMarkerSuffix), stale, stale); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := orphanedDirectories(stacksDir, map[string]struct{}{"deployed": {}}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{filepath.Join(stacksDir, "crashed"), filepath.Join(stacksDir, "orphan")}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("orphanedDirectories() = %v, want %v", got, want)
+	}
+}
+
+func TestMarkDeployInProgress(t *testing.T) {
+	mountPath := makeWorkingDir(t.TempDir(), "web")
+
+	unmark, err := markDeployInProgress(mountPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(mountPath + deployMarkerSuffix); err != nil {
+		t.Fatalf("marker missing: %v", err)
+	}
+
+	unmark()
+	if _, err := os.Stat(mountPath + deployMarkerSuffix); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("marker left behind: %v", err)
+	}
+}
+
+func TestIsNotSwarmManager(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{err: nil},
+		{err: errors.New("Error response from daemon: This node is not a swarm manager. Use \"docker swarm init\" or \"docker swarm join\" to connect this node to swarm and try again."), want: true},
+		{err: errors.New("Cannot connect to the Docker daemon at unix:///var/run/docker.sock. Is the docker daemon running?")},
+	}
+
+	for _, tt := range tests {
+		if got := isNotSwarmManager(tt.err); got != tt.want {
+			t.Errorf("isNotSwarmManager(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/rs/zerolog/log"
+)
+
+// GitCloneConfig gathers everything needed to materialize a stack repository
+// on disk.
+type GitCloneConfig struct {
+	URL       string
+	Reference string
+	User      string
+	Password  string
+	Depth     int
+
+	RecurseSubmodules bool
+	// SubmoduleCredentials are "host[:port]=username:password" entries used
+	// for the submodules hosted on a matching host. User/Password apply to
+	// the main repository and to the submodules of its host without a
+	// matching entry, both backends following this precedence.
+	SubmoduleCredentials []string
+
+	LFS bool
+	// LFSPaths are the directories, relative to the clone root, in which LFS
+	// pointer files are replaced by their content
+	LFSPaths []string
+
+	// SparsePaths, when not empty, restricts the checkout to these
+	// directories of the repository
+	SparsePaths []string
+
+	// CacheDir, when set, holds bare mirrors shared by the stacks cloned
+	// from the same repository
+	CacheDir string
+	// CacheMaxAge is the time after which an unused mirror is removed
+	CacheMaxAge time.Duration
+
+	// Backend is the name of the GitBackend to use, see newGitBackend
+	Backend string
+
+	Transport TransportOptions
+}
+
+func (cmd *DeployCommand) gitCloneConfig() GitCloneConfig {
+	return GitCloneConfig{
+		URL:                  cmd.GitRepository,
+		Reference:            cmd.Reference,
+		User:                 cmd.User,
+		Password:             cmd.Password,
+		Depth:                cmd.CloneDepth,
+		RecurseSubmodules:    cmd.RecurseSubmodules,
+		SubmoduleCredentials: cmd.SubmoduleCredential,
+		LFS:                  cmd.LFS,
+		LFSPaths:             composeDirectories(cmd.Workdir, cmd.ComposeRelativeFilePaths),
+		SparsePaths:          sparsePaths(cmd.Sparse, cmd.SparsePath, composeDirectories(cmd.Workdir, cmd.ComposeRelativeFilePaths)),
+		CacheDir:             cmd.CacheDir,
+		CacheMaxAge:          cmd.CacheMaxAge,
+		Backend:              cmd.GitBackend,
+		Transport:            cmd.transportOptions(),
+	}
+}
+
+func (cmd *SwarmDeployCommand) gitCloneConfig() GitCloneConfig {
+	return GitCloneConfig{
+		URL:                  cmd.GitRepository,
+		Reference:            cmd.Reference,
+		User:                 cmd.User,
+		Password:             cmd.Password,
+		Depth:                cmd.CloneDepth,
+		RecurseSubmodules:    cmd.RecurseSubmodules,
+		SubmoduleCredentials: cmd.SubmoduleCredential,
+		LFS:                  cmd.LFS,
+		LFSPaths:             composeDirectories(cmd.Workdir, cmd.ComposeRelativeFilePaths),
+		SparsePaths:          sparsePaths(cmd.Sparse, cmd.SparsePath, composeDirectories(cmd.Workdir, cmd.ComposeRelativeFilePaths)),
+		CacheDir:             cmd.CacheDir,
+		CacheMaxAge:          cmd.CacheMaxAge,
+		Backend:              cmd.GitBackend,
+		Transport:            cmd.transportOptions(),
+	}
+}
+
+const (
+	gitBackendGoGit  = "go-git"
+	gitBackendBinary = "git"
+	gitBackendAuto   = "auto"
+)
+
+// GitBackend performs the Git operations needed to materialize a stack
+// repository on disk.
+type GitBackend interface {
+	Name() string
+	// Clone clones cfg.URL at cfg.Reference into clonePath, restricted to
+	// cfg.SparsePaths when set
+	Clone(ctx context.Context, clonePath string, cfg GitCloneConfig) error
+	// Fetch fetches cfg.Reference, or the remote HEAD when empty, into the
+	// bare repository at mirror, creating it when needed. It returns the
+	// fetched reference and the commit it resolves to.
+	Fetch(ctx context.Context, mirror string, cfg GitCloneConfig) (plumbing.ReferenceName, plumbing.Hash, error)
+	// Checkout creates a repository at clonePath borrowing the objects of
+	// mirror and checks out hash on referenceName, restricted to
+	// cfg.SparsePaths when set
+	Checkout(ctx context.Context, clonePath string, mirror string, referenceName plumbing.ReferenceName, hash plumbing.Hash, cfg GitCloneConfig) error
+	// UpdateSubmodules initializes and checks out the submodules of the
+	// repository at clonePath recursively, only those under cfg.SparsePaths
+	// when set
+	UpdateSubmodules(ctx context.Context, clonePath string, cfg GitCloneConfig) error
+}
+
+// newGitBackend returns the backend registered under name. The auto backend
+// is go-git, cloneRepository uses the git binary instead for sparse
+// checkouts and falls back to it on known go-git protocol errors.
+func newGitBackend(name string) (GitBackend, error) {
+	switch name {
+	case gitBackendGoGit, gitBackendAuto, "":
+		return goGitBackend{}, nil
+	case gitBackendBinary:
+		return newGitBinaryBackend()
+	}
+
+	return nil, fmt.Errorf("unknown Git backend %q", name)
+}
+
+// cloneRepository clones the repository described by cfg into clonePath, then
+// checks out its submodules and LFS objects when requested.
+func cloneRepository(ctx context.Context, clonePath string, cfg GitCloneConfig) error {
+	backend, err := newGitBackend(cfg.Backend)
+	if err != nil {
+		log.Error().
+			Err(err).
+			Msg("Failed to create Git backend")
+		return err
+	}
+
+	// go-git has no partial clone support and fetches every blob, the git
+	// binary only fetches the blobs of the sparse paths
+	if cfg.Backend == gitBackendAuto && len(cfg.SparsePaths) > 0 {
+		if binaryBackend, err := newGitBinaryBackend(); err == nil {
+			backend = binaryBackend
+		} else {
+			log.Debug().
+				Err(err).
+				Msg("git binary not available, the sparse checkout fetches the whole repository")
+		}
+	}
+
+	err = cloneWithBackend(ctx, backend, clonePath, cfg)
+	if err != nil && cfg.Backend == gitBackendAuto && backend.Name() == gitBackendGoGit && isGoGitProtocolError(err) {
+		fallback, fallbackErr := newGitBinaryBackend()
+		if fallbackErr == nil {
+			log.Warn().
+				Err(err).
+				Msg("go-git failed, falling back to the git binary")
+
+			backend = fallback
+			err = os.RemoveAll(clonePath)
+			if err == nil {
+				err = cloneWithBackend(ctx, backend, clonePath, cfg)
+			}
+		}
+	}
+	if err != nil {
+		log.Error().
+			Err(err).
+			Str("backend", backend.Name()).
+			Msg("Failed to clone Git repository")
+		return err
+	}
+
+	if cfg.LFS {
+		err = fetchLFSObjects(ctx, clonePath, cfg.URL, cfg, cfg.LFSPaths)
+		if err != nil {
+			log.Error().
+				Err(err).
+				Msg("Failed to fetch Git LFS objects")
+			return err
+		}
+	}
+
+	return nil
+}
+
+func cloneWithBackend(ctx context.Context, backend GitBackend, clonePath string, cfg GitCloneConfig) error {
+	log.Info().
+		Str("repository", cfg.URL).
+		Str("path", clonePath).
+		Str("reference", cfg.Reference).
+		Int("depth", cfg.Depth).
+		Strs("sparsePaths", cfg.SparsePaths).
+		Str("cacheDir", cfg.CacheDir).
+		Str("backend", backend.Name()).
+		Msg("Cloning git repository")
+
+	var err error
+	if cfg.CacheDir != "" {
+		err = cloneFromCache(ctx, backend, clonePath, cfg)
+		defer pruneGitCache(ctx, cfg.CacheDir, cfg.CacheMaxAge)
+	} else {
+		err = backend.Clone(ctx, clonePath, cfg)
+	}
+	if err != nil {
+		return err
+	}
+
+	if cfg.RecurseSubmodules {
+		err = backend.UpdateSubmodules(ctx, clonePath, cfg)
+		if err != nil {
+			return fmt.Errorf("failed to update Git submodules: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// goGitProtocolErrors are fragments of the errors go-git returns when it
+// does not speak the dialect of a Git server (Azure DevOps multi_ack, some
+// Bitbucket Server setups). Network, HTTP status and repository errors, which
+// the git binary would fail on as well, must not match, go-git reporting many
+// of them as unexpected client errors too.
+var goGitProtocolErrors = []string{
+	"multi_ack",
+	"invalid pkt-len",
+	"unsupported capability",
+	"empty advertised-ref message",
+	"malformed ref data",
+	"bad number of `:` in symref value",
+}
+
+func isGoGitProtocolError(err error) bool {
+	if errors.Is(err, transport.ErrEmptyUploadPackRequest) {
+		return true
+	}
+
+	for _, fragment := range goGitProtocolErrors {
+		if strings.Contains(err.Error(), fragment) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// resolveSubmoduleURL resolves a relative submodule URL ("../other.git")
+// against the URL of its parent repository, the same way go-git does.
+func resolveSubmoduleURL(parentURL, submoduleURL string) string {
+	if !strings.HasPrefix(submoduleURL, "./") && !strings.HasPrefix(submoduleURL, "../") {
+		return submoduleURL
+	}
+
+	u, err := url.Parse(parentURL)
+	if err != nil {
+		return submoduleURL
+	}
+
+	u.Path = path.Join(u.Path, submoduleURL)
+	return u.String()
+}
+
+// submoduleAuth returns the credentials configured for the host of
+// submoduleURL, falling back to the credentials of the main repository for
+// the submodules hosted next to it.
+func submoduleAuth(submoduleURL string, cfg GitCloneConfig) *http.BasicAuth {
+	host := repositoryHost(submoduleURL)
+
+	if user, password, ok := submoduleCredential(cfg.SubmoduleCredentials, host); ok {
+		return getAuth(user, password)
+	}
+
+	if host != "" && strings.EqualFold(host, repositoryHost(cfg.URL)) {
+		return getAuth(cfg.User, cfg.Password)
+	}
+
+	return nil
+}
+
+// submoduleCredential returns the first of the submodule credentials whose
+// host matches host.
+func submoduleCredential(credentials []string, host string) (string, string, bool) {
+	for _, credential := range credentials {
+		credentialHost, userPassword, ok := strings.Cut(credential, "=")
+		if !ok || !strings.EqualFold(credentialHost, host) {
+			continue
+		}
+
+		user, password, _ := strings.Cut(userPassword, ":")
+		return user, password, true
+	}
+
+	return "", "", false
+}
+
+// repositoryHost returns the host of repositoryURL, with its port when the URL
+// sets one.
+func repositoryHost(repositoryURL string) string {
+	endpoint, err := transport.NewEndpoint(repositoryURL)
+	if err != nil {
+		return ""
+	}
+
+	if endpoint.Port != 0 {
+		return endpoint.Host + ":" + strconv.Itoa(endpoint.Port)
+	}
+
+	return endpoint.Host
+}
+
+// sparsePaths returns the repository paths to check out in sparse mode: the
+// compose file directories plus the extra paths. It returns nil when sparse
+// mode is off or when one of the paths is the repository root.
+func sparsePaths(sparse bool, extraPaths []string, composeDirs []string) []string {
+	if !sparse && len(extraPaths) == 0 {
+		return nil
+	}
+
+	paths := []string{}
+	for _, p := range append(composeDirs, extraPaths...) {
+		p = strings.Trim(path.Clean(p), "/")
+		if p == "." || p == "" {
+			return nil
+		}
+
+		paths = append(paths, p)
+	}
+
+	return paths
+}
+
+// composeDirectories returns the distinct directories holding the given
+// compose files, relative to the clone root. When no compose file is given,
+// the files are discovered after the clone and the working directory is
+// returned instead.
+func composeDirectories(workdir string, composeRelativeFilePaths []string) []string {
+	if len(composeRelativeFilePaths) == 0 {
+		return []string{path.Clean(workdir)}
+	}
+
+	seen := make(map[string]struct{})
+	dirs := []string{}
+
+	for _, composeFilePath := range composeRelativeFilePaths {
+		dir := path.Dir(path.Join(workdir, composeFilePath))
+		if _, ok := seen[dir]; ok {
+			continue
+		}
+
+		seen[dir] = struct{}{}
+		dirs = append(dirs, dir)
+	}
+
+	return dirs
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+)
+
+// authRecorder is a Git HTTP server recording the Authorization headers of
+// the requests, by repository path.
+type authRecorder struct {
+	*httptest.Server
+	mu      sync.Mutex
+	headers map[string][]string
+}
+
+func newAuthRecorder(t *testing.T) *authRecorder {
+	t.Helper()
+
+	recorder := &authRecorder{headers: make(map[string][]string)}
+	recorder.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		repository, _, _ := strings.Cut(r.URL.Path, ".git/")
+		recorder.mu.Lock()
+		recorder.headers[repository+".git"] = r.Header.Values("Authorization")
+		recorder.mu.Unlock()
+		http.NotFound(w, r)
+	}))
+	t.Cleanup(recorder.Close)
+
+	return recorder
+}
+
+func (r *authRecorder) user(repository string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	headers := r.headers[repository]
+	if len(headers) != 1 {
+		return strings.Join(headers, ",")
+	}
+
+	for _, user := range []string{"main", "sub", "other"} {
+		if "Authorization: "+headers[0] == basicAuthHeader(user, user+"-password") {
+			return user
+		}
+	}
+
+	return headers[0]
+}
+
+func TestSubmoduleAuthPrecedence(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git binary not found")
+	}
+
+	main := newAuthRecorder(t)
+	other := newAuthRecorder(t)
+	mainHost := strings.TrimPrefix(main.URL, "http://")
+	otherHost := strings.TrimPrefix(other.URL, "http://")
+
+	tests := []struct {
+		name        string
+		credentials []string
+		url         string
+		repository  string
+		server      *authRecorder
+		want        string
+	}{
+		{name: "main repository", url: main.URL + "/org/main.git", repository: "/org/main.git", server: main, want: "main"},
+		{name: "main repository with a credential for its host", credentials: []string{mainHost + "=sub:sub-password"}, url: main.URL + "/org/main.git", repository: "/org/main.git", server: main, want: "main"},
+		{name: "submodule of the main host", url: main.URL + "/org/sub.git", repository: "/org/sub.git", server: main, want: "main"},
+		{name: "submodule with a credential for the main host", credentials: []string{mainHost + "=sub:sub-password"}, url: main.URL + "/org/sub.git", repository: "/org/sub.git", server: main, want: "sub"},
+		{name: "submodule of another host", url: other.URL + "/org/sub.git", repository: "/org/sub.git", server: other, want: ""},
+		{name: "submodule with a credential for another host", credentials: []string{otherHost + "=other:other-password", mainHost + "=sub:sub-password"}, url: other.URL + "/org/sub.git", repository: "/org/sub.git", server: other, want: "other"},
+		{name: "first credential of a host", credentials: []string{mainHost + "=sub:sub-password", mainHost + "=other:other-password"}, url: main.URL + "/org/sub.git", repository: "/org/sub.git", server: main, want: "sub"},
+	}
+
+	backend := &gitBinaryBackend{binary: "git"}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := GitCloneConfig{
+				URL:                  main.URL + "/org/main.git",
+				User:                 "main",
+				Password:             "main-password",
+				SubmoduleCredentials: tt.credentials,
+			}
+
+			// go-git clones the main repository with the main credentials
+			auth := submoduleAuth(tt.url, cfg)
+			if tt.url == cfg.URL {
+				auth = getAuth(cfg.User, cfg.Password)
+			}
+
+			got := ""
+			if auth != nil {
+				got = auth.Username
+			}
+			if got != tt.want {
+				t.Errorf("go-git user = %q, want %q", got, tt.want)
+			}
+
+			// git binary, the request fails once the headers are recorded
+			_, _ = backend.run(context.Background(), t.TempDir(), cfg, "ls-remote", tt.url)
+			if got := tt.server.user(tt.repository); got != tt.want {
+				t.Errorf("git user = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsGoGitProtocolError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "empty upload-pack request", err: transport.ErrEmptyUploadPackRequest, want: true},
+		{name: "wrapped empty upload-pack request", err: fmt.Errorf("fetch: %w", transport.ErrEmptyUploadPackRequest), want: true},
+		{name: "multi_ack", err: errors.New("unexpected client error: multi_ack_detailed capability not supported"), want: true},
+		{name: "invalid pkt-len", err: plumbing.NewUnexpectedError(errors.New("invalid pkt-len found")), want: true},
+		{name: "malformed symref", err: plumbing.NewUnexpectedError(errors.New("bad number of `:` in symref value")), want: true},
+		{name: "network error", err: plumbing.NewUnexpectedError(errors.New("dial tcp 10.0.0.1:443: connect: connection refused"))},
+		{name: "HTTP status error", err: plumbing.NewUnexpectedError(errors.New("unexpected requesting \"https://dev.azure.com/org/_git/repo/info/refs\" status code: 500"))},
+		{name: "authentication required", err: transport.ErrAuthenticationRequired},
+		{name: "repository not found", err: transport.ErrRepositoryNotFound},
+		{name: "unknown reference", err: plumbing.ErrReferenceNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isGoGitProtocolError(tt.err); got != tt.want {
+				t.Errorf("isGoGitProtocolError(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
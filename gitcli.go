@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/rs/zerolog/log"
+)
+
+var errGitBinaryNotFound = errors.New("git binary not found")
+
+// systemCABundles are the usual locations of the system CA bundle, which is
+// merged with --git-ca-file since git only accepts a single bundle.
+var systemCABundles = []string{
+	"/etc/ssl/certs/ca-certificates.crt",
+	"/etc/pki/tls/certs/ca-bundle.crt",
+	"/etc/ssl/ca-bundle.pem",
+	"/etc/ssl/cert.pem",
+}
+
+// gitBinaryBackend implements GitBackend by driving the git binary shipped
+// with the unpacker, or the one found in PATH.
+type gitBinaryBackend struct {
+	binary string
+}
+
+func newGitBinaryBackend() (GitBackend, error) {
+	binary := getGitBinaryPath()
+	if _, err := os.Stat(binary); err != nil {
+		binary, err = exec.LookPath("git")
+		if err != nil {
+			return nil, errGitBinaryNotFound
+		}
+	}
+
+	return &gitBinaryBackend{binary: binary}, nil
+}
+
+func (b *gitBinaryBackend) Name() string {
+	return gitBackendBinary
+}
+
+func (b *gitBinaryBackend) Clone(ctx context.Context, clonePath string, cfg GitCloneConfig) error {
+	args := []string{"clone", "--no-checkout"}
+	if cfg.Depth > 0 {
+		args = append(args, "--depth", strconv.Itoa(cfg.Depth))
+	}
+	if len(cfg.SparsePaths) > 0 {
+		args = append(args, "--filter=blob:none", "--sparse")
+	}
+
+	referenceName := plumbing.ReferenceName(cfg.Reference)
+	if referenceName.IsBranch() || referenceName.IsTag() {
+		args = append(args, "--branch", referenceName.Short())
+	}
+	args = append(args, cfg.URL, clonePath)
+
+	_, err := b.run(ctx, "", cfg, args...)
+	if err != nil {
+		return err
+	}
+
+	if cfg.Reference != "" && !referenceName.IsBranch() && !referenceName.IsTag() {
+		args = []string{"fetch", "origin", cfg.Reference}
+		if cfg.Depth > 0 {
+			args = append(args, "--depth", strconv.Itoa(cfg.Depth))
+		}
+
+		_, err = b.run(ctx, clonePath, cfg, args...)
+		if err != nil {
+			return err
+		}
+
+		return b.checkout(ctx, clonePath, cfg, "--detach", "FETCH_HEAD")
+	}
+
+	return b.checkout(ctx, clonePath, cfg)
+}
+
+func (b *gitBinaryBackend) Fetch(ctx context.Context, mirror string, cfg GitCloneConfig) (plumbing.ReferenceName, plumbing.Hash, error) {
+	if _, err := os.Stat(mirror); errors.Is(err, os.ErrNotExist) {
+		log.Info().
+			Str("mirror", mirror).
+			Str("repository", cfg.URL).
+			Msg("Creating Git cache mirror")
+
+		_, err = b.run(ctx, "", cfg, "init", "--bare", mirror)
+		if err != nil {
+			return "", plumbing.ZeroHash, err
+		}
+	}
+
+	referenceName := plumbing.ReferenceName(cfg.Reference)
+	if referenceName == "" {
+		output, err := b.run(ctx, mirror, cfg, "ls-remote", "--symref", cfg.URL, "HEAD")
+		if err != nil {
+			return "", plumbing.ZeroHash, err
+		}
+
+		referenceName = parseSymref(output)
+		if referenceName == "" {
+			return "", plumbing.ZeroHash, errReferenceNotFound
+		}
+	}
+
+	args := []string{"fetch", "--force", "--no-tags"}
+	if cfg.Depth > 0 {
+		args = append(args, "--depth", strconv.Itoa(cfg.Depth))
+	}
+	if len(cfg.SparsePaths) > 0 {
+		args = append(args, "--filter=blob:none")
+	}
+	args = append(args, cfg.URL, fmt.Sprintf("+%s:%s", referenceName, referenceName))
+
+	_, err := b.run(ctx, mirror, cfg, args...)
+	if err != nil {
+		return "", plumbing.ZeroHash, err
+	}
+
+	output, err := b.run(ctx, mirror, cfg, "rev-parse", referenceName.String()+"^{commit}")
+	if err != nil {
+		return "", plumbing.ZeroHash, err
+	}
+
+	return referenceName, plumbing.NewHash(strings.TrimSpace(output)), nil
+}
+
+func (b *gitBinaryBackend) Checkout(ctx context.Context, clonePath string, mirror string, referenceName plumbing.ReferenceName, hash plumbing.Hash, cfg GitCloneConfig) error {
+	_, err := b.run(ctx, "", cfg, "init", clonePath)
+	if err != nil {
+		return err
+	}
+
+	err = writeAlternates(clonePath, mirror)
+	if err != nil {
+		return err
+	}
+
+	_, err = b.run(ctx, clonePath, cfg, "remote", "add", "origin", cfg.URL)
+	if err != nil {
+		return err
+	}
+
+	if referenceName.IsBranch() {
+		_, err = b.run(ctx, clonePath, cfg, "update-ref", referenceName.String(), hash.String())
+		if err != nil {
+			return err
+		}
+
+		return b.checkout(ctx, clonePath, cfg, referenceName.Short())
+	}
+
+	return b.checkout(ctx, clonePath, cfg, "--detach", hash.String())
+}
+
+func (b *gitBinaryBackend) UpdateSubmodules(ctx context.Context, clonePath string, cfg GitCloneConfig) error {
+	args := []string{"submodule", "update", "--init", "--recursive"}
+	if len(cfg.SparsePaths) > 0 {
+		args = append(append(args, "--"), cfg.SparsePaths...)
+	}
+
+	_, err := b.run(ctx, clonePath, cfg, args...)
+	return err
+}
+
+// checkout runs "git checkout --force" with checkoutArgs in the repository
+// at clonePath, limiting the worktree to the sparse paths when set.
+func (b *gitBinaryBackend) checkout(ctx context.Context, clonePath string, cfg GitCloneConfig, checkoutArgs ...string) error {
+	if len(cfg.SparsePaths) > 0 {
+		args := append([]string{"sparse-checkout", "set", "--cone"}, cfg.SparsePaths...)
+		_, err := b.run(ctx, clonePath, cfg, args...)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := b.run(ctx, clonePath, cfg, append([]string{"checkout", "--force"}, checkoutArgs...)...)
+	return err
+}
+
+// run executes git with the authentication, TLS and proxy settings of cfg and
+// returns its standard output. Credentials are passed through the
+// environment so that they do not show up in the process list.
+func (b *gitBinaryBackend) run(ctx context.Context, dir string, cfg GitCloneConfig, args ...string) (string, error) {
+	env, cleanup, err := gitBinaryEnv(cfg)
+	if err != nil {
+		return "", err
+	}
+	defer cleanup()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, b.binary, args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	log.Debug().
+		Str("command", b.binary).
+		Strs("args", args).
+		Msg("Running git")
+
+	err = cmd.Run()
+	if err != nil {
+		return stdout.String(), fmt.Errorf("git %s: %s", args[0], strings.TrimSpace(stderr.String()))
+	}
+
+	return stdout.String(), nil
+}
+
+// gitBinaryEnv translates cfg into git environment variables. The returned
+// function removes the temporary files created for them.
+func gitBinaryEnv(cfg GitCloneConfig) ([]string, func(), error) {
+	cleanup := func() {}
+	env := []string{"GIT_TERMINAL_PROMPT=0"}
+	env = append(env, cfg.Transport.proxyEnv()...)
+
+	if cfg.Transport.SkipTLSVerify {
+		env = append(env, "GIT_SSL_NO_VERIFY=true")
+	}
+
+	if cfg.Transport.CAFile != "" {
+		bundle, err := mergedCABundle(cfg.Transport.CAFile)
+		if err != nil {
+			return nil, cleanup, err
+		}
+
+		cleanup = func() { os.Remove(bundle) }
+		env = append(env, "GIT_SSL_CAINFO="+bundle)
+	}
+
+	// git sends every http.<url>.extraHeader matching a request, the most
+	// specific URL winning. The submodule credentials are set for their host
+	// and the main credentials for the host of the main repository, unless a
+	// submodule credential is set for it too, in which case they are only set
+	// for the main repository URL, an empty value first resetting the host
+	// header.
+	type httpHeader struct{ configURL, value string }
+	headers := []httpHeader{}
+	hostHeaders := map[string]bool{}
+
+	for _, credential := range cfg.SubmoduleCredentials {
+		host, _, ok := strings.Cut(credential, "=")
+		if !ok {
+			continue
+		}
+
+		user, password, _ := submoduleCredential(cfg.SubmoduleCredentials, host)
+		auth := getAuth(user, password)
+		if auth == nil {
+			continue
+		}
+
+		for _, scheme := range []string{"https", "http"} {
+			configURL := scheme + "://" + strings.ToLower(host) + "/"
+			if !hostHeaders[configURL] {
+				hostHeaders[configURL] = true
+				headers = append(headers, httpHeader{configURL, basicAuthHeader(auth.Username, auth.Password)})
+			}
+		}
+	}
+
+	if auth := getAuth(cfg.User, cfg.Password); auth != nil {
+		configURL := httpConfigURL(cfg.URL)
+		if hostHeaders[configURL] {
+			configURL = strings.TrimSuffix(configURL, "/") + repositoryPath(cfg.URL)
+			headers = append(headers, httpHeader{configURL, ""})
+		}
+
+		headers = append(headers, httpHeader{configURL, basicAuthHeader(auth.Username, auth.Password)})
+	}
+
+	for i, header := range headers {
+		env = append(env,
+			fmt.Sprintf("GIT_CONFIG_KEY_%d=http.%s.extraHeader", i, header.configURL),
+			fmt.Sprintf("GIT_CONFIG_VALUE_%d=%s", i, header.value),
+		)
+	}
+	env = append(env, fmt.Sprintf("GIT_CONFIG_COUNT=%d", len(headers)))
+
+	return env, cleanup, nil
+}
+
+// httpConfigURL returns the scheme://host[:port]/ prefix git uses to match
+// http.<url>.* settings against repositoryURL.
+func httpConfigURL(repositoryURL string) string {
+	endpoint, err := transport.NewEndpoint(repositoryURL)
+	if err != nil {
+		return repositoryURL
+	}
+
+	host := endpoint.Host
+	if endpoint.Port != 0 {
+		host += ":" + strconv.Itoa(endpoint.Port)
+	}
+
+	return endpoint.Protocol + "://" + host + "/"
+}
+
+// repositoryPath returns the path of repositoryURL, as matched by the
+// http.<url>.* settings.
+func repositoryPath(repositoryURL string) string {
+	endpoint, err := transport.NewEndpoint(repositoryURL)
+	if err != nil {
+		return ""
+	}
+
+	return "/" + strings.TrimPrefix(endpoint.Path, "/")
+}
+
+func basicAuthHeader(username, password string) string {
+	return "Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+}
+
+// mergedCABundle writes the system CA bundle followed by caFile to a
+// temporary file and returns its path.
+func mergedCABundle(caFile string) (string, error) {
+	extra, err := os.ReadFile(caFile)
+	if err != nil {
+		return "", err
+	}
+
+	var bundle []byte
+	for _, systemBundle := range systemCABundles {
+		content, err := os.ReadFile(systemBundle)
+		if err == nil {
+			bundle = append(content, '\n')
+			break
+		}
+	}
+	bundle = append(bundle, extra...)
+
+	f, err := os.CreateTemp("", "unpacker-ca-*.pem")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	_, err = f.Write(bundle)
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+
+	return f.Name(), nil
+}
+
+// parseSymref extracts the branch HEAD points to from the output of
+// "git ls-remote --symref <url> HEAD".
+func parseSymref(output string) plumbing.ReferenceName {
+	for _, line := range strings.Split(output, "\n") {
+		if !strings.HasPrefix(line, "ref: ") {
+			continue
+		}
+
+		fields := strings.Fields(strings.TrimPrefix(line, "ref: "))
+		if len(fields) == 2 && fields[1] == "HEAD" {
+			return plumbing.ReferenceName(fields[0])
+		}
+	}
+
+	return ""
+}
+
+func getGitBinaryPath() string {
+	command := path.Join(BIN_PATH, "git")
+	if runtime.GOOS == "windows" {
+		command = path.Join(BIN_PATH, "git.exe")
+	}
+	return command
+}
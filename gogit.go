@@ -0,0 +1,377 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/format/index"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/rs/zerolog/log"
+)
+
+// goGitBackend implements GitBackend in process with go-git.
+type goGitBackend struct{}
+
+func (goGitBackend) Name() string {
+	return gitBackendGoGit
+}
+
+func (goGitBackend) Clone(ctx context.Context, clonePath string, cfg GitCloneConfig) error {
+	repository, err := git.PlainCloneContext(ctx, clonePath, false, &git.CloneOptions{
+		URL:           cfg.URL,
+		ReferenceName: plumbing.ReferenceName(cfg.Reference),
+		Auth:          getAuth(cfg.User, cfg.Password),
+		Depth:         cfg.Depth,
+		NoCheckout:    len(cfg.SparsePaths) > 0,
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(cfg.SparsePaths) > 0 {
+		return checkoutSparse(repository, clonePath, cfg.SparsePaths)
+	}
+
+	return nil
+}
+
+func (goGitBackend) Fetch(ctx context.Context, mirror string, cfg GitCloneConfig) (plumbing.ReferenceName, plumbing.Hash, error) {
+	repository, err := git.PlainOpen(mirror)
+	if errors.Is(err, git.ErrRepositoryNotExists) {
+		log.Info().
+			Str("mirror", mirror).
+			Str("repository", cfg.URL).
+			Msg("Creating Git cache mirror")
+
+		repository, err = git.PlainInit(mirror, true)
+		if err == nil {
+			_, err = repository.CreateRemote(&config.RemoteConfig{
+				Name: git.DefaultRemoteName,
+				URLs: []string{cfg.URL},
+			})
+		}
+	}
+	if err != nil {
+		return "", plumbing.ZeroHash, err
+	}
+
+	remote, err := repository.Remote(git.DefaultRemoteName)
+	if err != nil {
+		return "", plumbing.ZeroHash, err
+	}
+
+	auth := getAuth(cfg.User, cfg.Password)
+
+	referenceName := plumbing.ReferenceName(cfg.Reference)
+	if referenceName == "" {
+		referenceName, err = remoteHead(remote, auth)
+		if err != nil {
+			return "", plumbing.ZeroHash, err
+		}
+	}
+
+	err = remote.FetchContext(ctx, &git.FetchOptions{
+		RefSpecs: []config.RefSpec{config.RefSpec(fmt.Sprintf("+%s:%s", referenceName, referenceName))},
+		Depth:    cfg.Depth,
+		Auth:     auth,
+		Tags:     git.NoTags,
+		Force:    true,
+	})
+	if err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
+		return "", plumbing.ZeroHash, err
+	}
+
+	reference, err := repository.Reference(referenceName, true)
+	if err != nil {
+		return "", plumbing.ZeroHash, err
+	}
+
+	hash := reference.Hash()
+	if tag, err := repository.TagObject(hash); err == nil {
+		commit, err := tag.Commit()
+		if err != nil {
+			return "", plumbing.ZeroHash, err
+		}
+		hash = commit.Hash
+	}
+
+	return referenceName, hash, nil
+}
+
+func (goGitBackend) Checkout(ctx context.Context, clonePath string, mirror string, referenceName plumbing.ReferenceName, hash plumbing.Hash, cfg GitCloneConfig) error {
+	repository, err := git.PlainInit(clonePath, false)
+	if err != nil {
+		return err
+	}
+
+	err = writeAlternates(clonePath, mirror)
+	if err != nil {
+		return err
+	}
+
+	_, err = repository.CreateRemote(&config.RemoteConfig{
+		Name: git.DefaultRemoteName,
+		URLs: []string{cfg.URL},
+	})
+	if err != nil {
+		return err
+	}
+
+	head := plumbing.NewHashReference(plumbing.HEAD, hash)
+	if referenceName.IsBranch() {
+		err = repository.Storer.SetReference(plumbing.NewHashReference(referenceName, hash))
+		if err != nil {
+			return err
+		}
+		head = plumbing.NewSymbolicReference(plumbing.HEAD, referenceName)
+	}
+
+	err = repository.Storer.SetReference(head)
+	if err != nil {
+		return err
+	}
+
+	if len(cfg.SparsePaths) > 0 {
+		return checkoutSparse(repository, clonePath, cfg.SparsePaths)
+	}
+
+	worktree, err := repository.Worktree()
+	if err != nil {
+		return err
+	}
+
+	return worktree.Reset(&git.ResetOptions{Commit: hash, Mode: git.HardReset})
+}
+
+func (goGitBackend) UpdateSubmodules(ctx context.Context, clonePath string, cfg GitCloneConfig) error {
+	repository, err := git.PlainOpen(clonePath)
+	if err != nil {
+		return err
+	}
+
+	return updateSubmodules(ctx, repository, cfg.URL, cfg, cfg.SparsePaths, int(git.DefaultSubmoduleRecursionDepth))
+}
+
+// remoteHead returns the branch the HEAD of the remote repository points to.
+func remoteHead(remote *git.Remote, auth transport.AuthMethod) (plumbing.ReferenceName, error) {
+	references, err := remote.List(&git.ListOptions{Auth: auth})
+	if err != nil {
+		return "", err
+	}
+
+	var head *plumbing.Reference
+	for _, reference := range references {
+		if reference.Name() == plumbing.HEAD {
+			head = reference
+		}
+	}
+
+	if head == nil {
+		return "", errReferenceNotFound
+	}
+
+	if head.Type() == plumbing.SymbolicReference {
+		return head.Target(), nil
+	}
+
+	for _, reference := range references {
+		if reference.Name().IsBranch() && reference.Hash() == head.Hash() {
+			return reference.Name(), nil
+		}
+	}
+
+	return "", errReferenceNotFound
+}
+
+// updateSubmodules initializes and checks out the submodules of repository,
+// recursing into nested submodules up to depth levels. Each submodule is
+// fetched with the credentials matching its host. Submodules outside of
+// sparsePaths, when set, are left untouched.
+func updateSubmodules(ctx context.Context, repository *git.Repository, repositoryURL string, cfg GitCloneConfig, sparsePaths []string, depth int) error {
+	if depth <= 0 {
+		return nil
+	}
+
+	worktree, err := repository.Worktree()
+	if err != nil {
+		return err
+	}
+
+	submodules, err := worktree.Submodules()
+	if err != nil {
+		return err
+	}
+
+	for _, submodule := range submodules {
+		if len(sparsePaths) > 0 && !inSparsePaths(submodule.Config().Path, sparsePaths) {
+			continue
+		}
+
+		submoduleURL := resolveSubmoduleURL(repositoryURL, submodule.Config().URL)
+
+		log.Info().
+			Str("submodule", submodule.Config().Name).
+			Str("path", submodule.Config().Path).
+			Str("url", submoduleURL).
+			Msg("Updating Git submodule")
+
+		err = submodule.UpdateContext(ctx, &git.SubmoduleUpdateOptions{
+			Init:              true,
+			RecurseSubmodules: git.NoRecurseSubmodules,
+			Auth:              submoduleAuth(submoduleURL, cfg),
+		})
+		if err != nil {
+			return fmt.Errorf("submodule %s: %w", submodule.Config().Name, err)
+		}
+
+		subRepository, err := submodule.Repository()
+		if err != nil {
+			return fmt.Errorf("submodule %s: %w", submodule.Config().Name, err)
+		}
+
+		err = updateSubmodules(ctx, subRepository, submoduleURL, cfg, nil, depth-1)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkoutSparse materializes the given paths of HEAD into the worktree of a
+// repository cloned without checkout and records them in the index. The
+// .gitmodules file is always checked out so that submodules can be updated.
+func checkoutSparse(repository *git.Repository, clonePath string, sparsePaths []string) error {
+	head, err := repository.Head()
+	if err != nil {
+		return err
+	}
+
+	commit, err := repository.CommitObject(head.Hash())
+	if err != nil {
+		return err
+	}
+
+	tree, err := commit.Tree()
+	if err != nil {
+		return err
+	}
+
+	idx := &index.Index{Version: index.EncodeVersionSupported}
+
+	walker := object.NewTreeWalker(tree, true, nil)
+	defer walker.Close()
+
+	for {
+		name, entry, err := walker.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		if entry.Mode == filemode.Dir || !inSparsePaths(name, sparsePaths) {
+			continue
+		}
+
+		target := filepath.Join(clonePath, filepath.FromSlash(name))
+		err = os.MkdirAll(filepath.Dir(target), 0755)
+		if err != nil {
+			return err
+		}
+
+		switch entry.Mode {
+		case filemode.Submodule:
+			err = os.MkdirAll(target, 0755)
+		case filemode.Symlink:
+			err = writeSymlinkBlob(repository, entry.Hash, target)
+		default:
+			err = writeFileBlob(repository, entry, target)
+		}
+		if err != nil {
+			return err
+		}
+
+		idx.Entries = append(idx.Entries, &index.Entry{
+			Name:       name,
+			Hash:       entry.Hash,
+			Mode:       entry.Mode,
+			ModifiedAt: time.Now(),
+		})
+	}
+
+	return repository.Storer.SetIndex(idx)
+}
+
+func inSparsePaths(name string, sparsePaths []string) bool {
+	if name == ".gitmodules" {
+		return true
+	}
+
+	for _, p := range sparsePaths {
+		if name == p || strings.HasPrefix(name, p+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+func writeFileBlob(repository *git.Repository, entry object.TreeEntry, target string) error {
+	blob, err := repository.BlobObject(entry.Hash)
+	if err != nil {
+		return err
+	}
+
+	reader, err := blob.Reader()
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	perm := os.FileMode(0644)
+	if entry.Mode == filemode.Executable {
+		perm = 0755
+	}
+
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(f, reader)
+	return err
+}
+
+func writeSymlinkBlob(repository *git.Repository, hash plumbing.Hash, target string) error {
+	blob, err := repository.BlobObject(hash)
+	if err != nil {
+		return err
+	}
+
+	reader, err := blob.Reader()
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	link, err := io.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+
+	return os.Symlink(string(link), target)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/go-git/go-git/v5"
+)
+
+// runTestGit runs the git binary in dir, local submodule URLs allowed.
+func runTestGit(t *testing.T, dir string, args ...string) {
+	t.Helper()
+
+	cmd := exec.Command("git", append([]string{
+		"-c", "protocol.file.allow=always",
+		"-c", "user.name=test",
+		"-c", "user.email=test@example.com",
+	}, args...)...)
+	cmd.Dir = dir
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("git %v: %v\n%s", args, err, output)
+	}
+}
+
+// newTestGitRepository creates a repository holding files in a single commit
+// on the main branch.
+func newTestGitRepository(t *testing.T, files map[string]string) string {
+	t.Helper()
+
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git binary not available")
+	}
+
+	dir := writeTestFiles(t, t.TempDir(), files)
+	runTestGit(t, dir, "init", "--initial-branch=main")
+	runTestGit(t, dir, "add", "-A")
+	runTestGit(t, dir, "commit", "-m", "Initial commit")
+
+	return dir
+}
+
+func TestGoGitSubmodules(t *testing.T) {
+	nested := newTestGitRepository(t, map[string]string{
+		"ca.pem": "nested certificate",
+	})
+
+	shared := newTestGitRepository(t, map[string]string{
+		"nginx/default.conf": "server {}",
+	})
+	runTestGit(t, shared, "submodule", "add", nested, "certs")
+	runTestGit(t, shared, "commit", "-m", "Add certs")
+
+	repository := newTestGitRepository(t, map[string]string{
+		"docker-compose.yml": "services:\n  web:\n    image: nginx\n",
+	})
+	runTestGit(t, repository, "submodule", "add", shared, "shared")
+	runTestGit(t, repository, "commit", "-m", "Add shared")
+
+	clonePath := filepath.Join(t.TempDir(), "web")
+	cfg := GitCloneConfig{
+		URL:               repository,
+		RecurseSubmodules: true,
+	}
+	if err := cloneWithBackend(context.Background(), goGitBackend{}, clonePath, cfg); err != nil {
+		t.Fatalf("cloneWithBackend() error = %v", err)
+	}
+
+	assertTestFiles(t, clonePath, map[string]string{
+		"docker-compose.yml":        "services:\n  web:\n    image: nginx\n",
+		"shared/nginx/default.conf": "server {}",
+		"shared/certs/ca.pem":       "nested certificate",
+	})
+}
+
+func TestGoGitSubmodulesSkipped(t *testing.T) {
+	shared := newTestGitRepository(t, map[string]string{
+		"nginx/default.conf": "server {}",
+	})
+
+	repository := newTestGitRepository(t, map[string]string{
+		"docker-compose.yml": "services:\n  web:\n    image: nginx\n",
+	})
+	runTestGit(t, repository, "submodule", "add", shared, "shared")
+	runTestGit(t, repository, "commit", "-m", "Add shared")
+
+	clonePath := filepath.Join(t.TempDir(), "web")
+	if err := cloneWithBackend(context.Background(), goGitBackend{}, clonePath, GitCloneConfig{URL: repository}); err != nil {
+		t.Fatalf("cloneWithBackend() error = %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(clonePath, "shared/nginx/default.conf")); !os.IsNotExist(err) {
+		t.Errorf("submodule checked out without --recurse-submodules: %v", err)
+	}
+}
+
+func TestCheckoutSparse(t *testing.T) {
+	shared := newTestGitRepository(t, map[string]string{
+		"nginx/default.conf": "server {}",
+	})
+
+	repository := newTestGitRepository(t, map[string]string{
+		"stacks/web/docker-compose.yml": "services:\n  web:\n    image: nginx\n",
+		"stacks/web/conf/app.conf":      "debug = false",
+		"stacks/webapp/notes.txt":       "not a prefix match",
+		"services/api/main.go":          "package main",
+	})
+	runTestGit(t, repository, "submodule", "add", shared, "stacks/web/shared")
+	runTestGit(t, repository, "submodule", "add", shared, "services/shared")
+	runTestGit(t, repository, "commit", "-m", "Add shared")
+
+	clonePath := filepath.Join(t.TempDir(), "web")
+	cfg := GitCloneConfig{
+		URL:               repository,
+		RecurseSubmodules: true,
+		SparsePaths:       []string{"stacks/web"},
+	}
+	if err := cloneWithBackend(context.Background(), goGitBackend{}, clonePath, cfg); err != nil {
+		t.Fatalf("cloneWithBackend() error = %v", err)
+	}
+
+	assertTestFiles(t, clonePath, map[string]string{
+		"stacks/web/docker-compose.yml":        "services:\n  web:\n    image: nginx\n",
+		"stacks/web/conf/app.conf":             "debug = false",
+		"stacks/web/shared/nginx/default.conf": "server {}",
+	})
+
+	for _, p := range []string{"stacks/webapp", "services"} {
+		if _, err := os.Stat(filepath.Join(clonePath, p)); !os.IsNotExist(err) {
+			t.Errorf("%s checked out outside of the sparse paths: %v", p, err)
+		}
+	}
+
+	// The index records the checked out entries only
+	cloned, err := git.PlainOpen(clonePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, err := cloned.Storer.Index()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, entry := range idx.Entries {
+		names = append(names, entry.Name)
+	}
+	sort.Strings(names)
+
+	want := []string{".gitmodules", "stacks/web/conf/app.conf", "stacks/web/docker-compose.yml", "stacks/web/shared"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("index entries = %v, want %v", names, want)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+)
+
+// containerEnvFile is created by Docker at the root of the container
+// filesystems.
+const containerEnvFile = "/.dockerenv"
+
+// hostDestination returns the host path of destination, a directory of the
+// unpacker container. An explicit hostPath wins, otherwise the mounts of the
+// unpacker container are inspected. It returns destination itself when it
+// is not mounted from the host or when the unpacker does not run in a
+// container.
+func hostDestination(destination, hostPath string) string {
+	destination = filepath.Clean(destination)
+	if hostPath != "" {
+		return filepath.Clean(hostPath)
+	}
+
+	if _, err := os.Stat(containerEnvFile); err != nil {
+		return destination
+	}
+
+	// The hostname of a container defaults to its short ID
+	containerID, err := os.Hostname()
+	if err != nil {
+		return destination
+	}
+
+	output, err := runCommand(getDockerBinaryPath(), []string{"--config", PORTAINER_DOCKER_CONFIG_PATH, "container", "inspect", "--format", "{{json .Mounts}}", containerID})
+	if err != nil {
+		log.Debug().
+			Err(err).
+			Str("container", containerID).
+			Msg("Failed to inspect the unpacker container, leaving the bind mounts untouched")
+		return destination
+	}
+
+	var mounts []containerMount
+	err = json.Unmarshal([]byte(strings.TrimSpace(output)), &mounts)
+	if err != nil {
+		return destination
+	}
+
+	host := mountedHostPath(destination, mounts)
+	if host != destination {
+		log.Info().
+			Str("destination", destination).
+			Str("hostDestination", host).
+			Msg("Detected the host path of the destination")
+	}
+
+	return host
+}
+
+// containerMount is a mount of the docker container inspect output.
+type containerMount struct {
+	Source      string
+	Destination string
+}
+
+// mountedHostPath returns the host path of destination through the deepest
+// of mounts holding it, destination itself when none does.
+func mountedHostPath(destination string, mounts []containerMount) string {
+	host, depth := destination, -1
+	for _, mount := range mounts {
+		if mount.Source == "" || !isWithin(mount.Destination, destination) || len(mount.Destination) <= depth {
+			continue
+		}
+
+		relativePath, err := filepath.Rel(mount.Destination, destination)
+		if err != nil {
+			continue
+		}
+
+		host, depth = filepath.Join(mount.Source, relativePath), len(mount.Destination)
+	}
+
+	return host
+}
+
+// translateBindMounts rewrites the bind mount sources of the compose files
+// which are relative or under containerRoot to their host path under
+// hostRoot, the Docker daemon resolving them on the host. Relative sources
+// are resolved against the directory of the first compose file, as compose
+// does. See rewriteComposeFiles for the returned paths.
+func translateBindMounts(clonePath string, composeRelativeFilePaths []string, containerRoot, hostRoot string) ([]string, error) {
+	if len(composeRelativeFilePaths) == 0 || filepath.Clean(containerRoot) == filepath.Clean(hostRoot) {
+		return composeRelativeFilePaths, nil
+	}
+
+	projectDir := filepath.Dir(filepath.Join(clonePath, filepath.FromSlash(composeRelativeFilePaths[0])))
+
+	translate := func(source string) (string, bool) {
+		if strings.Contains(source, "$") || !(strings.HasPrefix(source, ".") || filepath.IsAbs(source)) {
+			return "", false
+		}
+
+		if !filepath.IsAbs(source) {
+			source = filepath.Join(projectDir, source)
+		}
+
+		relativePath, err := filepath.Rel(containerRoot, source)
+		if err != nil || !isWithin(containerRoot, source) {
+			return "", false
+		}
+
+		return filepath.Join(hostRoot, relativePath), true
+	}
+
+	return rewriteComposeFiles(clonePath, composeRelativeFilePaths, func(composeFilePath string, root *yaml.Node) (bool, error) {
+		changed := false
+		forEachService(root, func(name string, service *yaml.Node) {
+			volumes := mappingValue(service, "volumes")
+			if volumes == nil || volumes.Kind != yaml.SequenceNode {
+				return
+			}
+
+			for _, volume := range volumes.Content {
+				switch volume.Kind {
+				case yaml.ScalarNode:
+					source, target, ok := strings.Cut(volume.Value, ":")
+					if !ok {
+						continue
+					}
+
+					if hostSource, ok := translate(source); ok {
+						volume.Value = hostSource + ":" + target
+						changed = true
+					}
+				case yaml.MappingNode:
+					volumeType, source := mappingValue(volume, "type"), mappingValue(volume, "source")
+					if volumeType == nil || volumeType.Value != "bind" || source == nil {
+						continue
+					}
+
+					if hostSource, ok := translate(source.Value); ok {
+						source.Value = hostSource
+						changed = true
+					}
+				}
+			}
+		})
+
+		return changed, nil
+	})
+}
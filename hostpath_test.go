@@ -0,0 +1,158 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestMountedHostPath(t *testing.T) {
+	tests := []struct {
+		name        string
+		destination string
+		mounts      []containerMount
+		want        string
+	}{
+		{
+			name:        "destination is a mount",
+			destination: "/data/compose",
+			mounts:      []containerMount{{Source: "/srv/portainer/compose", Destination: "/data/compose"}},
+			want:        "/srv/portainer/compose",
+		},
+		{
+			name:        "destination under a mount",
+			destination: "/data/compose/stacks",
+			mounts:      []containerMount{{Source: "/srv/portainer", Destination: "/data"}},
+			want:        "/srv/portainer/compose/stacks",
+		},
+		{
+			name:        "deepest mount wins",
+			destination: "/data/compose/stacks",
+			mounts: []containerMount{
+				{Source: "/srv/portainer/compose", Destination: "/data/compose"},
+				{Source: "/srv/portainer", Destination: "/data"},
+				{Source: "/", Destination: "/host"},
+			},
+			want: "/srv/portainer/compose/stacks",
+		},
+		{
+			name:        "sibling mount sharing a prefix",
+			destination: "/data/compose",
+			mounts:      []containerMount{{Source: "/srv/portainer/backup", Destination: "/data/comp"}},
+			want:        "/data/compose",
+		},
+		{
+			name:        "mount without a source",
+			destination: "/data/compose",
+			mounts:      []containerMount{{Destination: "/data"}},
+			want:        "/data/compose",
+		},
+		{
+			name:        "not mounted",
+			destination: "/data/compose",
+			want:        "/data/compose",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mountedHostPath(tt.destination, tt.mounts); got != tt.want {
+				t.Errorf("mountedHostPath() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTranslateBindMounts(t *testing.T) {
+	const hostRoot = "/srv/portainer/compose"
+
+	tests := []struct {
+		name   string
+		volume string
+		want   interface{}
+	}{
+		{name: "relative source", volume: "./conf:/etc/nginx:ro", want: hostRoot + "/web/stack/conf:/etc/nginx:ro"},
+		{name: "relative source in a parent directory", volume: "../shared:/shared", want: hostRoot + "/web/shared:/shared"},
+		{name: "relative source outside of the destination", volume: "../../../etc:/etc", want: "../../../etc:/etc"},
+		{name: "absolute source under the destination", volume: "{root}/cache:/cache", want: hostRoot + "/cache:/cache"},
+		{name: "absolute source sharing a prefix with the destination", volume: "{root}-backup:/backup", want: "{root}-backup:/backup"},
+		{name: "absolute source outside of the destination", volume: "/var/run/docker.sock:/var/run/docker.sock", want: "/var/run/docker.sock:/var/run/docker.sock"},
+		{name: "named volume", volume: "data:/data", want: "data:/data"},
+		{name: "interpolated source", volume: "${CONF_DIR}:/conf", want: "${CONF_DIR}:/conf"},
+		{name: "anonymous volume", volume: "/data", want: "/data"},
+		{
+			name:   "long syntax bind",
+			volume: "{type: bind, source: ./conf, target: /etc/nginx}",
+			want:   map[string]interface{}{"type": "bind", "source": hostRoot + "/web/stack/conf", "target": "/etc/nginx"},
+		},
+		{
+			name:   "long syntax volume",
+			volume: "{type: volume, source: ./conf, target: /etc/nginx}",
+			want:   map[string]interface{}{"type": "volume", "source": "./conf", "target": "/etc/nginx"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			containerRoot := t.TempDir()
+			clonePath := filepath.Join(containerRoot, "web")
+
+			// {root} stands for the destination directory of the unpacker
+			volume := replaceRoot(tt.volume, containerRoot)
+			want := tt.want
+			if s, ok := want.(string); ok {
+				want = replaceRoot(s, containerRoot)
+			}
+
+			writeTestFiles(t, clonePath, map[string]string{
+				"stack/docker-compose.yml": "services:\n  web:\n    image: nginx\n    volumes:\n      - " + volume + "\n",
+			})
+
+			composeFilePaths, err := translateBindMounts(clonePath, []string{"stack/docker-compose.yml"}, containerRoot, hostRoot)
+			if err != nil {
+				t.Fatalf("translateBindMounts() error = %v", err)
+			}
+
+			content, err := os.ReadFile(filepath.Join(clonePath, filepath.FromSlash(composeFilePaths[0])))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var compose struct {
+				Services map[string]struct {
+					Volumes []interface{}
+				}
+			}
+			if err := yaml.Unmarshal(content, &compose); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := compose.Services["web"].Volumes[0]; !reflect.DeepEqual(got, want) {
+				t.Errorf("volume = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestTranslateBindMountsSameRoot(t *testing.T) {
+	clonePath := writeTestFiles(t, t.TempDir(), map[string]string{
+		"docker-compose.yml": "services:\n  web:\n    image: nginx\n    volumes:\n      - ./conf:/etc/nginx\n",
+	})
+
+	composeFilePaths, err := translateBindMounts(clonePath, []string{"docker-compose.yml"}, "/data/compose/", "/data/compose")
+	if err != nil {
+		t.Fatalf("translateBindMounts() error = %v", err)
+	}
+
+	if want := []string{"docker-compose.yml"}; !reflect.DeepEqual(composeFilePaths, want) {
+		t.Errorf("translateBindMounts() = %v, want %v", composeFilePaths, want)
+	}
+}
+
+func replaceRoot(s, root string) string {
+	return strings.ReplaceAll(s, "{root}", root)
+}
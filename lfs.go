@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	lfsPointerVersion    = "version https://git-lfs.github.com/spec/v1"
+	lfsPointerMaxSize    = 1024
+	lfsMediaType         = "application/vnd.git-lfs+json"
+	lfsOperationDownload = "download"
+)
+
+var errLFSUnsupportedRemote = errors.New("Git LFS is only supported for HTTP(S) remotes")
+
+type lfsPointer struct {
+	path string
+	oid  string
+	size int64
+}
+
+type lfsObject struct {
+	Oid  string `json:"oid"`
+	Size int64  `json:"size"`
+}
+
+type lfsBatchRequest struct {
+	Operation string      `json:"operation"`
+	Transfers []string    `json:"transfers"`
+	Objects   []lfsObject `json:"objects"`
+}
+
+type lfsBatchResponse struct {
+	Objects []struct {
+		lfsObject
+		Actions map[string]struct {
+			Href   string            `json:"href"`
+			Header map[string]string `json:"header"`
+		} `json:"actions"`
+		Error *struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	} `json:"objects"`
+}
+
+// fetchLFSObjects replaces the LFS pointer files found under the given
+// directories of the clone with the objects they reference. Pointers living
+// in a submodule are resolved against the LFS server of that submodule.
+func fetchLFSObjects(ctx context.Context, clonePath string, repositoryURL string, cfg GitCloneConfig, dirs []string) error {
+	httpClient, err := newHTTPClient(cfg.Transport)
+	if err != nil {
+		return err
+	}
+
+	pointersByRepository := make(map[string][]lfsPointer)
+	for _, dir := range dirs {
+		root := filepath.Join(clonePath, filepath.FromSlash(dir))
+
+		err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+
+			if d.IsDir() {
+				if d.Name() == ".git" {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+
+			if !d.Type().IsRegular() {
+				return nil
+			}
+
+			pointer, ok, err := readLFSPointer(p)
+			if err != nil || !ok {
+				return err
+			}
+
+			repositoryPath := owningRepository(clonePath, filepath.Dir(p))
+			pointersByRepository[repositoryPath] = append(pointersByRepository[repositoryPath], pointer)
+			return nil
+		})
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+
+	for repositoryPath, pointers := range pointersByRepository {
+		remoteURL := repositoryURL
+		if repositoryPath != clonePath {
+			remoteURL, err = repositoryRemoteURL(repositoryPath)
+			if err != nil {
+				return err
+			}
+		}
+
+		log.Info().
+			Str("repository", remoteURL).
+			Int("objects", len(pointers)).
+			Msg("Fetching Git LFS objects")
+
+		err = downloadLFSObjects(ctx, httpClient, remoteURL, lfsAuthorizer(remoteURL, cfg), pointers)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// readLFSPointer reports whether the file at p is a Git LFS pointer file and
+// parses it when it is.
+func readLFSPointer(p string) (lfsPointer, bool, error) {
+	info, err := os.Stat(p)
+	if err != nil || info.Size() > lfsPointerMaxSize {
+		return lfsPointer{}, false, err
+	}
+
+	content, err := os.ReadFile(p)
+	if err != nil {
+		return lfsPointer{}, false, err
+	}
+
+	if !bytes.HasPrefix(content, []byte(lfsPointerVersion+"\n")) {
+		return lfsPointer{}, false, nil
+	}
+
+	pointer := lfsPointer{path: p}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		key, value, _ := strings.Cut(scanner.Text(), " ")
+		switch key {
+		case "oid":
+			pointer.oid = strings.TrimPrefix(value, "sha256:")
+		case "size":
+			pointer.size, _ = strconv.ParseInt(value, 10, 64)
+		}
+	}
+
+	return pointer, pointer.oid != "", nil
+}
+
+// owningRepository returns the closest directory between dir and clonePath
+// holding a .git entry, which is either the clone itself or a submodule.
+func owningRepository(clonePath, dir string) string {
+	for dir != clonePath && strings.HasPrefix(dir, clonePath) {
+		if _, err := os.Lstat(filepath.Join(dir, ".git")); err == nil {
+			return dir
+		}
+		dir = filepath.Dir(dir)
+	}
+
+	return clonePath
+}
+
+func repositoryRemoteURL(repositoryPath string) (string, error) {
+	repository, err := git.PlainOpen(repositoryPath)
+	if err != nil {
+		return "", err
+	}
+
+	remote, err := repository.Remote(git.DefaultRemoteName)
+	if err != nil {
+		return "", err
+	}
+
+	return remote.Config().URLs[0], nil
+}
+
+// lfsEndpoint derives the LFS server URL from a Git remote URL following the
+// Git LFS server discovery rules.
+func lfsEndpoint(remoteURL string) (string, error) {
+	if !strings.HasPrefix(remoteURL, "http://") && !strings.HasPrefix(remoteURL, "https://") {
+		return "", errLFSUnsupportedRemote
+	}
+
+	remoteURL = strings.TrimSuffix(remoteURL, "/")
+	if !strings.HasSuffix(remoteURL, ".git") {
+		remoteURL += ".git"
+	}
+
+	return remoteURL + "/info/lfs", nil
+}
+
+func lfsAuthorizer(remoteURL string, cfg GitCloneConfig) func(*http.Request) {
+	auth := submoduleAuth(remoteURL, cfg)
+
+	return func(req *http.Request) {
+		if auth != nil {
+			req.SetBasicAuth(auth.Username, auth.Password)
+		}
+	}
+}
+
+func downloadLFSObjects(ctx context.Context, httpClient *http.Client, remoteURL string, authorize func(*http.Request), pointers []lfsPointer) error {
+	endpoint, err := lfsEndpoint(remoteURL)
+	if err != nil {
+		return err
+	}
+
+	batch := lfsBatchRequest{
+		Operation: lfsOperationDownload,
+		Transfers: []string{"basic"},
+	}
+	for _, pointer := range pointers {
+		batch.Objects = append(batch.Objects, lfsObject{Oid: pointer.oid, Size: pointer.size})
+	}
+
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint+"/objects/batch", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", lfsMediaType)
+	req.Header.Set("Content-Type", lfsMediaType)
+	authorize(req)
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("LFS batch request to %s failed: %s", endpoint, resp.Status)
+	}
+
+	var batchResponse lfsBatchResponse
+	err = json.NewDecoder(resp.Body).Decode(&batchResponse)
+	if err != nil {
+		return err
+	}
+
+	hrefs := make(map[string]int)
+	for i, object := range batchResponse.Objects {
+		if object.Error != nil {
+			return fmt.Errorf("LFS object %s: %s", object.Oid, object.Error.Message)
+		}
+		hrefs[object.Oid] = i
+	}
+
+	for _, pointer := range pointers {
+		i, ok := hrefs[pointer.oid]
+		if !ok {
+			return fmt.Errorf("LFS object %s missing from batch response", pointer.oid)
+		}
+
+		action, ok := batchResponse.Objects[i].Actions[lfsOperationDownload]
+		if !ok {
+			return fmt.Errorf("LFS object %s has no download action", pointer.oid)
+		}
+
+		err = downloadLFSObject(ctx, httpClient, action.Href, action.Header, pointer)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// downloadLFSObject fetches a single object and overwrites its pointer file
+// once the content matches the expected oid.
+func downloadLFSObject(ctx context.Context, httpClient *http.Client, href string, header map[string]string, pointer lfsPointer) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, href, nil)
+	if err != nil {
+		return err
+	}
+	for key, value := range header {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("LFS download of %s failed: %s", pointer.oid, resp.Status)
+	}
+
+	info, err := os.Stat(pointer.path)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := pointer.path + ".lfs"
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, info.Mode())
+	if err != nil {
+		return err
+	}
+
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, hash), resp.Body)
+	f.Close()
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if hex.EncodeToString(hash.Sum(nil)) != pointer.oid {
+		os.Remove(tmpPath)
+		return fmt.Errorf("LFS object %s failed checksum verification", pointer.oid)
+	}
+
+	log.Debug().
+		Str("path", pointer.path).
+		Str("oid", pointer.oid).
+		Msg("Git LFS object downloaded")
+
+	return os.Rename(tmpPath, pointer.path)
+}
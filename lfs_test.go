@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testLFSPointer(content string) (string, string) {
+	sum := sha256.Sum256([]byte(content))
+	oid := hex.EncodeToString(sum[:])
+	return oid, fmt.Sprintf("%s\noid sha256:%s\nsize %d\n", lfsPointerVersion, oid, len(content))
+}
+
+func TestFetchLFSObjects(t *testing.T) {
+	const seed = "INSERT INTO users VALUES (1, 'admin');\n"
+	oid, pointer := testLFSPointer(seed)
+
+	tests := []struct {
+		name     string
+		served   string
+		objError string
+		want     string
+		wantErr  string
+	}{
+		{name: "valid object", served: seed, want: seed},
+		{name: "corrupted object", served: "DROP TABLE users;\n", want: pointer, wantErr: "failed checksum verification"},
+		{name: "object error", objError: "Object does not exist", want: pointer, wantErr: "Object does not exist"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var batchAuth, downloadAuth string
+
+			mux := http.NewServeMux()
+			server := httptest.NewServer(mux)
+			defer server.Close()
+
+			mux.HandleFunc("/org/stack.git/info/lfs/objects/batch", func(w http.ResponseWriter, r *http.Request) {
+				batchAuth = r.Header.Get("Authorization")
+
+				var batch lfsBatchRequest
+				if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				if batch.Operation != lfsOperationDownload || len(batch.Objects) != 1 || batch.Objects[0].Oid != oid {
+					http.Error(w, "unexpected batch request", http.StatusBadRequest)
+					return
+				}
+
+				object := map[string]interface{}{"oid": oid, "size": len(seed)}
+				if tt.objError != "" {
+					object["error"] = map[string]interface{}{"code": 404, "message": tt.objError}
+				} else {
+					object["actions"] = map[string]interface{}{
+						"download": map[string]interface{}{
+							"href":   server.URL + "/objects/" + oid,
+							"header": map[string]string{"Authorization": "Bearer download-token"},
+						},
+					}
+				}
+
+				w.Header().Set("Content-Type", lfsMediaType)
+				json.NewEncoder(w).Encode(map[string]interface{}{"objects": []interface{}{object}})
+			})
+			mux.HandleFunc("/objects/"+oid, func(w http.ResponseWriter, r *http.Request) {
+				downloadAuth = r.Header.Get("Authorization")
+				fmt.Fprint(w, tt.served)
+			})
+
+			clonePath := writeTestFiles(t, t.TempDir(), map[string]string{
+				"db/seed.sql":        pointer,
+				"docker-compose.yml": "services:\n  db:\n    image: postgres\n",
+			})
+
+			cfg := GitCloneConfig{
+				URL:      server.URL + "/org/stack.git",
+				User:     "deploy",
+				Password: "secret",
+			}
+			err := fetchLFSObjects(context.Background(), clonePath, cfg.URL, cfg, []string{"db"})
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("fetchLFSObjects() error = %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("fetchLFSObjects() error = %v, want %q", err, tt.wantErr)
+			}
+
+			assertTestFiles(t, clonePath, map[string]string{"db/seed.sql": tt.want})
+
+			if _, err := os.Stat(filepath.Join(clonePath, "db/seed.sql.lfs")); !os.IsNotExist(err) {
+				t.Errorf("temporary object file left behind: %v", err)
+			}
+
+			req, _ := http.NewRequest(http.MethodGet, cfg.URL, nil)
+			req.SetBasicAuth(cfg.User, cfg.Password)
+			if want := req.Header.Get("Authorization"); batchAuth != want {
+				t.Errorf("batch Authorization = %q, want %q", batchAuth, want)
+			}
+			if tt.served != "" && downloadAuth != "Bearer download-token" {
+				t.Errorf("download Authorization = %q, want the header of the batch response", downloadAuth)
+			}
+		})
+	}
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	composeLockFile    = "compose.lock.json"
+	composeLockVersion = 1
+)
+
+var (
+	errComposeLockNotFound = errors.New("compose lock file not found")
+	errStaleComposeLock    = errors.New("compose lock file out of date")
+)
+
+// composeLock pins the image of each service of a stack to a digest.
+type composeLock struct {
+	Version  int                    `json:"version"`
+	Services map[string]lockedImage `json:"services"`
+}
+
+type lockedImage struct {
+	// Image is the reference of the resolved compose model
+	Image  string `json:"image"`
+	Digest string `json:"digest"`
+}
+
+// Reference returns the image reference pinned to the locked digest, the tag
+// being kept for readability.
+func (l lockedImage) Reference() string {
+	image, _, _ := strings.Cut(l.Image, "@")
+	return image + "@" + l.Digest
+}
+
+// resolveComposeLock resolves the image of each service of the model to the
+// digest of its manifest. The services whose image could not be resolved are
+// returned with the error.
+func resolveComposeLock(ctx context.Context, client *registryClient, model *composeModel) (*composeLock, map[string]error) {
+	lock := &composeLock{
+		Version:  composeLockVersion,
+		Services: make(map[string]lockedImage),
+	}
+	failures := make(map[string]error)
+
+	// Services sharing an image are resolved once
+	digests := make(map[string]string)
+	for name, service := range model.Services {
+		if service.Image == "" {
+			continue
+		}
+
+		digest, ok := digests[service.Image]
+		if !ok {
+			ref, err := parseImageReference(service.Image)
+			if err == nil {
+				digest = ref.Digest
+				if digest == "" {
+					digest, err = client.HeadManifest(ctx, ref)
+				}
+			}
+
+			if err != nil {
+				failures[name] = err
+				continue
+			}
+
+			digests[service.Image] = digest
+		}
+
+		lock.Services[name] = lockedImage{Image: service.Image, Digest: digest}
+	}
+
+	return lock, failures
+}
+
+// readComposeLock reads the first lock file found in dirs and returns it
+// with its path.
+func readComposeLock(dirs ...string) (*composeLock, string, error) {
+	for _, dir := range dirs {
+		lockPath := filepath.Join(dir, composeLockFile)
+
+		content, err := os.ReadFile(lockPath)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, "", err
+		}
+
+		var lock composeLock
+		err = json.Unmarshal(content, &lock)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid lock file %s: %w", lockPath, err)
+		}
+
+		if lock.Version != composeLockVersion {
+			return nil, "", fmt.Errorf("unsupported version %d of lock file %s", lock.Version, lockPath)
+		}
+
+		return &lock, lockPath, nil
+	}
+
+	return nil, "", errComposeLockNotFound
+}
+
+func writeComposeLock(lockPath string, lock *composeLock) error {
+	content, err := json.MarshalIndent(lock, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(lockPath, append(content, '\n'), 0644)
+}
+
+// pinComposeImages rewrites the image of the services of the compose files
+// to the digests of the lock. It fails when the lock does not match the
+// resolved model, e.g. after an image change in the repository. See
+// rewriteComposeFiles for the returned paths.
+func pinComposeImages(clonePath string, composeRelativeFilePaths []string, model *composeModel, lock *composeLock) ([]string, error) {
+	stale := []string{}
+	for name, service := range model.Services {
+		if service.Image == "" {
+			continue
+		}
+
+		locked, ok := lock.Services[name]
+		if !ok || locked.Image != service.Image {
+			stale = append(stale, name)
+		}
+	}
+
+	if len(stale) > 0 {
+		sort.Strings(stale)
+		return nil, fmt.Errorf("%w for services %s", errStaleComposeLock, strings.Join(stale, ", "))
+	}
+
+	pinned := make(map[string]struct{})
+	paths, err := rewriteComposeFiles(clonePath, composeRelativeFilePaths, func(composeFilePath string, root *yaml.Node) (bool, error) {
+		changed := false
+		forEachService(root, func(name string, service *yaml.Node) {
+			locked, ok := lock.Services[name]
+			if !ok || mappingValue(service, "image") == nil {
+				return
+			}
+
+			setMappingValue(service, "image", stringNode(locked.Reference()))
+			pinned[name] = struct{}{}
+			changed = true
+		})
+
+		return changed, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The image of a service may come from outside of the compose files,
+	// e.g. through extends
+	unpinned := []string{}
+	for name, service := range model.Services {
+		if _, ok := pinned[name]; service.Image != "" && !ok {
+			unpinned = append(unpinned, name)
+		}
+	}
+
+	if len(unpinned) > 0 {
+		sort.Strings(unpinned)
+		return nil, fmt.Errorf("no image to pin in the compose files for services %s", strings.Join(unpinned, ", "))
+	}
+
+	return paths, nil
+}
+
+// readPreviousComposeLock returns the lock file of the previous deployment
+// of the stack, read before the stack directory is removed, or nil.
+func readPreviousComposeLock(mountPath string) *composeLock {
+	lock, _, err := readComposeLock(mountPath)
+	if err != nil {
+		if !errors.Is(err, errComposeLockNotFound) {
+			log.Warn().
+				Err(err).
+				Msg("Failed to read the lock file of the previous deployment")
+		}
+		return nil
+	}
+
+	return lock
+}
+
+// lockStackImages pins the images of the stack to the lock file of the
+// working directory, or to previousLock, in locked mode. It otherwise pins
+// them to their current digests, resolved with client. When an image cannot
+// be resolved, the deployment fails in strict mode and the images are
+// otherwise deployed by tag, previousLock being kept. The lock in use is
+// written to the stack directory. See rewriteComposeFiles for the returned
+// paths.
+func lockStackImages(ctx context.Context, locked, strict bool, client *registryClient, previousLock *composeLock, clonePath, workingDir, mountPath string, composeRelativeFilePaths, env []string) ([]string, error) {
+	composeFilePaths := make([]string, len(composeRelativeFilePaths))
+	for i := 0; i < len(composeRelativeFilePaths); i++ {
+		composeFilePaths[i] = path.Join(clonePath, composeRelativeFilePaths[i])
+	}
+
+	model, err := loadComposeModel(ctx, workingDir, composeFilePaths, env)
+	if err != nil {
+		return nil, err
+	}
+
+	return lockModelImages(ctx, locked, strict, client, previousLock, model, clonePath, workingDir, mountPath, composeRelativeFilePaths)
+}
+
+// lockModelImages pins the images of the resolved compose model, see
+// lockStackImages.
+func lockModelImages(ctx context.Context, locked, strict bool, client *registryClient, previousLock *composeLock, model *composeModel, clonePath, workingDir, mountPath string, composeRelativeFilePaths []string) ([]string, error) {
+	var lock *composeLock
+	var err error
+	if locked {
+		var lockPath string
+		lock, lockPath, err = readComposeLock(workingDir)
+		if errors.Is(err, errComposeLockNotFound) && previousLock != nil {
+			lock, lockPath, err = previousLock, filepath.Join(mountPath, composeLockFile), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		log.Info().
+			Str("path", lockPath).
+			Msg("Deploying the image digests of the lock file")
+	} else {
+		var failures map[string]error
+		lock, failures = resolveComposeLock(ctx, client, model)
+
+		err = resolveFailure(failures)
+		if err != nil && strict {
+			return nil, err
+		}
+		if err != nil {
+			log.Warn().
+				Err(err).
+				Msg("Deploying the images by tag, the registry digests could not be resolved")
+
+			keepComposeLock(mountPath, previousLock)
+			return composeRelativeFilePaths, nil
+		}
+	}
+
+	composeRelativeFilePaths, err = pinComposeImages(clonePath, composeRelativeFilePaths, model, lock)
+	if err != nil {
+		return nil, err
+	}
+
+	err = writeComposeLock(filepath.Join(mountPath, composeLockFile), lock)
+	if err != nil {
+		return nil, err
+	}
+
+	return composeRelativeFilePaths, nil
+}
+
+// keepComposeLock writes back the lock file of the previous deployment,
+// removed with the stack directory, for a later deployment in locked mode.
+func keepComposeLock(mountPath string, previousLock *composeLock) {
+	if previousLock == nil {
+		return
+	}
+
+	err := writeComposeLock(filepath.Join(mountPath, composeLockFile), previousLock)
+	if err != nil {
+		log.Warn().
+			Err(err).
+			Msg("Failed to keep the lock file of the previous deployment")
+	}
+}
+
+// resolveFailure logs the services whose image could not be resolved and
+// returns an error listing them, or nil.
+func resolveFailure(failures map[string]error) error {
+	if len(failures) == 0 {
+		return nil
+	}
+
+	services := make([]string, 0, len(failures))
+	for service, err := range failures {
+		log.Error().
+			Err(err).
+			Str("service", service).
+			Msg("Failed to resolve image digest")
+
+		services = append(services, service)
+	}
+	sort.Strings(services)
+
+	return fmt.Errorf("failed to resolve the images of services %s", strings.Join(services, ", "))
+}
+
+// Run resolves the images of the stack to their current digests and writes
+// the lock file.
+func (cmd *UpdateLockCommand) Run(cmdCtx *CommandExecutionContext) error {
+	composeRelativeFilePaths, err := resolveComposeFiles(cmd.Directory, cmd.Workdir, cmd.ComposeRelativeFilePaths)
+	if err != nil {
+		return err
+	}
+
+	composeFilePaths := make([]string, len(composeRelativeFilePaths))
+	for i := 0; i < len(composeRelativeFilePaths); i++ {
+		composeFilePaths[i] = path.Join(cmd.Directory, composeRelativeFilePaths[i])
+	}
+
+	workingDir := path.Join(cmd.Directory, cmd.Workdir)
+	model, err := loadComposeModel(cmdCtx.context, workingDir, composeFilePaths, cmd.Env)
+	if err != nil {
+		log.Error().
+			Err(err).
+			Msg("Failed to resolve the stack images")
+		return err
+	}
+
+	client, err := newRegistryClient(cmd.transportOptions(), cmd.Registry)
+	if err != nil {
+		return err
+	}
+
+	lock, failures := resolveComposeLock(cmdCtx.context, client, model)
+	err = resolveFailure(failures)
+	if err != nil {
+		return err
+	}
+
+	lockPath := cmd.Output
+	if lockPath == "" {
+		lockPath = filepath.Join(workingDir, composeLockFile)
+	}
+
+	err = writeComposeLock(lockPath, lock)
+	if err != nil {
+		return err
+	}
+
+	log.Info().
+		Str("path", lockPath).
+		Int("services", len(lock.Services)).
+		Msg("Lock file updated")
+
+	return nil
+}
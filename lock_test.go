@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveComposeLock(t *testing.T) {
+	registry := newTestRegistry(t, "", "")
+	digest := registry.PutManifest("web", "1.0", mediaTypeOCIManifest, []byte(`{"schemaVersion":2}`))
+
+	client, err := newRegistryClient(TransportOptions{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pinned := registry.Ref("web") + "@sha256:0000000000000000000000000000000000000000000000000000000000000000"
+	model := &composeModel{Services: map[string]composeService{
+		"web":    {Image: registry.Ref("web") + ":1.0"},
+		"pinned": {Image: pinned},
+		"build":  {},
+		"gone":   {Image: registry.Ref("gone") + ":1.0"},
+	}}
+
+	lock, failures := resolveComposeLock(context.Background(), client, model)
+
+	if got := lock.Services["web"]; got.Digest != digest || got.Reference() != registry.Ref("web")+":1.0@"+digest {
+		t.Errorf("web = %+v, want digest %s", got, digest)
+	}
+	if got := lock.Services["pinned"]; got.Reference() != pinned {
+		t.Errorf("pinned = %s, want %s", got.Reference(), pinned)
+	}
+	if _, ok := lock.Services["build"]; ok {
+		t.Error("service without image locked")
+	}
+	if _, ok := failures["gone"]; !ok || len(failures) != 1 {
+		t.Errorf("failures = %v, want gone", failures)
+	}
+	if err := resolveFailure(failures); err == nil {
+		t.Error("resolveFailure() = nil, want an error")
+	}
+}
+
+func TestPinComposeImages(t *testing.T) {
+	const digest = "sha256:1111111111111111111111111111111111111111111111111111111111111111"
+
+	lock := &composeLock{Version: composeLockVersion, Services: map[string]lockedImage{
+		"web": {Image: "nginx:1.25", Digest: digest},
+	}}
+
+	tests := []struct {
+		name    string
+		compose string
+		model   map[string]composeService
+		want    string
+		wantErr error
+	}{
+		{
+			name:    "pinned",
+			compose: "services:\n  web:\n    image: nginx:1.25\n",
+			model:   map[string]composeService{"web": {Image: "nginx:1.25"}},
+			want:    "services:\n  web:\n    image: nginx:1.25@" + digest + "\n",
+		},
+		{
+			name:    "already pinned by a previous step",
+			compose: "services:\n  web:\n    image: nginx:1.25@" + digest + "\n",
+			model:   map[string]composeService{"web": {Image: "nginx:1.25"}},
+			want:    "services:\n  web:\n    image: nginx:1.25@" + digest + "\n",
+		},
+		{
+			name:    "image changed in the repository",
+			compose: "services:\n  web:\n    image: nginx:1.26\n",
+			model:   map[string]composeService{"web": {Image: "nginx:1.26"}},
+			wantErr: errStaleComposeLock,
+		},
+		{
+			name:    "service missing from the lock",
+			compose: "services:\n  web:\n    image: nginx:1.25\n  db:\n    image: postgres\n",
+			model:   map[string]composeService{"web": {Image: "nginx:1.25"}, "db": {Image: "postgres"}},
+			wantErr: errStaleComposeLock,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clonePath := writeTestFiles(t, t.TempDir(), map[string]string{"docker-compose.yml": tt.compose})
+
+			paths, err := pinComposeImages(clonePath, []string{"docker-compose.yml"}, &composeModel{Services: tt.model}, lock)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("pinComposeImages() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			assertTestFiles(t, clonePath, map[string]string{paths[0]: tt.want})
+		})
+	}
+}
+
+func TestReadPreviousComposeLock(t *testing.T) {
+	mountPath := t.TempDir()
+	if lock := readPreviousComposeLock(mountPath); lock != nil {
+		t.Fatalf("readPreviousComposeLock() = %+v, want nil", lock)
+	}
+
+	lock := &composeLock{Version: composeLockVersion, Services: map[string]lockedImage{
+		"web": {Image: "nginx", Digest: "sha256:1111111111111111111111111111111111111111111111111111111111111111"},
+	}}
+	if err := writeComposeLock(filepath.Join(mountPath, composeLockFile), lock); err != nil {
+		t.Fatal(err)
+	}
+
+	previous := readPreviousComposeLock(mountPath)
+	if previous == nil || previous.Services["web"] != lock.Services["web"] {
+		t.Fatalf("readPreviousComposeLock() = %+v, want %+v", previous, lock)
+	}
+
+	// The lock of the previous deployment is kept when the stack directory
+	// is recreated
+	recreated := t.TempDir()
+	keepComposeLock(recreated, previous)
+	if kept := readPreviousComposeLock(recreated); kept == nil || kept.Services["web"] != lock.Services["web"] {
+		t.Errorf("kept lock = %+v, want %+v", kept, lock)
+	}
+}
+
+func TestLockModelImages(t *testing.T) {
+	registry := newTestRegistry(t, "", "")
+	digest := registry.PutManifest("web", "1.0", mediaTypeOCIManifest, []byte(`{"schemaVersion":2}`))
+
+	client, err := newRegistryClient(TransportOptions{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	previousLock := &composeLock{Version: composeLockVersion, Services: map[string]lockedImage{
+		"web": {Image: registry.Ref("web") + ":1.0", Digest: "sha256:1111111111111111111111111111111111111111111111111111111111111111"},
+	}}
+
+	tests := []struct {
+		name       string
+		image      string
+		strict     bool
+		wantPinned bool
+		wantLock   string
+		wantErr    bool
+	}{
+		{name: "resolved", image: registry.Ref("web") + ":1.0", wantPinned: true, wantLock: digest},
+		{name: "registry unreachable", image: registry.Ref("gone") + ":1.0", wantLock: previousLock.Services["web"].Digest},
+		{name: "registry unreachable in strict mode", image: registry.Ref("gone") + ":1.0", strict: true, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			compose := "services:\n  web:\n    image: " + tt.image + "\n"
+			clonePath := writeTestFiles(t, t.TempDir(), map[string]string{"docker-compose.yml": compose})
+			mountPath := t.TempDir()
+			model := &composeModel{Services: map[string]composeService{"web": {Image: tt.image}}}
+
+			paths, err := lockModelImages(context.Background(), false, tt.strict, client, previousLock, model, clonePath, clonePath, mountPath, []string{"docker-compose.yml"})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("lockModelImages() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			want := compose
+			if tt.wantPinned {
+				want = "services:\n  web:\n    image: " + tt.image + "@" + digest + "\n"
+			}
+			assertTestFiles(t, clonePath, map[string]string{paths[0]: want})
+
+			lock := readPreviousComposeLock(mountPath)
+			if lock == nil || lock.Services["web"].Digest != tt.wantLock {
+				t.Errorf("written lock = %+v, want digest %s", lock, tt.wantLock)
+			}
+		})
+	}
+}
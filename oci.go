@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	ociSourcePrefix = "oci://"
+
+	artifactTypeStack     = "application/vnd.portainer.compose-unpacker.stack.v1"
+	mediaTypeStackConfig  = "application/vnd.portainer.compose-unpacker.stack.config.v1+json"
+	mediaTypeStackLayer   = "application/vnd.oci.image.layer.v1.tar+gzip"
+	annotationTitle       = "org.opencontainers.image.title"
+	annotationCreated     = "org.opencontainers.image.created"
+	annotationORASUnpack  = "io.deis.oras.content.unpack"
+	ociImageSchemaVersion = 2
+)
+
+var errDigestMismatch = errors.New("blob digest mismatch")
+
+type ociDescriptor struct {
+	MediaType    string            `json:"mediaType"`
+	Digest       string            `json:"digest"`
+	Size         int64             `json:"size"`
+	ArtifactType string            `json:"artifactType,omitempty"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+}
+
+type ociManifest struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType"`
+	ArtifactType  string            `json:"artifactType,omitempty"`
+	Config        ociDescriptor     `json:"config"`
+	Layers        []ociDescriptor   `json:"layers"`
+	Subject       *ociDescriptor    `json:"subject,omitempty"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+// ociSource pulls a stack bundle stored as an OCI artifact. Gzipped tar
+// layers are extracted into the stack directory and the other layers are
+// written under their title annotation, like ORAS does.
+type ociSource struct {
+	ref        imageReference
+	registries []string
+	transport  TransportOptions
+}
+
+func newOCISource(location string, registries []string, transport TransportOptions) (*ociSource, error) {
+	ref, err := parseImageReference(strings.TrimPrefix(location, ociSourcePrefix))
+	if err != nil {
+		return nil, err
+	}
+
+	return &ociSource{ref: ref, registries: registries, transport: transport}, nil
+}
+
+func (s *ociSource) Name() string {
+	return path.Base(s.ref.Repository)
+}
+
+func (s *ociSource) Fetch(ctx context.Context, clonePath string) error {
+	client, err := newRegistryClient(s.transport, s.registries)
+	if err != nil {
+		return err
+	}
+
+	log.Info().
+		Str("reference", s.ref.String()).
+		Str("path", clonePath).
+		Msg("Pulling stack artifact")
+
+	body, _, digest, err := client.GetManifest(ctx, s.ref, mediaTypeOCIManifest)
+	if err != nil {
+		return err
+	}
+
+	if s.ref.Digest != "" && s.ref.Digest != digest {
+		return fmt.Errorf("%w: manifest %s, expected %s", errDigestMismatch, digest, s.ref.Digest)
+	}
+
+	var manifest ociManifest
+	err = json.Unmarshal(body, &manifest)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(clonePath, 0755)
+	if err != nil {
+		return err
+	}
+
+	for _, layer := range manifest.Layers {
+		err = s.fetchLayer(ctx, client, layer, clonePath)
+		if err != nil {
+			return err
+		}
+	}
+
+	log.Info().
+		Str("digest", digest).
+		Int("layers", len(manifest.Layers)).
+		Msg("Stack artifact pulled")
+
+	return nil
+}
+
+func (s *ociSource) fetchLayer(ctx context.Context, client *registryClient, layer ociDescriptor, clonePath string) error {
+	blob, err := client.GetBlob(ctx, s.ref, layer.Digest)
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+
+	f, err := os.CreateTemp("", "unpacker-layer-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, hash), blob)
+	if err != nil {
+		return err
+	}
+
+	if actual := "sha256:" + hex.EncodeToString(hash.Sum(nil)); actual != layer.Digest {
+		return fmt.Errorf("%w: layer %s, got %s", errDigestMismatch, layer.Digest, actual)
+	}
+
+	if strings.HasSuffix(layer.MediaType, "tar+gzip") || layer.Annotations[annotationORASUnpack] == "true" {
+		return extractTarGz(f.Name(), clonePath, 0, maxArchiveSize)
+	}
+
+	title := layer.Annotations[annotationTitle]
+	if title == "" {
+		log.Warn().
+			Str("digest", layer.Digest).
+			Str("mediaType", layer.MediaType).
+			Msg("Skipping artifact layer without title")
+		return nil
+	}
+
+	target, err := archiveEntryPath(clonePath, title, 0)
+	if err != nil || target == "" {
+		return err
+	}
+
+	err = ensureNoSymlinkParent(clonePath, target)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	return writeArchiveFile(target, f, 0644, nil)
+}
+
+func (cmd *PushCommand) Run(cmdCtx *CommandExecutionContext) error {
+	log.Info().
+		Str("directory", cmd.Directory).
+		Str("reference", cmd.Reference).
+		Msg("Pushing stack directory as an OCI artifact")
+
+	ref, err := parseImageReference(strings.TrimPrefix(cmd.Reference, ociSourcePrefix))
+	if err != nil {
+		return err
+	}
+
+	if ref.Digest != "" {
+		return fmt.Errorf("%w: push requires a tag, not a digest", errInvalidImageReference)
+	}
+
+	client, err := newRegistryClient(cmd.transportOptions(), cmd.Registry)
+	if err != nil {
+		return err
+	}
+
+	layer, err := createTarGz(cmd.Directory)
+	if err != nil {
+		log.Error().
+			Err(err).
+			Msg("Failed to package stack directory")
+		return err
+	}
+
+	layerDigest, err := client.PutBlob(cmdCtx.context, ref, layer)
+	if err != nil {
+		return err
+	}
+
+	config := []byte("{}")
+	configDigest, err := client.PutBlob(cmdCtx.context, ref, config)
+	if err != nil {
+		return err
+	}
+
+	manifest, err := json.Marshal(ociManifest{
+		SchemaVersion: ociImageSchemaVersion,
+		MediaType:     mediaTypeOCIManifest,
+		ArtifactType:  artifactTypeStack,
+		Config: ociDescriptor{
+			MediaType: mediaTypeStackConfig,
+			Digest:    configDigest,
+			Size:      int64(len(config)),
+		},
+		Layers: []ociDescriptor{{
+			MediaType: mediaTypeStackLayer,
+			Digest:    layerDigest,
+			Size:      int64(len(layer)),
+			Annotations: map[string]string{
+				annotationTitle: filepath.Base(filepath.Clean(cmd.Directory)) + ".tar.gz",
+			},
+		}},
+		Annotations: map[string]string{
+			annotationCreated: time.Now().UTC().Format(time.RFC3339),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	digest, err := client.PutManifest(cmdCtx.context, ref, mediaTypeOCIManifest, manifest)
+	if err != nil {
+		log.Error().
+			Err(err).
+			Msg("Failed to push stack artifact")
+		return err
+	}
+
+	log.Info().
+		Str("reference", ref.String()).
+		Str("digest", digest).
+		Msg("Stack artifact pushed")
+
+	fmt.Println(ref.Name() + "@" + digest)
+	return nil
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPushAndPullStackArtifact(t *testing.T) {
+	tests := []struct {
+		name         string
+		username     string
+		registries   []string
+		pullRegistry []string
+		wantPushErr  error
+		wantPullErr  error
+	}{
+		{name: "anonymous registry"},
+		{
+			name:         "authenticated registry",
+			username:     "user",
+			registries:   []string{"user:secret:REGISTRY"},
+			pullRegistry: []string{"user:secret:REGISTRY"},
+		},
+		{
+			name:        "missing credentials",
+			username:    "user",
+			wantPushErr: errRegistryUnauthorized,
+		},
+		{
+			name:        "pull without credentials",
+			username:    "user",
+			registries:  []string{"user:secret:REGISTRY"},
+			wantPullErr: errRegistryUnauthorized,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registry := newTestRegistry(t, tt.username, "secret")
+
+			directory := filepath.Join(t.TempDir(), "stack")
+			writeTestFiles(t, directory, map[string]string{
+				"docker-compose.yml": "services:\n  web:\n    image: nginx\n",
+				"conf/nginx.conf":    "events {}\n",
+			})
+
+			ref := "oci://" + registry.Ref("stacks/web") + ":1.0"
+			push := &PushCommand{Directory: directory, Reference: ref, Registry: withRegistryHost(tt.registries, registry.Host)}
+			err := push.Run(&CommandExecutionContext{context: context.Background()})
+			if !errors.Is(err, tt.wantPushErr) {
+				t.Fatalf("push error = %v, want %v", err, tt.wantPushErr)
+			}
+			if err != nil {
+				return
+			}
+
+			source, err := newOCISource(ref, withRegistryHost(tt.pullRegistry, registry.Host), TransportOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			clonePath := filepath.Join(t.TempDir(), source.Name())
+			err = source.Fetch(context.Background(), clonePath)
+			if !errors.Is(err, tt.wantPullErr) {
+				t.Fatalf("pull error = %v, want %v", err, tt.wantPullErr)
+			}
+			if err != nil {
+				return
+			}
+
+			assertTestFiles(t, clonePath, map[string]string{
+				"docker-compose.yml": "services:\n  web:\n    image: nginx\n",
+				"conf/nginx.conf":    "events {}\n",
+			})
+		})
+	}
+}
+
+func TestPullStackArtifact(t *testing.T) {
+	registry := newTestRegistry(t, "", "")
+
+	layer, err := createTarGz(writeTestFiles(t, filepath.Join(t.TempDir(), "stack"), map[string]string{
+		"docker-compose.yml": "services: {}\n",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	layerDigest := registry.PutBlob(layer)
+	fileDigest := registry.PutBlob([]byte("KEY=value\n"))
+
+	manifest := func(layers ...ociDescriptor) []byte {
+		content, err := json.Marshal(ociManifest{
+			SchemaVersion: ociImageSchemaVersion,
+			MediaType:     mediaTypeOCIManifest,
+			ArtifactType:  artifactTypeStack,
+			Config:        ociDescriptor{MediaType: mediaTypeStackConfig, Digest: registry.PutBlob([]byte("{}")), Size: 2},
+			Layers:        layers,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return content
+	}
+
+	stackLayer := ociDescriptor{MediaType: mediaTypeStackLayer, Digest: layerDigest, Size: int64(len(layer))}
+	fileLayer := func(title string) ociDescriptor {
+		return ociDescriptor{MediaType: "text/plain", Digest: fileDigest, Size: 10, Annotations: map[string]string{annotationTitle: title}}
+	}
+
+	registry.mu.Lock()
+	registry.blobs["sha256:0000000000000000000000000000000000000000000000000000000000000000"] = []byte("tampered")
+	registry.mu.Unlock()
+
+	tests := []struct {
+		name     string
+		manifest []byte
+		digest   string
+		files    map[string]string
+		wantErr  error
+	}{
+		{
+			name:     "stack layer and ORAS file layer",
+			manifest: manifest(stackLayer, fileLayer("stack.env")),
+			files: map[string]string{
+				"docker-compose.yml": "services: {}\n",
+				"stack.env":          "KEY=value\n",
+			},
+		},
+		{
+			name:     "pinned digest",
+			manifest: manifest(stackLayer),
+			digest:   "PINNED",
+			files:    map[string]string{"docker-compose.yml": "services: {}\n"},
+		},
+		{
+			name:     "digest mismatch",
+			manifest: manifest(stackLayer),
+			digest:   "sha256:1111111111111111111111111111111111111111111111111111111111111111",
+			wantErr:  errDigestMismatch,
+		},
+		{
+			name: "tampered layer",
+			manifest: manifest(ociDescriptor{
+				MediaType: mediaTypeStackLayer,
+				Digest:    "sha256:0000000000000000000000000000000000000000000000000000000000000000",
+			}),
+			wantErr: errDigestMismatch,
+		},
+		{
+			name:     "file layer escaping the stack",
+			manifest: manifest(fileLayer("../stack.env")),
+			wantErr:  errUnsafeArchive,
+		},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tag := "v" + string(rune('a'+i))
+			digest := registry.PutManifest("stacks/web", tag, mediaTypeOCIManifest, tt.manifest)
+
+			ref := "oci://" + registry.Ref("stacks/web") + ":" + tag
+			switch tt.digest {
+			case "":
+			case "PINNED":
+				ref += "@" + digest
+			default:
+				// The registry answers with another manifest than the
+				// requested digest
+				registry.mu.Lock()
+				registry.manifests["stacks/web@"+tt.digest] = testManifest{mediaType: mediaTypeOCIManifest, content: tt.manifest}
+				registry.mu.Unlock()
+				ref += "@" + tt.digest
+			}
+
+			source, err := newOCISource(ref, nil, TransportOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			clonePath := filepath.Join(t.TempDir(), "web")
+			err = source.Fetch(context.Background(), clonePath)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Fetch() error = %v, want %v", err, tt.wantErr)
+			}
+
+			assertTestFiles(t, clonePath, tt.files)
+		})
+	}
+}
+
+// withRegistryHost replaces the REGISTRY placeholder of the user:password:
+// registry entries with host.
+func withRegistryHost(registries []string, host string) []string {
+	replaced := make([]string, len(registries))
+	for i, registry := range registries {
+		replaced[i] = registry[:len(registry)-len("REGISTRY")] + host
+	}
+
+	return replaced
+}
+
+// writeTestFiles writes the files, keyed by slash separated path, under dir
+// and returns dir.
+func writeTestFiles(t *testing.T, dir string, files map[string]string) string {
+	t.Helper()
+
+	for name, content := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return dir
+}
+
+func assertTestFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+
+	for name, want := range files {
+		content, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if string(content) != want {
+			t.Errorf("%s = %q, want %q", name, content, want)
+		}
+	}
+}
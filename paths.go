@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	// projectNamePattern is the project name format enforced by docker
+	// compose
+	projectNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+	errInvalidProjectName    = errors.New("invalid project name")
+	errPathOutsideRepository = errors.New("path outside of the repository")
+)
+
+// validateProjectName checks the name of a compose project to create against
+// the compose rules, the name being used as a directory of the destination.
+func validateProjectName(name string) error {
+	if !projectNamePattern.MatchString(name) {
+		return fmt.Errorf("%w %q: only lowercase letters, digits, dashes and underscores are allowed, starting with a letter or a digit", errInvalidProjectName, name)
+	}
+
+	return validateStackName(name)
+}
+
+// validateStackName checks that the name of a stack is a single directory of
+// the destination. It is used for the swarm stacks, docker stack accepting
+// uppercase letters and dots, and for the commands acting on existing stacks
+// whose name may predate the compose rules.
+func validateStackName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("%w %q: must be a single path element", errInvalidProjectName, name)
+	}
+
+	return nil
+}
+
+// checkRelativePath checks that the slash separated path p stays inside the
+// directory it is relative to, without resolving symbolic links.
+func checkRelativePath(p string) error {
+	cleaned := path.Clean(filepath.ToSlash(p))
+	if path.IsAbs(cleaned) || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return fmt.Errorf("%w: %q", errPathOutsideRepository, p)
+	}
+
+	return nil
+}
+
+// checkStackPaths checks the paths given on the command line, relative to
+// the repository, before anything is fetched.
+func checkStackPaths(workdir string, composeRelativeFilePaths, extraPaths []string) error {
+	err := checkRelativePath(workdir)
+	if err != nil {
+		return err
+	}
+
+	for _, composeRelativeFilePath := range composeRelativeFilePaths {
+		err = checkRelativePath(path.Join(workdir, composeRelativeFilePath))
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, extraPath := range extraPaths {
+		err = checkRelativePath(extraPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkPathInside checks that the path relative to root stays inside root
+// once the symbolic links are resolved. Missing path elements are allowed.
+func checkPathInside(root, relativePath string) error {
+	err := checkRelativePath(relativePath)
+	if err != nil {
+		return err
+	}
+
+	resolvedRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return err
+	}
+
+	resolved, err := evalExistingSymlinks(filepath.Join(root, filepath.FromSlash(relativePath)))
+	if err != nil {
+		return err
+	}
+
+	if !isWithin(resolvedRoot, resolved) {
+		return fmt.Errorf("%w: %q resolves to %s", errPathOutsideRepository, relativePath, resolved)
+	}
+
+	return nil
+}
+
+// evalExistingSymlinks resolves the symbolic links of the longest existing
+// prefix of p and appends the rest.
+func evalExistingSymlinks(p string) (string, error) {
+	resolved, err := filepath.EvalSymlinks(p)
+	if err == nil {
+		return resolved, nil
+	}
+
+	parent := filepath.Dir(p)
+	if !errors.Is(err, os.ErrNotExist) || parent == p {
+		return "", err
+	}
+
+	resolvedParent, err := evalExistingSymlinks(parent)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(resolvedParent, filepath.Base(p)), nil
+}
+
+// checkEnvFilePaths checks that the env_file entries of the compose files
+// stay inside the clone, docker compose reading them in the unpacker
+// container. Interpolated paths cannot be resolved and are skipped.
+func checkEnvFilePaths(clonePath string, composeRelativeFilePaths []string) error {
+	return readComposeFiles(clonePath, composeRelativeFilePaths, func(composeFilePath string, root *yaml.Node) error {
+		var err error
+		forEachService(root, func(name string, service *yaml.Node) {
+			for _, envFile := range envFilePaths(mappingValue(service, "env_file")) {
+				if err != nil || strings.Contains(envFile, "$") {
+					continue
+				}
+
+				if filepath.IsAbs(envFile) {
+					err = fmt.Errorf("%w: env_file %q of service %s is absolute", errPathOutsideRepository, envFile, name)
+					continue
+				}
+
+				relativePath, relErr := filepath.Rel(clonePath, filepath.Join(filepath.Dir(composeFilePath), filepath.FromSlash(envFile)))
+				if relErr != nil {
+					err = relErr
+					continue
+				}
+
+				if checkErr := checkPathInside(clonePath, filepath.ToSlash(relativePath)); checkErr != nil {
+					err = fmt.Errorf("env_file of service %s: %w", name, checkErr)
+				}
+			}
+		})
+
+		return err
+	})
+}
+
+// envFilePaths returns the paths of an env_file node, a path, a list of
+// paths or a list of mappings with a path.
+func envFilePaths(envFile *yaml.Node) []string {
+	if envFile == nil {
+		return nil
+	}
+
+	entries := []*yaml.Node{envFile}
+	if envFile.Kind == yaml.SequenceNode {
+		entries = envFile.Content
+	}
+
+	paths := []string{}
+	for _, entry := range entries {
+		if entry.Kind == yaml.MappingNode {
+			entry = mappingValue(entry, "path")
+		}
+
+		if entry != nil && entry.Kind == yaml.ScalarNode {
+			paths = append(paths, entry.Value)
+		}
+	}
+
+	return paths
+}
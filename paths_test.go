@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestValidateStackNames(t *testing.T) {
+	tests := []struct {
+		name           string
+		wantProjectErr bool
+		wantStackErr   bool
+	}{
+		{name: "web"},
+		{name: "web_2-prod"},
+		{name: "Web", wantProjectErr: true},
+		{name: "web.prod", wantProjectErr: true},
+		{name: "_web", wantProjectErr: true},
+		{name: "", wantProjectErr: true, wantStackErr: true},
+		{name: "..", wantProjectErr: true, wantStackErr: true},
+		{name: "a/b", wantProjectErr: true, wantStackErr: true},
+		{name: `a\b`, wantProjectErr: true, wantStackErr: true},
+		{name: "../web", wantProjectErr: true, wantStackErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateProjectName(tt.name)
+			if (err != nil) != tt.wantProjectErr || (err != nil && !errors.Is(err, errInvalidProjectName)) {
+				t.Errorf("validateProjectName() error = %v, want error %v", err, tt.wantProjectErr)
+			}
+
+			err = validateStackName(tt.name)
+			if (err != nil) != tt.wantStackErr || (err != nil && !errors.Is(err, errInvalidProjectName)) {
+				t.Errorf("validateStackName() error = %v, want error %v", err, tt.wantStackErr)
+			}
+		})
+	}
+}
+
+func TestSourceNames(t *testing.T) {
+	tests := []struct {
+		source  Source
+		wantErr bool
+	}{
+		{source: &gitSource{name: "web"}},
+		{source: &gitSource{name: ".."}, wantErr: true},
+		{source: &archiveSource{url: "https://example.com/web.tar.gz"}},
+		{source: &archiveSource{url: "https://example.com/..?download=1"}, wantErr: true},
+		{source: &bundleSource{path: "web.tar.gz", manifest: &bundleManifest{Repository: "https://example.com/web.git"}}},
+		{source: &bundleSource{path: "web.tar.gz", manifest: &bundleManifest{Repository: "https://example.com/.."}}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		if err := validateStackName(tt.source.Name()); (err != nil) != tt.wantErr {
+			t.Errorf("validateStackName(%q) error = %v, want error %v", tt.source.Name(), err, tt.wantErr)
+		}
+	}
+}
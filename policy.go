@@ -0,0 +1,509 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	policyActionOff  = "off"
+	policyActionWarn = "warn"
+	policyActionDeny = "deny"
+)
+
+var (
+	errInvalidPolicy = errors.New("invalid policy")
+	errPolicyDenied  = errors.New("stack denied by policy")
+)
+
+// Policy is the set of rules checked against the resolved compose model
+// before a deployment.
+type Policy struct {
+	Rules policyRules `yaml:"rules"`
+}
+
+type policyRules struct {
+	Privileged  policyRule `yaml:"privileged"`
+	HostNetwork policyRule `yaml:"hostNetwork"`
+	HostPID     policyRule `yaml:"hostPID"`
+	// BindMounts uses AllowedRoots, the stack directory being always allowed
+	BindMounts policyRule `yaml:"bindMounts"`
+	// Capabilities uses Allowed for the capabilities which may be added
+	Capabilities policyRule `yaml:"capabilities"`
+	// PublishedPorts uses Allowed for the ports and port ranges, e.g.
+	// 8000-9000, which may be published
+	PublishedPorts policyRule `yaml:"publishedPorts"`
+	// ResourceLimits requires memory and CPU limits on every service
+	ResourceLimits policyRule `yaml:"resourceLimits"`
+	// Images uses AllowedRegistries, registry hosts optionally followed by a
+	// repository prefix, and RequireDigests
+	Images policyRule `yaml:"images"`
+}
+
+// policyRule is either an action or a mapping with an action and the
+// options of the rule.
+type policyRule struct {
+	Action       string   `yaml:"action"`
+	Allowed      []string `yaml:"allowed"`
+	AllowedRoots []string `yaml:"allowedRoots"`
+
+	AllowedRegistries []string `yaml:"allowedRegistries"`
+	RequireDigests    bool     `yaml:"requireDigests"`
+}
+
+func (r *policyRule) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		r.Action = node.Value
+		return nil
+	}
+
+	type plain policyRule
+	return node.Decode((*plain)(r))
+}
+
+func (r policyRule) enabled() bool {
+	return r.Action == policyActionWarn || r.Action == policyActionDeny
+}
+
+// loadPolicy reads the policy file at policyPath, unknown rules and actions
+// being errors.
+func loadPolicy(policyPath string) (*Policy, error) {
+	content, err := os.ReadFile(policyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var policy Policy
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true)
+
+	err = decoder.Decode(&policy)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", errInvalidPolicy, err)
+	}
+
+	for name, rule := range policy.Rules.byName() {
+		switch rule.Action {
+		case "", policyActionOff, policyActionWarn, policyActionDeny:
+		default:
+			return nil, fmt.Errorf("%w: unknown action %q for rule %s", errInvalidPolicy, rule.Action, name)
+		}
+	}
+
+	return &policy, nil
+}
+
+// deploymentPolicy returns the policy file at policyPath, if any, with the
+// registry allowlist and the digest requirement of the flags added as a deny
+// rule. It returns nil when there is nothing to enforce.
+func deploymentPolicy(policyPath string, allowedRegistries []string, requireDigests bool) (*Policy, error) {
+	policy := &Policy{}
+	if policyPath != "" {
+		var err error
+		policy, err = loadPolicy(policyPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(allowedRegistries) > 0 || requireDigests {
+		images := &policy.Rules.Images
+		images.Action = policyActionDeny
+		images.AllowedRegistries = append(images.AllowedRegistries, allowedRegistries...)
+		images.RequireDigests = images.RequireDigests || requireDigests
+	}
+
+	if policyPath == "" && !policy.Rules.Images.enabled() {
+		return nil, nil
+	}
+
+	return policy, nil
+}
+
+func (r policyRules) byName() map[string]policyRule {
+	return map[string]policyRule{
+		"privileged":     r.Privileged,
+		"hostNetwork":    r.HostNetwork,
+		"hostPID":        r.HostPID,
+		"bindMounts":     r.BindMounts,
+		"capabilities":   r.Capabilities,
+		"publishedPorts": r.PublishedPorts,
+		"resourceLimits": r.ResourceLimits,
+		"images":         r.Images,
+	}
+}
+
+// composeModel is the subset of the resolved compose model, as output by
+// docker compose config, checked by the policies.
+type composeModel struct {
+	Services map[string]composeService `json:"services"`
+	Volumes  map[string]composeVolume  `json:"volumes"`
+}
+
+type composeVolume struct {
+	Driver     string            `json:"driver"`
+	DriverOpts map[string]string `json:"driver_opts"`
+}
+
+// bindDevice returns the host path a volume of the local driver binds, an
+// empty string for the other volumes.
+func (v composeVolume) bindDevice() string {
+	if v.Driver != "" && v.Driver != "local" {
+		return ""
+	}
+
+	for _, option := range strings.Split(v.DriverOpts["o"], ",") {
+		if option == "bind" || option == "rbind" {
+			return v.DriverOpts["device"]
+		}
+	}
+
+	return ""
+}
+
+type composeService struct {
+	Image       string   `json:"image"`
+	Privileged  bool     `json:"privileged"`
+	NetworkMode string   `json:"network_mode"`
+	Pid         string   `json:"pid"`
+	CapAdd      []string `json:"cap_add"`
+	Volumes     []struct {
+		Type   string `json:"type"`
+		Source string `json:"source"`
+		Target string `json:"target"`
+	} `json:"volumes"`
+	Ports []struct {
+		Target    int         `json:"target"`
+		Published interface{} `json:"published"`
+	} `json:"ports"`
+	MemLimit interface{} `json:"mem_limit"`
+	CPUs     interface{} `json:"cpus"`
+	Deploy   *struct {
+		Resources struct {
+			Limits *struct {
+				Cpus     interface{} `json:"cpus"`
+				Memory   interface{} `json:"memory"`
+				NanoCPUs interface{} `json:"nanocpus"`
+			} `json:"limits"`
+		} `json:"resources"`
+	} `json:"deploy"`
+}
+
+// loadComposeModel resolves the compose project with docker compose config,
+// which merges the files, interpolates the variables and normalizes the
+// short syntaxes.
+func loadComposeModel(ctx context.Context, workingDir string, composeFilePaths, env []string) (*composeModel, error) {
+	output, err := runComposeCommand(ctx, workingDir, "", composeFilePaths, env, "config", "--format", "json")
+	if err != nil {
+		return nil, err
+	}
+
+	var model composeModel
+	err = json.Unmarshal([]byte(output), &model)
+	if err != nil {
+		return nil, err
+	}
+
+	return &model, nil
+}
+
+// enforcePolicy checks the resolved compose model against the policy and
+// logs the violations. It fails when a deny rule is violated.
+func enforcePolicy(ctx context.Context, policy *Policy, workingDir string, composeFilePaths, env, allowedRoots []string) error {
+	findings, err := checkPolicy(ctx, policy, workingDir, composeFilePaths, env, allowedRoots)
+	if err != nil {
+		log.Error().
+			Err(err).
+			Msg("Failed to check the stack against the policy")
+		return err
+	}
+
+	for _, finding := range findings {
+		event := log.Warn()
+		if finding.Severity == findingError {
+			event = log.Error()
+		}
+
+		event.
+			Str("service", finding.Service).
+			Str("rule", finding.Rule).
+			Msg(finding.Message)
+	}
+
+	if hasValidationErrors(findings) {
+		log.Error().
+			Strs("services", offendingServices(findings)).
+			Msg("Stack denied by policy")
+		return errPolicyDenied
+	}
+
+	return nil
+}
+
+// offendingServices returns the services with at least one deny violation.
+func offendingServices(findings []validationFinding) []string {
+	seen := make(map[string]struct{})
+	services := []string{}
+	for _, finding := range findings {
+		if finding.Severity != findingError || finding.Service == "" {
+			continue
+		}
+
+		if _, ok := seen[finding.Service]; !ok {
+			seen[finding.Service] = struct{}{}
+			services = append(services, finding.Service)
+		}
+	}
+
+	return services
+}
+
+// checkPolicy returns the policy violations of the compose project as
+// findings, errors for deny rules and warnings for warn rules.
+func checkPolicy(ctx context.Context, policy *Policy, workingDir string, composeFilePaths, env, allowedRoots []string) ([]validationFinding, error) {
+	model, err := loadComposeModel(ctx, workingDir, composeFilePaths, env)
+	if err != nil {
+		return nil, err
+	}
+
+	return policy.check(model, allowedRoots), nil
+}
+
+func (p *Policy) check(model *composeModel, allowedRoots []string) []validationFinding {
+	names := make([]string, 0, len(model.Services))
+	for name := range model.Services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	findings := []validationFinding{}
+	violation := func(rule policyRule, ruleName, service, format string, args ...interface{}) {
+		if !rule.enabled() {
+			return
+		}
+
+		severity := findingWarning
+		if rule.Action == policyActionDeny {
+			severity = findingError
+		}
+
+		findings = append(findings, validationFinding{
+			Service:  service,
+			Severity: severity,
+			Rule:     "policy/" + ruleName,
+			Message:  fmt.Sprintf(format, args...),
+		})
+	}
+
+	rules := p.Rules
+	for _, name := range names {
+		service := model.Services[name]
+
+		if service.Privileged {
+			violation(rules.Privileged, "privileged", name, "service %s runs in privileged mode", name)
+		}
+
+		if service.NetworkMode == "host" {
+			violation(rules.HostNetwork, "hostNetwork", name, "service %s uses the host network", name)
+		}
+
+		if service.Pid == "host" {
+			violation(rules.HostPID, "hostPID", name, "service %s uses the host PID namespace", name)
+		}
+
+		for _, volume := range service.Volumes {
+			source := volume.Source
+			if volume.Type == "volume" {
+				// Named volumes of the local driver may bind a host path
+				source = model.Volumes[volume.Source].bindDevice()
+			} else if volume.Type != "bind" {
+				continue
+			}
+
+			if source != "" && !withinAnyRoot(source, rules.BindMounts.AllowedRoots, allowedRoots) {
+				violation(rules.BindMounts, "bindMounts", name, "service %s mounts %s outside of the allowed roots", name, source)
+			}
+		}
+
+		for _, capability := range service.CapAdd {
+			if !containsCapability(rules.Capabilities.Allowed, capability) {
+				violation(rules.Capabilities, "capabilities", name, "service %s adds the %s capability", name, capability)
+			}
+		}
+
+		for _, port := range service.Ports {
+			published := toString(port.Published)
+			if published != "" && published != "0" && !portAllowed(rules.PublishedPorts.Allowed, published) {
+				violation(rules.PublishedPorts, "publishedPorts", name, "service %s publishes port %s", name, published)
+			}
+		}
+
+		if missing := service.missingLimits(); len(missing) > 0 {
+			violation(rules.ResourceLimits, "resourceLimits", name, "service %s has no %s limit", name, strings.Join(missing, " and "))
+		}
+
+		// Services only built from source have no image to check
+		if service.Image != "" && rules.Images.enabled() {
+			ref, err := parseImageReference(service.Image)
+			switch {
+			case err != nil:
+				violation(rules.Images, "images", name, "service %s uses the invalid image reference %s", name, service.Image)
+			case len(rules.Images.AllowedRegistries) > 0 && !registryAllowed(rules.Images.AllowedRegistries, ref):
+				violation(rules.Images, "images", name, "service %s uses image %s from registry %s which is not allowed", name, service.Image, ref.Registry)
+			}
+
+			if err == nil && rules.Images.RequireDigests && ref.Digest == "" {
+				if ref.Tag == "latest" {
+					violation(rules.Images, "images", name, "service %s uses the mutable latest tag of %s", name, ref.Name())
+				} else {
+					violation(rules.Images, "images", name, "service %s uses image %s which is not pinned by digest", name, service.Image)
+				}
+			}
+		}
+	}
+
+	return findings
+}
+
+// missingLimits returns the resources, memory and cpu, without limit, be it
+// from the deploy section or the service level settings.
+func (s composeService) missingLimits() []string {
+	memory := !isEmptyValue(s.MemLimit)
+	cpu := !isEmptyValue(s.CPUs)
+
+	if s.Deploy != nil && s.Deploy.Resources.Limits != nil {
+		limits := s.Deploy.Resources.Limits
+		memory = memory || !isEmptyValue(limits.Memory)
+		cpu = cpu || !isEmptyValue(limits.Cpus) || !isEmptyValue(limits.NanoCPUs)
+	}
+
+	missing := []string{}
+	if !memory {
+		missing = append(missing, "memory")
+	}
+	if !cpu {
+		missing = append(missing, "cpu")
+	}
+
+	return missing
+}
+
+// withinAnyRoot returns whether the bind mount source is inside one of the
+// policy roots or of the clones. The symbolic links of a source inside a clone
+// are resolved first, the repository controlling where they point to.
+func withinAnyRoot(source string, policyRoots, cloneRoots []string) bool {
+	source = filepath.Clean(source)
+
+	roots := make([]string, 0, len(policyRoots)+len(cloneRoots))
+	for _, root := range policyRoots {
+		roots = append(roots, filepath.Clean(root))
+	}
+
+	for _, cloneRoot := range cloneRoots {
+		resolvedRoot, err := filepath.EvalSymlinks(cloneRoot)
+		if err != nil {
+			continue
+		}
+		roots = append(roots, resolvedRoot)
+
+		if !isWithin(filepath.Clean(cloneRoot), source) && !isWithin(resolvedRoot, source) {
+			continue
+		}
+
+		resolved, err := evalExistingSymlinks(source)
+		if err != nil {
+			return false
+		}
+		source = resolved
+	}
+
+	for _, root := range roots {
+		if isWithin(root, source) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// registryAllowed returns whether the image is from one of the allowed
+// registries, an entry being a registry host, e.g. ghcr.io, optionally
+// followed by a repository prefix, e.g. ghcr.io/portainer.
+func registryAllowed(allowed []string, ref imageReference) bool {
+	for _, entry := range allowed {
+		entry = strings.TrimPrefix(strings.TrimPrefix(strings.TrimSpace(entry), "https://"), "http://")
+		host, prefix, _ := strings.Cut(strings.TrimSuffix(entry, "/"), "/")
+		if normalizeRegistryHost(host) != normalizeRegistryHost(ref.Registry) {
+			continue
+		}
+
+		if prefix == "" || ref.Repository == prefix || strings.HasPrefix(ref.Repository, prefix+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+func containsCapability(allowed []string, capability string) bool {
+	normalize := func(c string) string {
+		return strings.TrimPrefix(strings.ToUpper(c), "CAP_")
+	}
+
+	for _, a := range allowed {
+		if normalize(a) == normalize(capability) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// portAllowed returns whether every port of published, a port or a range,
+// is in one of the allowed ports or ranges.
+func portAllowed(allowed []string, published string) bool {
+	low, high, ok := parsePortRange(published)
+	if !ok {
+		return false
+	}
+
+	for _, a := range allowed {
+		allowedLow, allowedHigh, ok := parsePortRange(a)
+		if ok && low >= allowedLow && high <= allowedHigh {
+			return true
+		}
+	}
+
+	return false
+}
+
+func parsePortRange(ports string) (int, int, bool) {
+	lowPort, highPort, isRange := strings.Cut(strings.TrimSpace(ports), "-")
+
+	low, err := strconv.Atoi(lowPort)
+	if err != nil {
+		return 0, 0, false
+	}
+
+	if !isRange {
+		return low, low, true
+	}
+
+	high, err := strconv.Atoi(highPort)
+	if err != nil || high < low {
+		return 0, 0, false
+	}
+
+	return low, high, true
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestWithinAnyRoot(t *testing.T) {
+	clonePath := filepath.Join(t.TempDir(), "stack")
+	writeTestFiles(t, clonePath, map[string]string{"conf/nginx.conf": ""})
+
+	data := t.TempDir()
+	links := map[string]string{
+		"hostroot": "/",
+		"etc":      "/etc",
+		"data":     data,
+		"config":   "conf",
+		"escape":   "config/../..",
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(clonePath, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		source string
+		want   bool
+	}{
+		{name: "clone", source: clonePath, want: true},
+		{name: "file of the clone", source: filepath.Join(clonePath, "conf/nginx.conf"), want: true},
+		{name: "missing file of the clone", source: filepath.Join(clonePath, "missing"), want: true},
+		{name: "link inside the clone", source: filepath.Join(clonePath, "config"), want: true},
+		{name: "link to the host root", source: filepath.Join(clonePath, "hostroot"), want: false},
+		{name: "path under a link to the host", source: filepath.Join(clonePath, "etc/ssh"), want: false},
+		{name: "link out of the clone through a link", source: filepath.Join(clonePath, "escape"), want: false},
+		{name: "link to an allowed root", source: filepath.Join(clonePath, "data"), want: true},
+		{name: "allowed root", source: filepath.Join(data, "db"), want: true},
+		{name: "host path", source: "/var/run/docker.sock", want: false},
+		{name: "parent of the clone", source: filepath.Join(clonePath, ".."), want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := withinAnyRoot(tt.source, []string{data}, []string{clonePath}); got != tt.want {
+				t.Errorf("withinAnyRoot(%s) = %v, want %v", tt.source, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPolicyBindMounts(t *testing.T) {
+	clonePath := t.TempDir()
+
+	// As docker compose config outputs it
+	var model composeModel
+	err := json.Unmarshal([]byte(`{
+		"services": {
+			"web": {"volumes": [{"type": "bind", "source": "`+filepath.Join(clonePath, "conf")+`", "target": "/conf"}, {"type": "volume", "source": "data", "target": "/data"}]},
+			"root": {"volumes": [{"type": "volume", "source": "hostroot", "target": "/host"}]},
+			"rbind": {"volumes": [{"type": "volume", "source": "etc", "target": "/etc"}]},
+			"nfs": {"volumes": [{"type": "volume", "source": "nfs", "target": "/nfs"}]},
+			"socket": {"volumes": [{"type": "bind", "source": "/var/run/docker.sock", "target": "/var/run/docker.sock"}]}
+		},
+		"volumes": {
+			"data": {"name": "stack_data"},
+			"hostroot": {"name": "stack_hostroot", "driver_opts": {"type": "none", "o": "bind", "device": "/"}},
+			"etc": {"name": "stack_etc", "driver": "local", "driver_opts": {"type": "none", "o": "ro,rbind", "device": "/etc"}},
+			"nfs": {"name": "stack_nfs", "driver_opts": {"type": "nfs", "o": "addr=10.0.0.1,rw", "device": ":/exports"}}
+		}
+	}`), &model)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	policy := &Policy{Rules: policyRules{BindMounts: policyRule{Action: policyActionDeny}}}
+
+	got := offendingServices(policy.check(&model, []string{clonePath}))
+	want := []string{"rbind", "root", "socket"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("offending services = %v, want %v", got, want)
+	}
+}
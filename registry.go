@@ -0,0 +1,515 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	dockerHubRegistry     = "docker.io"
+	dockerHubRegistryHost = "registry-1.docker.io"
+
+	mediaTypeOCIManifest        = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeOCIIndex           = "application/vnd.oci.image.index.v1+json"
+	mediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	mediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+)
+
+var (
+	errInvalidImageReference = errors.New("invalid image reference")
+	errRegistryUnauthorized  = errors.New("registry authentication failed")
+
+	manifestMediaTypes = []string{
+		mediaTypeOCIManifest,
+		mediaTypeOCIIndex,
+		mediaTypeDockerManifest,
+		mediaTypeDockerManifestList,
+	}
+
+	challengeParam = regexp.MustCompile(`(\w+)="([^"]*)"`)
+)
+
+// imageReference is a parsed registry/repository[:tag][@digest] reference.
+type imageReference struct {
+	Registry   string
+	Repository string
+	Tag        string
+	Digest     string
+}
+
+// parseImageReference parses an image or artifact reference following the
+// Docker conventions: a missing registry means Docker Hub and a missing tag
+// means latest.
+func parseImageReference(ref string) (imageReference, error) {
+	var r imageReference
+
+	name := ref
+	if i := strings.Index(name, "@"); i != -1 {
+		r.Digest = name[i+1:]
+		name = name[:i]
+	}
+
+	if i := strings.LastIndex(name, ":"); i != -1 && !strings.Contains(name[i+1:], "/") {
+		r.Tag = name[i+1:]
+		name = name[:i]
+	}
+
+	if name == "" {
+		return r, fmt.Errorf("%w: %q", errInvalidImageReference, ref)
+	}
+
+	first, rest, found := strings.Cut(name, "/")
+	if found && (strings.ContainsAny(first, ".:") || first == "localhost") {
+		r.Registry = first
+		r.Repository = rest
+	} else {
+		r.Registry = dockerHubRegistry
+		r.Repository = name
+		if !found {
+			r.Repository = "library/" + name
+		}
+	}
+
+	if r.Tag == "" && r.Digest == "" {
+		r.Tag = "latest"
+	}
+
+	return r, nil
+}
+
+// Reference returns the tag or digest used to address the manifest.
+func (r imageReference) Reference() string {
+	if r.Digest != "" {
+		return r.Digest
+	}
+	return r.Tag
+}
+
+// Name returns the reference without tag nor digest.
+func (r imageReference) Name() string {
+	return r.Registry + "/" + r.Repository
+}
+
+func (r imageReference) String() string {
+	s := r.Name()
+	if r.Tag != "" {
+		s += ":" + r.Tag
+	}
+	if r.Digest != "" {
+		s += "@" + r.Digest
+	}
+	return s
+}
+
+// registryCredential is a username and password parsed from a --registry
+// entry.
+type registryCredential struct {
+	Username string
+	Password string
+}
+
+// parseRegistryCredentials parses the "username:password:registry" entries
+// of the --registry flag, keyed by registry host. The registry may include a
+// port and the password may contain colons.
+func parseRegistryCredentials(registries []string) map[string]registryCredential {
+	credentials := make(map[string]registryCredential)
+
+	for _, registry := range registries {
+		username, rest, found := strings.Cut(registry, ":")
+		if !found {
+			log.Warn().
+				Msg("Registry credentials are malformed, skipping them")
+			continue
+		}
+
+		// The registry follows the colon before its scheme, otherwise the
+		// last colon or the one before when the last colon separates its
+		// port
+		i := strings.LastIndex(rest, ":")
+		if k := strings.Index(rest, "://"); k >= 0 {
+			i = strings.LastIndex(rest[:k], ":")
+		} else if i >= 0 && isPort(rest[i+1:]) {
+			if j := strings.LastIndex(rest[:i], ":"); j >= 0 {
+				i = j
+			}
+		}
+		if i < 0 || rest[i+1:] == "" {
+			log.Warn().
+				Msg("Registry credentials are malformed, skipping them")
+			continue
+		}
+
+		credentials[normalizeRegistryHost(rest[i+1:])] = registryCredential{
+			Username: username,
+			Password: rest[:i],
+		}
+	}
+
+	return credentials
+}
+
+func isPort(s string) bool {
+	if s == "" {
+		return false
+	}
+
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+
+	return true
+}
+
+func normalizeRegistryHost(registry string) string {
+	registry = strings.TrimPrefix(strings.TrimPrefix(registry, "https://"), "http://")
+	registry, _, _ = strings.Cut(registry, "/")
+
+	switch registry {
+	case "index.docker.io", dockerHubRegistryHost, "":
+		return dockerHubRegistry
+	}
+
+	return strings.ToLower(registry)
+}
+
+// registryClient is a minimal OCI distribution API client.
+type registryClient struct {
+	httpClient  *http.Client
+	credentials map[string]registryCredential
+	// authorizations caches the Authorization header per registry and scope
+	authorizations map[string]string
+}
+
+func newRegistryClient(transport TransportOptions, registries []string) (*registryClient, error) {
+	httpClient, err := newHTTPClient(transport)
+	if err != nil {
+		return nil, err
+	}
+
+	return &registryClient{
+		httpClient:     httpClient,
+		credentials:    parseRegistryCredentials(registries),
+		authorizations: make(map[string]string),
+	}, nil
+}
+
+// registryBaseURL returns the base URL of the registry API. Registries on
+// the loopback interface are reached over plain HTTP, as Docker does.
+func registryBaseURL(registry string) string {
+	if registry == dockerHubRegistry {
+		return "https://" + dockerHubRegistryHost
+	}
+
+	host := registry
+	if i := strings.LastIndex(host, ":"); i != -1 {
+		host = host[:i]
+	}
+
+	if host == "localhost" || host == "127.0.0.1" || host == "::1" {
+		return "http://" + registry
+	}
+
+	return "https://" + registry
+}
+
+// do sends the request built by newRequest, answering the authentication
+// challenge of the registry once when needed.
+func (c *registryClient) do(ctx context.Context, ref imageReference, actions string, newRequest func() (*http.Request, error)) (*http.Response, error) {
+	scope := fmt.Sprintf("repository:%s:%s", ref.Repository, actions)
+	key := ref.Registry + " " + scope
+
+	for attempt := 0; attempt < 2; attempt++ {
+		req, err := newRequest()
+		if err != nil {
+			return nil, err
+		}
+		req = req.WithContext(ctx)
+
+		if authorization, ok := c.authorizations[key]; ok {
+			req.Header.Set("Authorization", authorization)
+		}
+
+		resp, err := c.httpClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode != http.StatusUnauthorized || attempt > 0 {
+			return resp, nil
+		}
+
+		challenge := resp.Header.Get("WWW-Authenticate")
+		resp.Body.Close()
+
+		authorization, err := c.authorize(ctx, ref.Registry, challenge, scope)
+		if err != nil {
+			return nil, err
+		}
+		c.authorizations[key] = authorization
+	}
+
+	return nil, errRegistryUnauthorized
+}
+
+// authorize answers a Basic or Bearer WWW-Authenticate challenge and returns
+// the Authorization header to send.
+func (c *registryClient) authorize(ctx context.Context, registry, challenge, scope string) (string, error) {
+	credential, hasCredential := c.credentials[normalizeRegistryHost(registry)]
+
+	scheme, params, _ := strings.Cut(challenge, " ")
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if !hasCredential {
+			return "", fmt.Errorf("%w: no credentials for %s", errRegistryUnauthorized, registry)
+		}
+
+		req, _ := http.NewRequest(http.MethodGet, "/", nil)
+		req.SetBasicAuth(credential.Username, credential.Password)
+		return req.Header.Get("Authorization"), nil
+	case "bearer":
+	default:
+		return "", fmt.Errorf("%w: unsupported challenge %q", errRegistryUnauthorized, challenge)
+	}
+
+	values := make(map[string]string)
+	for _, match := range challengeParam.FindAllStringSubmatch(params, -1) {
+		values[match[1]] = match[2]
+	}
+
+	tokenURL, err := url.Parse(values["realm"])
+	if err != nil || values["realm"] == "" {
+		return "", fmt.Errorf("%w: invalid realm in %q", errRegistryUnauthorized, challenge)
+	}
+
+	query := tokenURL.Query()
+	if values["service"] != "" {
+		query.Set("service", values["service"])
+	}
+	query.Set("scope", scope)
+	tokenURL.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, tokenURL.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if hasCredential {
+		req.SetBasicAuth(credential.Username, credential.Password)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%w: token request to %s returned %s", errRegistryUnauthorized, tokenURL.Host, resp.Status)
+	}
+
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&token)
+	if err != nil {
+		return "", err
+	}
+
+	if token.Token == "" {
+		token.Token = token.AccessToken
+	}
+
+	return "Bearer " + token.Token, nil
+}
+
+func registryError(resp *http.Response, operation string) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	return fmt.Errorf("%s failed: %s: %s", operation, resp.Status, strings.TrimSpace(string(body)))
+}
+
+// GetManifest fetches the manifest of ref and returns its content, media
+// type and digest.
+func (c *registryClient) GetManifest(ctx context.Context, ref imageReference, accept ...string) ([]byte, string, string, error) {
+	if len(accept) == 0 {
+		accept = manifestMediaTypes
+	}
+
+	manifestURL := fmt.Sprintf("%s/v2/%s/manifests/%s", registryBaseURL(ref.Registry), ref.Repository, ref.Reference())
+	resp, err := c.do(ctx, ref, "pull", func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodGet, manifestURL, nil)
+		if err == nil {
+			req.Header.Set("Accept", strings.Join(accept, ", "))
+		}
+		return req, err
+	})
+	if err != nil {
+		return nil, "", "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", "", registryError(resp, "manifest fetch of "+ref.String())
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	return body, resp.Header.Get("Content-Type"), digestOf(body), nil
+}
+
+// HeadManifest resolves ref to the digest of its manifest without
+// downloading it.
+func (c *registryClient) HeadManifest(ctx context.Context, ref imageReference) (string, error) {
+	manifestURL := fmt.Sprintf("%s/v2/%s/manifests/%s", registryBaseURL(ref.Registry), ref.Repository, ref.Reference())
+	resp, err := c.do(ctx, ref, "pull", func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodHead, manifestURL, nil)
+		if err == nil {
+			req.Header.Set("Accept", strings.Join(manifestMediaTypes, ", "))
+		}
+		return req, err
+	})
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("manifest lookup of %s failed: %s", ref, resp.Status)
+	}
+
+	digest := resp.Header.Get("Docker-Content-Digest")
+	if digest == "" {
+		_, _, digest, err = c.GetManifest(ctx, ref)
+	}
+
+	return digest, err
+}
+
+// GetBlob opens the blob with the given digest in the repository of ref.
+func (c *registryClient) GetBlob(ctx context.Context, ref imageReference, digest string) (io.ReadCloser, error) {
+	blobURL := fmt.Sprintf("%s/v2/%s/blobs/%s", registryBaseURL(ref.Registry), ref.Repository, digest)
+	resp, err := c.do(ctx, ref, "pull", func() (*http.Request, error) {
+		return http.NewRequest(http.MethodGet, blobURL, nil)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, registryError(resp, "blob fetch of "+digest)
+	}
+
+	return resp.Body, nil
+}
+
+// PutBlob uploads content to the repository of ref unless the registry
+// already has it, and returns its digest.
+func (c *registryClient) PutBlob(ctx context.Context, ref imageReference, content []byte) (string, error) {
+	digest := digestOf(content)
+	base := registryBaseURL(ref.Registry)
+
+	blobURL := fmt.Sprintf("%s/v2/%s/blobs/%s", base, ref.Repository, digest)
+	resp, err := c.do(ctx, ref, "pull,push", func() (*http.Request, error) {
+		return http.NewRequest(http.MethodHead, blobURL, nil)
+	})
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		return digest, nil
+	}
+
+	uploadURL := fmt.Sprintf("%s/v2/%s/blobs/uploads/", base, ref.Repository)
+	resp, err = c.do(ctx, ref, "pull,push", func() (*http.Request, error) {
+		return http.NewRequest(http.MethodPost, uploadURL, nil)
+	})
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusAccepted {
+		return "", registryError(resp, "blob upload of "+digest)
+	}
+
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		return "", err
+	}
+
+	baseURL, _ := url.Parse(base)
+	location = baseURL.ResolveReference(location)
+	query := location.Query()
+	query.Set("digest", digest)
+	location.RawQuery = query.Encode()
+
+	resp, err = c.do(ctx, ref, "pull,push", func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodPut, location.String(), bytes.NewReader(content))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/octet-stream")
+		}
+		return req, err
+	})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		return "", registryError(resp, "blob upload of "+digest)
+	}
+
+	return digest, nil
+}
+
+// PutManifest uploads a manifest under the tag of ref and returns its
+// digest.
+func (c *registryClient) PutManifest(ctx context.Context, ref imageReference, mediaType string, manifest []byte) (string, error) {
+	manifestURL := fmt.Sprintf("%s/v2/%s/manifests/%s", registryBaseURL(ref.Registry), ref.Repository, ref.Reference())
+	resp, err := c.do(ctx, ref, "pull,push", func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodPut, manifestURL, bytes.NewReader(manifest))
+		if err == nil {
+			req.Header.Set("Content-Type", mediaType)
+		}
+		return req, err
+	})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		return "", registryError(resp, "manifest upload of "+ref.String())
+	}
+
+	log.Debug().
+		Str("reference", ref.String()).
+		Str("digest", digestOf(manifest)).
+		Msg("Manifest pushed")
+
+	return digestOf(manifest), nil
+}
+
+func digestOf(content []byte) string {
+	sum := sha256.Sum256(content)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
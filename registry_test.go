@@ -0,0 +1,227 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testRegistry is an in memory OCI distribution registry, reached over plain
+// HTTP on the loopback interface like registryBaseURL expects.
+type testRegistry struct {
+	*httptest.Server
+	// Host is the registry part of the references to the registry
+	Host string
+
+	username string
+	password string
+
+	mu        sync.Mutex
+	blobs     map[string][]byte
+	manifests map[string]testManifest
+	uploads   int
+}
+
+type testManifest struct {
+	mediaType string
+	content   []byte
+}
+
+// newTestRegistry starts a registry, requiring basic authentication when
+// username is not empty.
+func newTestRegistry(t *testing.T, username, password string) *testRegistry {
+	t.Helper()
+
+	r := &testRegistry{
+		username:  username,
+		password:  password,
+		blobs:     make(map[string][]byte),
+		manifests: make(map[string]testManifest),
+	}
+	r.Server = httptest.NewServer(http.HandlerFunc(r.serveHTTP))
+	t.Cleanup(r.Close)
+
+	u, err := url.Parse(r.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Host = u.Host
+
+	return r
+}
+
+// Ref returns a reference to repository in the registry.
+func (r *testRegistry) Ref(repository string) string {
+	return r.Host + "/" + repository
+}
+
+// PutManifest stores a manifest under the tag, or only its digest when tag is
+// empty, and returns its digest.
+func (r *testRegistry) PutManifest(repository, tag, mediaType string, content []byte) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	digest := digestOf(content)
+	r.manifests[repository+"@"+digest] = testManifest{mediaType: mediaType, content: content}
+	if tag != "" {
+		r.manifests[repository+":"+tag] = testManifest{mediaType: mediaType, content: content}
+	}
+
+	return digest
+}
+
+// PutBlob stores a blob and returns its digest.
+func (r *testRegistry) PutBlob(content []byte) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	digest := digestOf(content)
+	r.blobs[digest] = content
+	return digest
+}
+
+func (r *testRegistry) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	if r.username != "" {
+		username, password, ok := req.BasicAuth()
+		if !ok || username != r.username || password != r.password {
+			w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	p := strings.TrimPrefix(req.URL.Path, "/v2/")
+	switch {
+	case strings.Contains(p, "/blobs/uploads/"):
+		repository, upload, _ := strings.Cut(p, "/blobs/uploads/")
+		r.serveUpload(w, req, repository, upload)
+	case strings.Contains(p, "/blobs/"):
+		_, digest, _ := strings.Cut(p, "/blobs/")
+		blob, ok := r.blobs[digest]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Length", fmt.Sprint(len(blob)))
+		if req.Method == http.MethodGet {
+			w.Write(blob)
+		}
+	case strings.Contains(p, "/manifests/"):
+		repository, reference, _ := strings.Cut(p, "/manifests/")
+		r.serveManifest(w, req, repository, reference)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (r *testRegistry) serveUpload(w http.ResponseWriter, req *http.Request, repository, upload string) {
+	switch req.Method {
+	case http.MethodPost:
+		r.uploads++
+		w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/uploads/%d", repository, r.uploads))
+		w.WriteHeader(http.StatusAccepted)
+	case http.MethodPut:
+		content, _ := io.ReadAll(req.Body)
+		if digest := req.URL.Query().Get("digest"); digest != digestOf(content) || upload == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		r.blobs[digestOf(content)] = content
+		w.WriteHeader(http.StatusCreated)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (r *testRegistry) serveManifest(w http.ResponseWriter, req *http.Request, repository, reference string) {
+	key := repository + ":" + reference
+	if strings.HasPrefix(reference, "sha256:") {
+		key = repository + "@" + reference
+	}
+
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		manifest, ok := r.manifests[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", manifest.mediaType)
+		w.Header().Set("Docker-Content-Digest", digestOf(manifest.content))
+		if req.Method == http.MethodGet {
+			w.Write(manifest.content)
+		}
+	case http.MethodPut:
+		content, _ := io.ReadAll(req.Body)
+		manifest := testManifest{mediaType: req.Header.Get("Content-Type"), content: content}
+		r.manifests[key] = manifest
+		r.manifests[repository+"@"+digestOf(content)] = manifest
+		w.WriteHeader(http.StatusCreated)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func TestParseImageReference(t *testing.T) {
+	tests := []struct {
+		ref     string
+		want    imageReference
+		wantErr bool
+	}{
+		{ref: "nginx", want: imageReference{Registry: dockerHubRegistry, Repository: "library/nginx", Tag: "latest"}},
+		{ref: "org/app:1.2", want: imageReference{Registry: dockerHubRegistry, Repository: "org/app", Tag: "1.2"}},
+		{ref: "localhost:5000/app", want: imageReference{Registry: "localhost:5000", Repository: "app", Tag: "latest"}},
+		{ref: "registry.example.com/org/app:1@sha256:abc", want: imageReference{Registry: "registry.example.com", Repository: "org/app", Tag: "1", Digest: "sha256:abc"}},
+		{ref: "ghcr.io/org/app@sha256:abc", want: imageReference{Registry: "ghcr.io", Repository: "org/app", Digest: "sha256:abc"}},
+		{ref: ":latest", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ref, func(t *testing.T) {
+			got, err := parseImageReference(tt.ref)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseImageReference() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && got != tt.want {
+				t.Errorf("parseImageReference() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseRegistryCredentials(t *testing.T) {
+	tests := []struct {
+		registry string
+		want     map[string]registryCredential
+	}{
+		{registry: "user:pass:registry.example.com", want: map[string]registryCredential{"registry.example.com": {Username: "user", Password: "pass"}}},
+		{registry: "user:pass:registry.example.com:5000", want: map[string]registryCredential{"registry.example.com:5000": {Username: "user", Password: "pass"}}},
+		{registry: "user:p:a:ss:registry.example.com", want: map[string]registryCredential{"registry.example.com": {Username: "user", Password: "p:a:ss"}}},
+		{registry: "user:p:a:ss:registry.example.com:5000", want: map[string]registryCredential{"registry.example.com:5000": {Username: "user", Password: "p:a:ss"}}},
+		{registry: "user::https://index.docker.io/v1/", want: map[string]registryCredential{dockerHubRegistry: {Username: "user"}}},
+		{registry: "user:pass", want: map[string]registryCredential{}},
+		{registry: "user:pass:", want: map[string]registryCredential{}},
+		{registry: "registry.example.com", want: map[string]registryCredential{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.registry, func(t *testing.T) {
+			got := parseRegistryCredentials([]string{tt.registry})
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseRegistryCredentials() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,23 +1,246 @@
 package main
 
 import (
+	"bufio"
+	"errors"
+	"fmt"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/rs/zerolog/log"
 )
 
+const mountInfoPath = "/proc/self/mountinfo"
+
+var (
+	errUnsafeRemoval     = errors.New("refusing to remove directory")
+	errNothingToRemove   = errors.New("a path, --older-than or --glob is required")
+	errRemovalRootNeeded = errors.New("--root is required to remove directories")
+)
+
+// systemPaths are never removed, nor their parents. Stack directories may be
+// under them.
+var systemPaths = []string{
+	"/", "/home", "/mnt", "/opt", "/root", "/srv", "/tmp", "/var", "/var/lib",
+}
+
+// systemTrees are never removed, nor their parents and the paths under them.
+var systemTrees = []string{
+	BIN_PATH, "/bin", "/boot", "/dev", "/etc", "/lib", "/lib32", "/lib64",
+	"/proc", "/run", "/sbin", "/sys", "/usr", "/var/lib/docker", "/var/run",
+}
+
 func (cmd *RemoveDirCommand) Run(cmdCtx *CommandExecutionContext) error {
-	log.Info().
-		Str("path", cmd.Path).
-		Msg("Remove directory")
+	if cmd.Path == "" && cmd.OlderThan <= 0 && cmd.Glob == "" {
+		return errNothingToRemove
+	}
 
-	err := os.RemoveAll(cmd.Path)
+	if cmd.Root == "" {
+		return errRemovalRootNeeded
+	}
+
+	root, err := filepath.EvalSymlinks(cmd.Root)
 	if err != nil {
 		log.Error().
 			Err(err).
-			Str("path", cmd.Path).
-			Msg("Failed to remove directory")
+			Str("root", cmd.Root).
+			Msg("Failed to resolve the removal root")
+		return err
+	}
+
+	paths := []string{}
+	if cmd.Path != "" {
+		paths = append(paths, cmd.Path)
+	}
+
+	if cmd.OlderThan > 0 || cmd.Glob != "" {
+		stale, err := staleStackDirectories(root, cmd.Glob, cmd.OlderThan)
+		if err != nil {
+			log.Error().
+				Err(err).
+				Str("root", root).
+				Msg("Failed to list stack directories")
+			return err
+		}
+
+		paths = append(paths, stale...)
+	}
+
+	mountPoints, err := readMountPoints()
+	if err != nil {
+		log.Debug().
+			Err(err).
+			Msg("Failed to read the mount points")
+	}
+
+	for _, p := range paths {
+		target, err := checkRemovablePath(p, root, mountPoints)
+		if err != nil {
+			log.Error().
+				Err(err).
+				Str("path", p).
+				Msg("Refusing to remove directory")
+			return err
+		}
+
+		if cmd.DryRun {
+			fmt.Println(target)
+			continue
+		}
+
+		log.Info().
+			Str("path", target).
+			Msg("Remove directory")
+
+		err = os.RemoveAll(target)
+		if err != nil {
+			log.Error().
+				Err(err).
+				Str("path", target).
+				Msg("Failed to remove directory")
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkRemovablePath returns the path to remove once its parent directories
+// are resolved, the last element being removed itself even when it is a
+// symbolic link. The path must be strictly under root, must not be a system
+// path, be in a system tree nor hold a mount point.
+func checkRemovablePath(p, root string, mountPoints []string) (string, error) {
+	absolutePath, err := filepath.Abs(p)
+	if err != nil {
+		return "", err
+	}
+
+	parent, err := filepath.EvalSymlinks(filepath.Dir(absolutePath))
+	if errors.Is(err, os.ErrNotExist) {
+		// Nothing to remove, as with os.RemoveAll
+		return absolutePath, nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	target := filepath.Join(parent, filepath.Base(absolutePath))
+
+	if target == root || !isWithin(root, target) {
+		return "", fmt.Errorf("%w: %s is not under %s", errUnsafeRemoval, target, root)
+	}
+
+	for _, systemPath := range systemPaths {
+		if isWithin(target, systemPath) {
+			return "", fmt.Errorf("%w: %s is a system path", errUnsafeRemoval, target)
+		}
+	}
+
+	for _, systemTree := range systemTrees {
+		if isWithin(target, systemTree) || isWithin(systemTree, target) {
+			return "", fmt.Errorf("%w: %s is a system path", errUnsafeRemoval, target)
+		}
+	}
+
+	for _, mountPoint := range mountPoints {
+		if isWithin(target, mountPoint) {
+			return "", fmt.Errorf("%w: %s is or holds the mount point %s", errUnsafeRemoval, target, mountPoint)
+		}
+	}
+
+	return target, nil
+}
+
+// staleStackDirectories returns the stack directories under root, see
+// makeWorkingDir, whose name matches pattern and which were not modified for
+// longer than maxAge. An empty pattern or a zero maxAge matches all of them.
+func staleStackDirectories(root, pattern string, maxAge time.Duration) ([]string, error) {
+	stacksDir := makeWorkingDir(root, "")
+
+	entries, err := os.ReadDir(stacksDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	stale := []string{}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		if pattern != "" {
+			matched, err := filepath.Match(pattern, entry.Name())
+			if err != nil {
+				return nil, err
+			}
+			if !matched {
+				continue
+			}
+		}
+
+		if maxAge > 0 {
+			info, err := entry.Info()
+			if err != nil {
+				return nil, err
+			}
+			if time.Since(info.ModTime()) < maxAge {
+				continue
+			}
+		}
+
+		stale = append(stale, filepath.Join(stacksDir, entry.Name()))
+	}
+
+	sort.Strings(stale)
+	return stale, nil
+}
+
+// readMountPoints returns the mount points of the process, other than the
+// root filesystem.
+func readMountPoints() ([]string, error) {
+	file, err := os.Open(mountInfoPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	mountPoints := []string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// The fifth field is the mount point, with octal escapes
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 {
+			continue
+		}
+
+		mountPoint := unescapeMountPoint(fields[4])
+		if mountPoint != "/" {
+			mountPoints = append(mountPoints, mountPoint)
+		}
+	}
+
+	return mountPoints, scanner.Err()
+}
+
+func unescapeMountPoint(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
 	}
 
-	return err
+	return b.String()
 }
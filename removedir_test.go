@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCheckRemovablePath(t *testing.T) {
+	root, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeTestFiles(t, root, map[string]string{
+		"stacks/web/docker-compose.yml": "",
+		"stacks/mounted/data/.keep":     "",
+	})
+	if err := os.Symlink("/", filepath.Join(root, "hostroot")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("/etc", filepath.Join(root, "stacks", "etc")); err != nil {
+		t.Fatal(err)
+	}
+
+	mountPoints := []string{filepath.Join(root, "stacks/mounted/data")}
+
+	tests := []struct {
+		name    string
+		path    string
+		root    string
+		want    string
+		wantErr error
+	}{
+		{name: "stack directory", path: filepath.Join(root, "stacks/web"), want: filepath.Join(root, "stacks/web")},
+		{name: "missing directory", path: filepath.Join(root, "stacks/missing"), want: filepath.Join(root, "stacks/missing")},
+		{name: "link removed itself", path: filepath.Join(root, "stacks/etc"), want: filepath.Join(root, "stacks/etc")},
+		{name: "root", path: root, wantErr: errUnsafeRemoval},
+		{name: "outside of the root", path: filepath.Dir(root), wantErr: errUnsafeRemoval},
+		{name: "through a link out of the root", path: filepath.Join(root, "hostroot/etc/ssh"), wantErr: errUnsafeRemoval},
+		{name: "through a link to a system tree", path: filepath.Join(root, "stacks/etc/ssh"), wantErr: errUnsafeRemoval},
+		{name: "holding a mount point", path: filepath.Join(root, "stacks/mounted"), wantErr: errUnsafeRemoval},
+		{name: "mount point", path: filepath.Join(root, "stacks/mounted/data"), wantErr: errUnsafeRemoval},
+		{name: "system path", path: "/var/lib", root: "/", wantErr: errUnsafeRemoval},
+		{name: "parent of a system path", path: "/var", root: "/", wantErr: errUnsafeRemoval},
+		{name: "under a system tree", path: "/etc/ssh", root: "/", wantErr: errUnsafeRemoval},
+		{name: "under the binaries", path: filepath.Join(BIN_PATH, "docker"), root: "/", wantErr: errUnsafeRemoval},
+		{name: "docker data", path: "/var/lib/docker", root: "/", wantErr: errUnsafeRemoval},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testRoot := root
+			if tt.root != "" {
+				testRoot = tt.root
+			}
+
+			got, err := checkRemovablePath(tt.path, testRoot, mountPoints)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("checkRemovablePath() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && got != tt.want {
+				t.Errorf("checkRemovablePath() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRemoveDirCommand(t *testing.T) {
+	root := t.TempDir()
+	writeTestFiles(t, root, map[string]string{
+		"stacks/web/docker-compose.yml": "",
+		"stacks/api/docker-compose.yml": "",
+		"stacks/old/docker-compose.yml": "",
+	})
+
+	old := time.Now().Add(-48 * time.Hour)
+	if err := os.Chtimes(filepath.Join(root, "stacks/old"), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		cmd     RemoveDirCommand
+		removed []string
+		wantErr error
+	}{
+		{name: "no root", cmd: RemoveDirCommand{Path: filepath.Join(root, "stacks/web")}, wantErr: errRemovalRootNeeded},
+		{name: "nothing to remove", cmd: RemoveDirCommand{Root: root}, wantErr: errNothingToRemove},
+		{name: "dry run", cmd: RemoveDirCommand{Root: root, Glob: "*", DryRun: true}},
+		{name: "older than", cmd: RemoveDirCommand{Root: root, OlderThan: 24 * time.Hour}, removed: []string{"old"}},
+		{name: "glob", cmd: RemoveDirCommand{Root: root, Glob: "a*"}, removed: []string{"old", "api"}},
+		{name: "path", cmd: RemoveDirCommand{Root: root, Path: filepath.Join(root, "stacks/web")}, removed: []string{"old", "api", "web"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.cmd.Run(&CommandExecutionContext{context: context.Background()})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Run() error = %v, want %v", err, tt.wantErr)
+			}
+
+			removed := make(map[string]bool)
+			for _, name := range tt.removed {
+				removed[name] = true
+			}
+
+			for _, name := range []string{"web", "api", "old"} {
+				_, err := os.Stat(filepath.Join(root, "stacks", name))
+				if exists := err == nil; exists == removed[name] {
+					t.Errorf("stack directory %s exists = %v, want %v", name, exists, !removed[name])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// rewrittenComposeFileInfix marks the compose files written by
+// rewriteComposeFiles.
+const rewrittenComposeFileInfix = ".unpacker"
+
+// composeFileRewriter updates the root mapping of a compose file in place and
+// reports whether it changed it.
+type composeFileRewriter func(composeFilePath string, root *yaml.Node) (bool, error)
+
+// composeFileReader inspects the root mapping of a compose file.
+type composeFileReader func(composeFilePath string, root *yaml.Node) error
+
+// readComposeFiles calls read with the root mapping of each compose file,
+// skipping the empty ones.
+func readComposeFiles(clonePath string, composeRelativeFilePaths []string, read composeFileReader) error {
+	for _, composeRelativeFilePath := range composeRelativeFilePaths {
+		composeFilePath := filepath.Join(clonePath, filepath.FromSlash(composeRelativeFilePath))
+
+		document, err := parseComposeFile(composeFilePath)
+		if err != nil {
+			return err
+		}
+		if len(document.Content) == 0 || document.Content[0].Kind != yaml.MappingNode {
+			continue
+		}
+
+		err = read(composeFilePath, document.Content[0])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// parseComposeFile returns the YAML document of a compose file.
+func parseComposeFile(composeFilePath string) (*yaml.Node, error) {
+	content, err := os.ReadFile(composeFilePath)
+	if err != nil {
+		return nil, err
+	}
+
+	var document yaml.Node
+	err = yaml.Unmarshal(content, &document)
+	if err != nil {
+		return nil, err
+	}
+
+	return &document, nil
+}
+
+// rewriteComposeFiles applies rewrite to the compose files. The rewritten
+// files are written next to the original ones, so that relative paths keep
+// working, and their paths, relative to clonePath, are returned in place of
+// the original ones. Files left unchanged are returned as is and rewriting a
+// file produced by a previous call updates it in place.
+func rewriteComposeFiles(clonePath string, composeRelativeFilePaths []string, rewrite composeFileRewriter) ([]string, error) {
+	rewrittenFilePaths := make([]string, len(composeRelativeFilePaths))
+
+	for i, composeRelativeFilePath := range composeRelativeFilePaths {
+		composeFilePath := filepath.Join(clonePath, filepath.FromSlash(composeRelativeFilePath))
+
+		document, err := parseComposeFile(composeFilePath)
+		if err != nil {
+			return nil, err
+		}
+
+		rewrittenFilePaths[i] = composeRelativeFilePath
+		if len(document.Content) == 0 || document.Content[0].Kind != yaml.MappingNode {
+			continue
+		}
+
+		changed, err := rewrite(composeFilePath, document.Content[0])
+		if err != nil {
+			return nil, err
+		}
+		if !changed {
+			continue
+		}
+
+		var buf bytes.Buffer
+		encoder := yaml.NewEncoder(&buf)
+		encoder.SetIndent(2)
+
+		err = encoder.Encode(document)
+		if err == nil {
+			err = encoder.Close()
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		dir, name := path.Split(composeRelativeFilePath)
+		ext := path.Ext(name)
+		if !strings.HasSuffix(strings.TrimSuffix(name, ext), rewrittenComposeFileInfix) {
+			rewrittenFilePaths[i] = path.Join(dir, "."+strings.TrimSuffix(name, ext)+rewrittenComposeFileInfix+ext)
+		}
+
+		// The rewritten file may already exist in the repository as a link
+		err = checkPathInside(clonePath, rewrittenFilePaths[i])
+		if err != nil {
+			return nil, err
+		}
+
+		err = os.WriteFile(filepath.Join(clonePath, filepath.FromSlash(rewrittenFilePaths[i])), buf.Bytes(), 0644)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return rewrittenFilePaths, nil
+}
+
+// mappingValue returns the value of key in a mapping node, or nil.
+func mappingValue(mapping *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return mapping.Content[i+1]
+		}
+	}
+
+	return nil
+}
+
+// setMappingValue sets key to value in a mapping node.
+func setMappingValue(mapping *yaml.Node, key string, value *yaml.Node) {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			mapping.Content[i+1] = value
+			return
+		}
+	}
+
+	mapping.Content = append(mapping.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, value)
+}
+
+func stringNode(value string) *yaml.Node {
+	return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value}
+}
+
+// ensureComposeVersion raises the 3.x version of a compose file to
+// minMinor when it is lower, for the features the rewriters rely on. Files
+// without a version or with another major version are left untouched.
+func ensureComposeVersion(root *yaml.Node, minMinor int) {
+	version := mappingValue(root, "version")
+	if version == nil || !strings.HasPrefix(version.Value, "3") {
+		return
+	}
+
+	minor := 0
+	if _, v, ok := strings.Cut(version.Value, "."); ok {
+		minor, _ = strconv.Atoi(v)
+	}
+
+	if minor < minMinor {
+		version.Value = "3." + strconv.Itoa(minMinor)
+		version.Style = yaml.DoubleQuotedStyle
+	}
+}
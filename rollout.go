@@ -0,0 +1,256 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// swarmUpdateConfigMinorVersion is the first 3.x compose file version
+	// supporting the update order and monitor settings
+	swarmUpdateConfigMinorVersion = 4
+	swarmUpdatePollInterval       = 2 * time.Second
+)
+
+var (
+	errSwarmUpdateFailed = errors.New("swarm service update failure")
+	errInvalidUpdateFlag = errors.New("invalid update policy")
+)
+
+// updateConfig returns the deploy.update_config mapping built from the
+// update flags, or nil when none is set.
+func (cmd *SwarmDeployCommand) updateConfig() (*yaml.Node, error) {
+	switch cmd.UpdateOrder {
+	case "", "start-first", "stop-first":
+	default:
+		return nil, fmt.Errorf("%w: unknown update order %q", errInvalidUpdateFlag, cmd.UpdateOrder)
+	}
+
+	switch cmd.UpdateFailureAction {
+	case "", "pause", "continue", "rollback":
+	default:
+		return nil, fmt.Errorf("%w: unknown update failure action %q", errInvalidUpdateFlag, cmd.UpdateFailureAction)
+	}
+
+	updateConfig := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+
+	if cmd.UpdateParallelism > 0 {
+		setMappingValue(updateConfig, "parallelism", &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!int", Value: strconv.Itoa(cmd.UpdateParallelism)})
+	}
+	if cmd.UpdateDelay > 0 {
+		setMappingValue(updateConfig, "delay", stringNode(cmd.UpdateDelay.String()))
+	}
+	if cmd.UpdateOrder != "" {
+		setMappingValue(updateConfig, "order", stringNode(cmd.UpdateOrder))
+	}
+	if cmd.UpdateFailureAction != "" {
+		setMappingValue(updateConfig, "failure_action", stringNode(cmd.UpdateFailureAction))
+	}
+	if cmd.Monitor > 0 {
+		setMappingValue(updateConfig, "monitor", stringNode(cmd.Monitor.String()))
+	}
+
+	if len(updateConfig.Content) == 0 {
+		return nil, nil
+	}
+
+	return updateConfig, nil
+}
+
+// applyUpdatePolicy sets updateConfig as the deploy.update_config of the
+// services which do not define one in any of the compose files. See
+// rewriteComposeFiles for the returned paths.
+func applyUpdatePolicy(clonePath string, composeRelativeFilePaths []string, updateConfig *yaml.Node) ([]string, error) {
+	// The compose files are merged by docker stack deploy, an update_config
+	// set by any of them wins over the flags
+	configured := make(map[string]struct{})
+	err := readComposeFiles(clonePath, composeRelativeFilePaths, func(composeFilePath string, root *yaml.Node) error {
+		forEachService(root, func(name string, service *yaml.Node) {
+			deploy := mappingValue(service, "deploy")
+			if deploy != nil && deploy.Kind == yaml.MappingNode && mappingValue(deploy, "update_config") != nil {
+				configured[name] = struct{}{}
+			}
+		})
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return rewriteComposeFiles(clonePath, composeRelativeFilePaths, func(composeFilePath string, root *yaml.Node) (bool, error) {
+		changed := false
+		forEachService(root, func(name string, service *yaml.Node) {
+			if _, ok := configured[name]; ok {
+				return
+			}
+
+			deploy := mappingValue(service, "deploy")
+			if deploy == nil || deploy.Kind != yaml.MappingNode {
+				deploy = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+				setMappingValue(service, "deploy", deploy)
+			}
+
+			copied := *updateConfig
+			setMappingValue(deploy, "update_config", &copied)
+			changed = true
+
+			log.Debug().
+				Str("service", name).
+				Msg("Applying the update policy")
+		})
+
+		if changed {
+			ensureComposeVersion(root, swarmUpdateConfigMinorVersion)
+		}
+
+		return changed, nil
+	})
+}
+
+func forEachService(root *yaml.Node, fn func(name string, service *yaml.Node)) {
+	services := mappingValue(root, "services")
+	if services == nil || services.Kind != yaml.MappingNode {
+		return
+	}
+
+	for i := 0; i+1 < len(services.Content); i += 2 {
+		if services.Content[i+1].Kind == yaml.MappingNode {
+			fn(services.Content[i].Value, services.Content[i+1])
+		}
+	}
+}
+
+// waitForSwarmUpdates waits for the service updates of the stack started
+// after since to complete. The services whose update is paused on failure
+// are rolled back, and an error listing the services rolled back, by Swarm
+// or by the unpacker, is returned.
+func waitForSwarmUpdates(cmdCtx *CommandExecutionContext, projectName string, since time.Time, timeout time.Duration) error {
+	log.Info().
+		Str("projectName", projectName).
+		Dur("timeout", timeout).
+		Msg("Waiting for the Swarm service updates")
+
+	var services []swarmService
+	deadline := time.Now().Add(timeout)
+	for {
+		var err error
+		services, err = inspectStackServices(projectName)
+		if err != nil {
+			log.Error().
+				Err(err).
+				Msg("Failed to inspect Swarm stack services")
+			return err
+		}
+
+		pending := []string{}
+		for _, service := range services {
+			status := service.UpdateStatus
+			if status == nil || status.StartedAt.Before(since) {
+				continue
+			}
+
+			if status.State == "updating" || status.State == "rollback_started" {
+				pending = append(pending, service.Spec.Name)
+			}
+		}
+
+		if len(pending) == 0 {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			log.Warn().
+				Strs("services", pending).
+				Msg("Swarm service updates still in progress, giving up waiting")
+			break
+		}
+
+		select {
+		case <-cmdCtx.context.Done():
+			return cmdCtx.context.Err()
+		case <-time.After(swarmUpdatePollInterval):
+		}
+	}
+
+	err := rollBackFailedUpdates(services, since, rollbackSwarmService)
+	if err != nil {
+		return err
+	}
+
+	log.Info().Msg("Swarm service updates complete")
+	return nil
+}
+
+// rollBackFailedUpdates rolls back, with rollback, the services whose update
+// started after since is paused on failure. An error is returned when
+// services were rolled back, by Swarm or by the unpacker, or when a rollback
+// failed.
+func rollBackFailedUpdates(services []swarmService, since time.Time, rollback func(swarmService) error) error {
+	rolledBack := []string{}
+	failed := false
+	for _, service := range services {
+		status := service.UpdateStatus
+		if status == nil || status.StartedAt.Before(since) {
+			continue
+		}
+
+		switch status.State {
+		case "paused":
+			log.Warn().
+				Str("service", service.Spec.Name).
+				Str("message", status.Message).
+				Msg("Swarm service update failed, rolling back")
+
+			err := rollback(service)
+			if err != nil {
+				log.Error().
+					Err(err).
+					Str("service", service.Spec.Name).
+					Msg("Failed to roll back Swarm service")
+				failed = true
+				continue
+			}
+
+			rolledBack = append(rolledBack, service.Spec.Name)
+		case "rollback_started", "rollback_completed":
+			log.Warn().
+				Str("service", service.Spec.Name).
+				Str("message", status.Message).
+				Msg("Swarm service update failed and was rolled back by Swarm")
+
+			rolledBack = append(rolledBack, service.Spec.Name)
+		case "rollback_paused":
+			log.Error().
+				Str("service", service.Spec.Name).
+				Str("message", status.Message).
+				Msg("Swarm service rollback failed")
+
+			return errSwarmUpdateFailed
+		}
+	}
+
+	if len(rolledBack) > 0 {
+		log.Error().
+			Strs("services", rolledBack).
+			Msg("Swarm services rolled back after a failed update")
+		return errSwarmUpdateFailed
+	}
+	if failed {
+		return errSwarmUpdateFailed
+	}
+
+	return nil
+}
+
+// rollbackSwarmService starts the rollback of the service to its previous
+// spec.
+func rollbackSwarmService(service swarmService) error {
+	_, err := runCommand(getDockerBinaryPath(), []string{"--config", PORTAINER_DOCKER_CONFIG_PATH, "service", "rollback", "--detach", service.ID})
+	return err
+}
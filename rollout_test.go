@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRollBackFailedUpdates(t *testing.T) {
+	since := time.Now()
+	service := func(name, state string, startedAt time.Time) swarmService {
+		s := swarmService{ID: name + "-id"}
+		s.Spec.Name = name
+		if state != "" {
+			s.UpdateStatus = &struct {
+				State     string
+				StartedAt time.Time
+				Message   string
+			}{State: state, StartedAt: startedAt}
+		}
+		return s
+	}
+
+	tests := []struct {
+		name           string
+		services       []swarmService
+		rollbackErr    error
+		wantRolledBack []string
+		wantErr        error
+	}{
+		{
+			name:     "updates completed",
+			services: []swarmService{service("web", "completed", since.Add(time.Second)), service("db", "", time.Time{})},
+		},
+		{
+			name:           "paused update rolled back",
+			services:       []swarmService{service("web", "paused", since.Add(time.Second)), service("db", "completed", since.Add(time.Second))},
+			wantRolledBack: []string{"web-id"},
+			wantErr:        errSwarmUpdateFailed,
+		},
+		{
+			name:     "paused before the deployment",
+			services: []swarmService{service("web", "paused", since.Add(-time.Minute))},
+		},
+		{
+			name:     "rolled back by Swarm",
+			services: []swarmService{service("web", "rollback_completed", since.Add(time.Second))},
+			wantErr:  errSwarmUpdateFailed,
+		},
+		{
+			name:           "rollback failure",
+			services:       []swarmService{service("web", "paused", since.Add(time.Second))},
+			rollbackErr:    errors.New("rpc error"),
+			wantRolledBack: []string{"web-id"},
+			wantErr:        errSwarmUpdateFailed,
+		},
+		{
+			name:     "rollback paused",
+			services: []swarmService{service("web", "rollback_paused", since.Add(time.Second))},
+			wantErr:  errSwarmUpdateFailed,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rolledBack := []string{}
+			err := rollBackFailedUpdates(tt.services, since, func(service swarmService) error {
+				rolledBack = append(rolledBack, service.ID)
+				return tt.rollbackErr
+			})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("rollBackFailedUpdates() error = %v, want %v", err, tt.wantErr)
+			}
+
+			if tt.wantRolledBack == nil {
+				tt.wantRolledBack = []string{}
+			}
+			if !reflect.DeepEqual(rolledBack, tt.wantRolledBack) {
+				t.Errorf("rolled back %v, want %v", rolledBack, tt.wantRolledBack)
+			}
+		})
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// swarmObjectVersionLabel holds the unversioned name of a secret or
+	// config rewritten by versionSwarmObjects
+	swarmObjectVersionLabel = "io.portainer.unpacker.version-of"
+	swarmObjectHashLength   = 8
+	// swarmObjectNameMinorVersion is the first 3.x compose file version
+	// supporting custom names for secrets and configs
+	swarmObjectNameMinorVersion = 5
+)
+
+// swarmObjectKinds are the top-level compose sections and the matching
+// docker object commands.
+var swarmObjectKinds = []string{"secret", "config"}
+
+// versionSwarmObjects rewrites the file-backed secrets and configs of the
+// compose files to content-hashed names, Swarm objects being immutable. The
+// relative file paths are resolved against the directory of the first compose
+// file, as docker stack deploy does. See rewriteComposeFiles for the returned
+// paths.
+func versionSwarmObjects(clonePath, projectName string, composeRelativeFilePaths []string) ([]string, error) {
+	if len(composeRelativeFilePaths) == 0 {
+		return composeRelativeFilePaths, nil
+	}
+	workingDir := filepath.Dir(filepath.Join(clonePath, filepath.FromSlash(composeRelativeFilePaths[0])))
+
+	return rewriteComposeFiles(clonePath, composeRelativeFilePaths, func(composeFilePath string, root *yaml.Node) (bool, error) {
+		changed := false
+		for _, kind := range swarmObjectKinds {
+			section := mappingValue(root, kind+"s")
+			if section == nil || section.Kind != yaml.MappingNode {
+				continue
+			}
+
+			for i := 0; i+1 < len(section.Content); i += 2 {
+				key, definition := section.Content[i].Value, section.Content[i+1]
+
+				versioned, err := versionSwarmObject(workingDir, projectName, kind, key, definition)
+				if err != nil {
+					return false, fmt.Errorf("failed to version %s %s: %w", kind, key, err)
+				}
+
+				changed = changed || versioned
+			}
+		}
+
+		if changed {
+			ensureComposeVersion(root, swarmObjectNameMinorVersion)
+		}
+
+		return changed, nil
+	})
+}
+
+// versionSwarmObject appends the hash of the file of a secret or config
+// definition to its name and records the unversioned name in a label. A
+// relative file path is resolved against workingDir.
+func versionSwarmObject(workingDir, projectName, kind, key string, definition *yaml.Node) (bool, error) {
+	if definition.Kind != yaml.MappingNode {
+		return false, nil
+	}
+
+	file := mappingValue(definition, "file")
+	if file == nil {
+		return false, nil
+	}
+
+	if strings.Contains(file.Value, "$") {
+		log.Warn().
+			Str(kind, key).
+			Str("file", file.Value).
+			Msg("Skipping versioning of an interpolated file path")
+		return false, nil
+	}
+
+	filePath := file.Value
+	if !filepath.IsAbs(filePath) {
+		filePath = filepath.Join(workingDir, filepath.FromSlash(filePath))
+	}
+
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		return false, err
+	}
+
+	sum := sha256.Sum256(content)
+	hash := hex.EncodeToString(sum[:])[:swarmObjectHashLength]
+
+	// Without a custom name, docker stack deploy prefixes the key with the
+	// stack namespace
+	baseName := projectName + "_" + key
+	if name := mappingValue(definition, "name"); name != nil {
+		baseName = name.Value
+	}
+
+	// A file rewritten by a previous run is already versioned
+	labels := mappingValue(definition, "labels")
+	if labels != nil && labels.Kind == yaml.MappingNode {
+		if versionOf := mappingValue(labels, swarmObjectVersionLabel); versionOf != nil {
+			baseName = versionOf.Value
+		}
+	}
+
+	name := baseName + "_" + hash
+	setMappingValue(definition, "name", stringNode(name))
+
+	switch {
+	case labels == nil:
+		labels = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+		setMappingValue(definition, "labels", labels)
+		fallthrough
+	case labels.Kind == yaml.MappingNode:
+		setMappingValue(labels, swarmObjectVersionLabel, stringNode(baseName))
+	case labels.Kind == yaml.SequenceNode:
+		labels.Content = append(labels.Content, stringNode(swarmObjectVersionLabel+"="+baseName))
+	}
+
+	log.Debug().
+		Str(kind, key).
+		Str("name", name).
+		Msg("Versioned Swarm object")
+
+	return true, nil
+}
+
+type swarmObject struct {
+	ID        string
+	CreatedAt time.Time
+	Spec      struct {
+		Name   string
+		Labels map[string]string
+	}
+}
+
+// pruneSwarmObjects removes the versioned secrets and configs of the stack
+// which are no longer referenced by any of its services, keeping the
+// retention most recent superseded versions of each object.
+func pruneSwarmObjects(projectName string, retention int) error {
+	referenced, err := referencedSwarmObjects(projectName)
+	if err != nil {
+		return err
+	}
+
+	for _, kind := range swarmObjectKinds {
+		objects, err := inspectSwarmObjects(kind, projectName)
+		if err != nil {
+			return err
+		}
+
+		versions := make(map[string][]swarmObject)
+		for _, object := range objects {
+			if _, ok := referenced[kind+"/"+object.Spec.Name]; ok {
+				continue
+			}
+
+			baseName := object.Spec.Labels[swarmObjectVersionLabel]
+			versions[baseName] = append(versions[baseName], object)
+		}
+
+		for baseName, superseded := range versions {
+			sort.Slice(superseded, func(i, j int) bool {
+				return superseded[i].CreatedAt.After(superseded[j].CreatedAt)
+			})
+
+			if len(superseded) <= retention {
+				continue
+			}
+
+			for _, object := range superseded[retention:] {
+				log.Info().
+					Str(kind, object.Spec.Name).
+					Str("versionOf", baseName).
+					Msg("Removing superseded Swarm object")
+
+				_, err := runCommand(getDockerBinaryPath(), []string{"--config", PORTAINER_DOCKER_CONFIG_PATH, kind, "rm", object.ID})
+				if err != nil {
+					log.Warn().
+						Err(err).
+						Str(kind, object.Spec.Name).
+						Msg("Failed to remove superseded Swarm object")
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// referencedSwarmObjects returns the "kind/name" of the secrets and configs
+// used by the current and previous specs of the services of the stack, the
+// previous ones being needed for a rollback.
+func referencedSwarmObjects(projectName string) (map[string]struct{}, error) {
+	services, err := inspectStackServices(projectName)
+	if err != nil {
+		return nil, err
+	}
+
+	referenced := make(map[string]struct{})
+	for _, service := range services {
+		specs := []swarmServiceSpec{service.Spec}
+		if service.PreviousSpec != nil {
+			specs = append(specs, *service.PreviousSpec)
+		}
+
+		for _, spec := range specs {
+			for _, secret := range spec.TaskTemplate.ContainerSpec.Secrets {
+				referenced["secret/"+secret.SecretName] = struct{}{}
+			}
+			for _, config := range spec.TaskTemplate.ContainerSpec.Configs {
+				referenced["config/"+config.ConfigName] = struct{}{}
+			}
+		}
+	}
+
+	return referenced, nil
+}
+
+// inspectSwarmObjects returns the versioned secrets or configs of the stack.
+func inspectSwarmObjects(kind, projectName string) ([]swarmObject, error) {
+	command := getDockerBinaryPath()
+
+	output, err := runCommand(command, []string{
+		"--config", PORTAINER_DOCKER_CONFIG_PATH, kind, "ls", "-q",
+		"--filter", fmt.Sprintf("label=%s=%s", swarmStackNamespaceLabel, projectName),
+		"--filter", "label=" + swarmObjectVersionLabel,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ids := splitLines(output)
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	output, err = runCommand(command, append([]string{"--config", PORTAINER_DOCKER_CONFIG_PATH, kind, "inspect"}, ids...))
+	if err != nil {
+		return nil, err
+	}
+
+	var objects []swarmObject
+	err = json.Unmarshal([]byte(output), &objects)
+	return objects, err
+}
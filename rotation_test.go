@@ -0,0 +1,68 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"path/filepath"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestVersionSwarmObjects(t *testing.T) {
+	hash := func(content string) string {
+		sum := sha256.Sum256([]byte(content))
+		return hex.EncodeToString(sum[:])[:swarmObjectHashLength]
+	}
+
+	// The relative paths of every compose file are resolved against the
+	// directory of the first one
+	clonePath := writeTestFiles(t, t.TempDir(), map[string]string{
+		"stack/docker-compose.yml":  "version: \"3.8\"\nservices:\n  web:\n    image: nginx\nsecrets:\n  key:\n    file: ./secrets/key\n",
+		"overrides/prod.yml":        "version: \"3.8\"\nconfigs:\n  nginx:\n    file: ./conf/nginx.conf\n    name: nginx-conf\n",
+		"stack/secrets/key":         "stack key",
+		"stack/conf/nginx.conf":     "stack conf",
+		"overrides/conf/nginx.conf": "override conf",
+		"overrides/secrets/key":     "override key",
+	})
+
+	paths, err := versionSwarmObjects(clonePath, "web", []string{"stack/docker-compose.yml", "overrides/prod.yml"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		"secrets.key":   "web_key_" + hash("stack key"),
+		"configs.nginx": "nginx-conf_" + hash("stack conf"),
+	}
+
+	got := make(map[string]string)
+	for _, p := range paths {
+		document, err := parseComposeFile(filepath.Join(clonePath, p))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, section := range []string{"secrets", "configs"} {
+			objects := mappingValue(document.Content[0], section)
+			if objects == nil {
+				continue
+			}
+
+			for i := 0; i+1 < len(objects.Content); i += 2 {
+				if name := mappingValue(objects.Content[i+1], "name"); name != nil {
+					got[section+"."+objects.Content[i].Value] = name.Value
+				}
+				if labels := mappingValue(objects.Content[i+1], "labels"); labels == nil || labels.Kind != yaml.MappingNode {
+					t.Errorf("%s %s has no version label", section, objects.Content[i].Value)
+				}
+			}
+		}
+	}
+
+	for key, name := range want {
+		if got[key] != name {
+			t.Errorf("name of %s = %s, want %s", key, got[key], name)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	sourceTypeAuto    = "auto"
+	sourceTypeGit     = "git"
+	sourceTypeArchive = "archive"
+	sourceTypeLocal   = "local"
+	sourceTypeOCI     = "oci"
+)
+
+var (
+	errInvalidSource     = errors.New("invalid stack source")
+	archiveFileSuffixes  = []string{".tar.gz", ".tgz", ".zip"}
+	errUnsupportedSource = errors.New("unsupported stack source type")
+)
+
+// Source materializes the files of a stack on disk.
+type Source interface {
+	// Name is the name of the directory the source is unpacked into, inside
+	// the stack directory
+	Name() string
+	// Fetch writes the content of the source into clonePath
+	Fetch(ctx context.Context, clonePath string) error
+}
+
+// SourceConfig describes where the stack files come from.
+type SourceConfig struct {
+	// Type is one of the sourceType* constants
+	Type     string
+	Location string
+	// SHA256 is the expected checksum of an archive, checked when set
+	SHA256 string
+	// StripComponents is the number of leading path elements removed from
+	// the archive entries
+	StripComponents int
+	// Registries are the --registry credentials used by OCI sources
+	Registries []string
+	Git        GitCloneConfig
+}
+
+func (cmd *DeployCommand) source() (Source, error) {
+	if cmd.FromBundle != "" {
+		return newBundleSource(cmd.FromBundle)
+	}
+
+	return newSource(SourceConfig{
+		Type:            cmd.Source,
+		Location:        cmd.GitRepository,
+		SHA256:          cmd.SHA256,
+		StripComponents: cmd.StripComponents,
+		Registries:      cmd.Registry,
+		Git:             cmd.gitCloneConfig(),
+	})
+}
+
+func (cmd *SwarmDeployCommand) source() (Source, error) {
+	return newSource(SourceConfig{
+		Type:            cmd.Source,
+		Location:        cmd.GitRepository,
+		SHA256:          cmd.SHA256,
+		StripComponents: cmd.StripComponents,
+		Registries:      cmd.Registry,
+		Git:             cmd.gitCloneConfig(),
+	})
+}
+
+// newSource returns the Source matching cfg. The auto type picks an OCI
+// source for oci:// references, an archive source for HTTP(S) URLs ending
+// with an archive suffix, a local source for existing paths that are not Git
+// repositories and Git otherwise.
+func newSource(cfg SourceConfig) (Source, error) {
+	sourceType := cfg.Type
+	if sourceType == sourceTypeAuto || sourceType == "" {
+		sourceType = detectSourceType(cfg.Location)
+	}
+
+	log.Debug().
+		Str("location", cfg.Location).
+		Str("type", sourceType).
+		Msg("Resolved stack source")
+
+	switch sourceType {
+	case sourceTypeGit:
+		i := strings.LastIndex(cfg.Location, "/")
+		if i == -1 {
+			return nil, fmt.Errorf("%w: invalid Git repository URL %q", errInvalidSource, cfg.Location)
+		}
+
+		return &gitSource{
+			name: strings.TrimSuffix(cfg.Location[i+1:], ".git"),
+			cfg:  cfg.Git,
+		}, nil
+	case sourceTypeArchive:
+		if !isHTTPURL(cfg.Location) {
+			return nil, fmt.Errorf("%w: archive sources must be HTTP(S) URLs", errInvalidSource)
+		}
+
+		return &archiveSource{
+			url:             cfg.Location,
+			sha256:          cfg.SHA256,
+			stripComponents: cfg.StripComponents,
+			transport:       cfg.Git.Transport,
+		}, nil
+	case sourceTypeLocal:
+		return &localSource{
+			path:            cfg.Location,
+			sha256:          cfg.SHA256,
+			stripComponents: cfg.StripComponents,
+		}, nil
+	case sourceTypeOCI:
+		return newOCISource(cfg.Location, cfg.Registries, cfg.Git.Transport)
+	}
+
+	return nil, fmt.Errorf("%w: %q", errUnsupportedSource, sourceType)
+}
+
+func detectSourceType(location string) string {
+	if strings.HasPrefix(location, ociSourcePrefix) {
+		return sourceTypeOCI
+	}
+
+	if isHTTPURL(location) {
+		if archiveSuffix(location) != "" {
+			return sourceTypeArchive
+		}
+		return sourceTypeGit
+	}
+
+	info, err := os.Stat(location)
+	if err != nil {
+		return sourceTypeGit
+	}
+
+	if info.IsDir() {
+		if _, err := os.Stat(filepath.Join(location, ".git")); err == nil {
+			return sourceTypeGit
+		}
+	}
+
+	return sourceTypeLocal
+}
+
+func isHTTPURL(location string) bool {
+	return strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://")
+}
+
+// archiveSuffix returns the archive suffix of location, ignoring any query
+// string, or an empty string when it is not an archive.
+func archiveSuffix(location string) string {
+	location, _, _ = strings.Cut(location, "?")
+
+	for _, suffix := range archiveFileSuffixes {
+		if strings.HasSuffix(strings.ToLower(location), suffix) {
+			return suffix
+		}
+	}
+
+	return ""
+}
+
+// archiveName strips the directories and the archive suffix of location.
+func archiveName(location string) string {
+	location, _, _ = strings.Cut(location, "?")
+	name := location[strings.LastIndexAny(location, `/\`)+1:]
+
+	return name[:len(name)-len(archiveSuffix(name))]
+}
+
+// gitSource clones a Git repository, this is the historical behavior of the
+// unpacker.
+type gitSource struct {
+	name string
+	cfg  GitCloneConfig
+}
+
+func (s *gitSource) Name() string {
+	return s.name
+}
+
+func (s *gitSource) Fetch(ctx context.Context, clonePath string) error {
+	if s.cfg.User != "" && s.cfg.Password != "" {
+		log.Info().
+			Str("user", s.cfg.User).
+			Msg("Using Git authentication")
+	}
+
+	return cloneRepository(ctx, clonePath, s.cfg)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// stackStateFile is written in the stack directory, next to the stack
+// sources, so that later commands know how the stack was deployed.
+const stackStateFile = ".unpacker-state.json"
+
+// stackState records how a stack was deployed.
+type stackState struct {
+	// Directory is the name of the directory holding the stack sources,
+	// inside the stack directory
+	Directory string `json:"directory"`
+	// ComposeFiles are relative to Directory
+	ComposeFiles []string `json:"composeFiles"`
+	// WorkingDir is relative to Directory
+	WorkingDir string   `json:"workingDir,omitempty"`
+	Profiles   []string `json:"profiles,omitempty"`
+}
+
+func writeStackState(mountPath string, state stackState) error {
+	content, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(filepath.Join(mountPath, stackStateFile), content, 0644)
+}
+
+// readStackState returns the state recorded in mountPath, or nil when the
+// stack was deployed without one.
+func readStackState(mountPath string) (*stackState, error) {
+	content, err := os.ReadFile(filepath.Join(mountPath, stackStateFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var state stackState
+	err = json.Unmarshal(content, &state)
+	if err != nil {
+		return nil, err
+	}
+
+	return &state, nil
+}
@@ -1,9 +1,13 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"path"
 	"runtime"
 	"strings"
+	"time"
 
 	"github.com/rs/zerolog/log"
 )
@@ -45,6 +49,154 @@ func deploySwarmStack(cmd SwarmDeployCommand, clonePath string) error {
 	return err
 }
 
+const (
+	swarmStackNamespaceLabel = "com.docker.stack.namespace"
+	swarmRemovalPollInterval = 2 * time.Second
+)
+
+var errSwarmStackRemovalTimeout = errors.New("timed out waiting for the Swarm stack removal")
+
+// swarmStackResourceTypes are the docker commands listing the resources
+// created by docker stack deploy, filtered by the namespace label unless
+// byName is set. Tasks are listed from the managers, the containers of the
+// other nodes being invisible to the local daemon.
+var swarmStackResourceTypes = []struct {
+	kind   string
+	args   []string
+	byName bool
+}{
+	{kind: "services", args: []string{"service", "ls", "-q"}},
+	{kind: "tasks", args: []string{"stack", "ps", "-q"}, byName: true},
+	{kind: "networks", args: []string{"network", "ls", "-q"}},
+	{kind: "secrets", args: []string{"secret", "ls", "-q"}},
+	{kind: "configs", args: []string{"config", "ls", "-q"}},
+}
+
+// swarmStackResources returns the IDs of the resources of the stack, by
+// resource type. Types without resources are omitted.
+func swarmStackResources(projectName string) (map[string][]string, error) {
+	command := getDockerBinaryPath()
+	filter := fmt.Sprintf("label=%s=%s", swarmStackNamespaceLabel, projectName)
+
+	resources := make(map[string][]string)
+	for _, resourceType := range swarmStackResourceTypes {
+		args := append([]string{"--config", PORTAINER_DOCKER_CONFIG_PATH}, resourceType.args...)
+		if resourceType.byName {
+			args = append(args, projectName)
+		} else {
+			args = append(args, "--filter", filter)
+		}
+
+		output, err := runCommand(command, args)
+		if err != nil && resourceType.byName && strings.Contains(err.Error(), "nothing found in stack") {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if ids := splitLines(output); len(ids) > 0 {
+			resources[resourceType.kind] = ids
+		}
+	}
+
+	return resources, nil
+}
+
+// waitForSwarmStackRemoval waits until no resource is left in the namespace
+// of the stack, docker stack rm returning before the tasks and networks are
+// actually removed.
+func waitForSwarmStackRemoval(cmdCtx *CommandExecutionContext, projectName string, timeout time.Duration) error {
+	log.Info().
+		Str("projectName", projectName).
+		Dur("timeout", timeout).
+		Msg("Waiting for the Swarm stack removal")
+
+	deadline := time.Now().Add(timeout)
+	for {
+		resources, err := swarmStackResources(projectName)
+		if err != nil {
+			log.Error().
+				Err(err).
+				Msg("Failed to list Swarm stack resources")
+			return err
+		}
+
+		if len(resources) == 0 {
+			log.Info().Msg("Swarm stack removal complete")
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			event := log.Error()
+			for kind, ids := range resources {
+				event = event.Strs(kind, ids)
+			}
+			event.Msg("Swarm stack resources left after removal")
+
+			return fmt.Errorf("%w %q after %s", errSwarmStackRemovalTimeout, projectName, timeout)
+		}
+
+		log.Debug().
+			Interface("resources", resources).
+			Msg("Swarm stack resources still present")
+
+		select {
+		case <-cmdCtx.context.Done():
+			return cmdCtx.context.Err()
+		case <-time.After(swarmRemovalPollInterval):
+		}
+	}
+}
+
+type swarmServiceSpec struct {
+	Name         string
+	TaskTemplate struct {
+		ContainerSpec struct {
+			Image   string
+			Secrets []struct{ SecretName string }
+			Configs []struct{ ConfigName string }
+		}
+	}
+}
+
+type swarmService struct {
+	ID           string
+	Spec         swarmServiceSpec
+	PreviousSpec *swarmServiceSpec
+	UpdateStatus *struct {
+		State     string
+		StartedAt time.Time
+		Message   string
+	}
+}
+
+// inspectStackServices returns the services labeled with the namespace of
+// the stack.
+func inspectStackServices(projectName string) ([]swarmService, error) {
+	command := getDockerBinaryPath()
+	filter := fmt.Sprintf("label=%s=%s", swarmStackNamespaceLabel, projectName)
+
+	output, err := runCommand(command, []string{"--config", PORTAINER_DOCKER_CONFIG_PATH, "service", "ls", "-q", "--filter", filter})
+	if err != nil {
+		return nil, err
+	}
+
+	serviceIDs := splitLines(output)
+	if len(serviceIDs) == 0 {
+		return nil, nil
+	}
+
+	output, err = runCommand(command, append([]string{"--config", PORTAINER_DOCKER_CONFIG_PATH, "service", "inspect"}, serviceIDs...))
+	if err != nil {
+		return nil, err
+	}
+
+	var services []swarmService
+	err = json.Unmarshal([]byte(output), &services)
+	return services, err
+}
+
 func checkRunningService(projectName string) ([]string, error) {
 	command := getDockerBinaryPath()
 	args := []string{"--config", PORTAINER_DOCKER_CONFIG_PATH, "stack", "services", "--format={{.ID}}", projectName}
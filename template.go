@@ -0,0 +1,415 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"text/template"
+	"text/template/parse"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/text/cases"
+	"golang.org/x/text/language"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	templateFileSuffix    = ".tmpl"
+	renderedFileExtension = ".rendered"
+)
+
+var errTemplateRequired = errors.New("required template value")
+
+// renderTemplates renders the compose files ending with .tmpl and the
+// templateFiles, relative to the clone root, with the merged values files.
+// The rendered files are written beside their templates, see renderedPath,
+// and the compose file paths are returned with the rendered compose files in
+// place of their templates.
+func renderTemplates(clonePath string, composeRelativeFilePaths, templateFiles, valuesFiles, env []string) ([]string, error) {
+	values, err := loadTemplateValues(clonePath, valuesFiles)
+	if err != nil {
+		return nil, err
+	}
+
+	vars := templateEnv(env)
+	data := map[string]interface{}{
+		"Values": values,
+		"Env":    vars,
+	}
+	funcs := templateFuncs(vars)
+
+	explicit := make(map[string]struct{}, len(templateFiles))
+	for _, templateFile := range templateFiles {
+		explicit[path.Clean(templateFile)] = struct{}{}
+	}
+
+	renderedFilePaths := make([]string, len(composeRelativeFilePaths))
+	for i, composeRelativeFilePath := range composeRelativeFilePaths {
+		renderedFilePaths[i] = composeRelativeFilePath
+
+		_, ok := explicit[path.Clean(composeRelativeFilePath)]
+		if !ok && !strings.HasSuffix(composeRelativeFilePath, templateFileSuffix) {
+			continue
+		}
+
+		renderedFilePaths[i], err = renderTemplateFile(clonePath, composeRelativeFilePath, data, funcs)
+		if err != nil {
+			return nil, err
+		}
+		delete(explicit, path.Clean(composeRelativeFilePath))
+	}
+
+	// Other templates, e.g. configuration files referenced by the stack
+	for _, templateFile := range templateFiles {
+		if _, ok := explicit[path.Clean(templateFile)]; !ok {
+			continue
+		}
+
+		_, err = renderTemplateFile(clonePath, templateFile, data, funcs)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return renderedFilePaths, nil
+}
+
+func renderTemplateFile(clonePath, relativePath string, data map[string]interface{}, funcs template.FuncMap) (string, error) {
+	err := checkPathInside(clonePath, relativePath)
+	if err != nil {
+		return "", fmt.Errorf("template %q: %w", relativePath, err)
+	}
+
+	sourcePath := filepath.Join(clonePath, filepath.FromSlash(relativePath))
+
+	content, err := os.ReadFile(sourcePath)
+	if err != nil {
+		return "", err
+	}
+
+	// Missing values render as empty strings, as with Helm, the required
+	// function makes them mandatory
+	tmpl, err := template.New(relativePath).
+		Option("missingkey=zero").
+		Funcs(funcs).
+		Parse(string(content))
+	if err != nil {
+		return "", err
+	}
+	printMissingAsEmpty(tmpl)
+
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, data)
+	if err != nil {
+		return "", err
+	}
+	rendered := buf.String()
+
+	// The rendered file may already exist in the repository as a link
+	renderedRelativePath := renderedPath(relativePath)
+	err = checkPathInside(clonePath, renderedRelativePath)
+	if err != nil {
+		return "", fmt.Errorf("rendered template %q: %w", renderedRelativePath, err)
+	}
+
+	err = os.WriteFile(filepath.Join(clonePath, filepath.FromSlash(renderedRelativePath)), []byte(rendered), 0644)
+	if err != nil {
+		return "", err
+	}
+
+	log.Info().
+		Str("template", relativePath).
+		Str("rendered", renderedRelativePath).
+		Msg("Rendered template")
+
+	return renderedRelativePath, nil
+}
+
+// templateFilePaths returns the template files relative to the clone root.
+func templateFilePaths(workdir string, templateFiles []string) []string {
+	paths := make([]string, len(templateFiles))
+	for i, templateFile := range templateFiles {
+		paths[i] = path.Join(workdir, templateFile)
+	}
+
+	return paths
+}
+
+// renderedPath returns the path of the file rendered from the template at p:
+// the .tmpl suffix is removed, and files without it get a .rendered infix,
+// e.g. compose.yml.tmpl gives compose.yml and compose.yml gives
+// compose.rendered.yml.
+func renderedPath(p string) string {
+	if strings.HasSuffix(p, templateFileSuffix) {
+		return strings.TrimSuffix(p, templateFileSuffix)
+	}
+
+	ext := path.Ext(p)
+	return strings.TrimSuffix(p, ext) + renderedFileExtension + ext
+}
+
+// loadTemplateValues merges the values files, the later ones overriding the
+// earlier ones. Relative paths are looked up in the clone first and on disk
+// otherwise.
+func loadTemplateValues(clonePath string, valuesFiles []string) (map[string]interface{}, error) {
+	values := map[string]interface{}{}
+
+	for _, valuesFile := range valuesFiles {
+		valuesPath := valuesFile
+		if !filepath.IsAbs(valuesFile) {
+			clonedPath := filepath.Join(clonePath, filepath.FromSlash(valuesFile))
+			if _, err := os.Stat(clonedPath); err == nil && isWithin(clonePath, clonedPath) {
+				valuesPath = clonedPath
+			}
+		}
+
+		content, err := os.ReadFile(valuesPath)
+		if err != nil {
+			return nil, err
+		}
+
+		var fileValues map[string]interface{}
+		err = yaml.Unmarshal(content, &fileValues)
+		if err != nil {
+			return nil, fmt.Errorf("invalid values file %s: %w", valuesFile, err)
+		}
+
+		log.Debug().
+			Str("path", valuesPath).
+			Msg("Loaded template values")
+
+		mergeValues(values, fileValues)
+	}
+
+	return values, nil
+}
+
+func mergeValues(dst, src map[string]interface{}) {
+	for key, value := range src {
+		srcMap, srcOk := value.(map[string]interface{})
+		dstMap, dstOk := dst[key].(map[string]interface{})
+		if srcOk && dstOk {
+			mergeValues(dstMap, srcMap)
+			continue
+		}
+
+		dst[key] = value
+	}
+}
+
+// templateEnv returns the process environment overridden by the --env
+// entries of the stack.
+func templateEnv(env []string) map[string]string {
+	vars := make(map[string]string)
+	for _, entry := range append(os.Environ(), env...) {
+		if key, value, ok := strings.Cut(entry, "="); ok {
+			vars[key] = value
+		}
+	}
+
+	return vars
+}
+
+// templateFuncs returns the functions available to the templates, a subset
+// of the sprig functions commonly used in compose and Helm templates. The env
+// function reads vars.
+func templateFuncs(vars map[string]string) template.FuncMap {
+	return template.FuncMap{
+		"default": func(def interface{}, value ...interface{}) interface{} {
+			if len(value) == 0 || isEmptyValue(value[0]) {
+				return def
+			}
+			return value[0]
+		},
+		"required": func(msg string, value interface{}) (interface{}, error) {
+			if isEmptyValue(value) {
+				return nil, fmt.Errorf("%w: %s", errTemplateRequired, msg)
+			}
+			return value, nil
+		},
+		"empty": isEmptyValue,
+		"coalesce": func(values ...interface{}) interface{} {
+			for _, value := range values {
+				if !isEmptyValue(value) {
+					return value
+				}
+			}
+			return nil
+		},
+		"ternary": func(yes, no interface{}, condition bool) interface{} {
+			if condition {
+				return yes
+			}
+			return no
+		},
+		"env": func(key string) string { return vars[key] },
+
+		"toString":   toString,
+		"quote":      func(value interface{}) string { return strconv.Quote(toString(value)) },
+		"squote":     func(value interface{}) string { return "'" + toString(value) + "'" },
+		"upper":      strings.ToUpper,
+		"lower":      strings.ToLower,
+		"title":      cases.Title(language.Und, cases.NoLower).String,
+		"trim":       strings.TrimSpace,
+		"trimPrefix": func(prefix, s string) string { return strings.TrimPrefix(s, prefix) },
+		"trimSuffix": func(suffix, s string) string { return strings.TrimSuffix(s, suffix) },
+		"replace":    func(old, new, s string) string { return strings.ReplaceAll(s, old, new) },
+		"contains":   func(substr, s string) bool { return strings.Contains(s, substr) },
+		"hasPrefix":  func(prefix, s string) bool { return strings.HasPrefix(s, prefix) },
+		"hasSuffix":  func(suffix, s string) bool { return strings.HasSuffix(s, suffix) },
+		"split":      func(sep, s string) []string { return strings.Split(s, sep) },
+		"join": func(sep string, values interface{}) string {
+			parts := []string{}
+			for _, value := range toList(values) {
+				parts = append(parts, toString(value))
+			}
+			return strings.Join(parts, sep)
+		},
+		"repeat": func(count int, s string) string { return strings.Repeat(s, count) },
+		"indent": func(spaces int, s string) string {
+			padding := strings.Repeat(" ", spaces)
+			return padding + strings.ReplaceAll(s, "\n", "\n"+padding)
+		},
+		"nindent": func(spaces int, s string) string {
+			padding := strings.Repeat(" ", spaces)
+			return "\n" + padding + strings.ReplaceAll(s, "\n", "\n"+padding)
+		},
+
+		"list": func(values ...interface{}) []interface{} { return values },
+		"dict": func(pairs ...interface{}) (map[string]interface{}, error) {
+			if len(pairs)%2 != 0 {
+				return nil, errors.New("dict requires key and value pairs")
+			}
+			dict := make(map[string]interface{}, len(pairs)/2)
+			for i := 0; i < len(pairs); i += 2 {
+				dict[toString(pairs[i])] = pairs[i+1]
+			}
+			return dict, nil
+		},
+		"hasKey": func(dict map[string]interface{}, key string) bool {
+			_, ok := dict[key]
+			return ok
+		},
+
+		"toYaml": func(value interface{}) (string, error) {
+			content, err := yaml.Marshal(value)
+			return strings.TrimSuffix(string(content), "\n"), err
+		},
+		"toJson": func(value interface{}) (string, error) {
+			content, err := json.Marshal(value)
+			return string(content), err
+		},
+		"b64enc": func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) },
+		"b64dec": func(s string) (string, error) {
+			content, err := base64.StdEncoding.DecodeString(s)
+			return string(content), err
+		},
+		"sha256sum": func(s string) string {
+			sum := sha256.Sum256([]byte(s))
+			return hex.EncodeToString(sum[:])
+		},
+	}
+}
+
+func isEmptyValue(value interface{}) bool {
+	if value == nil {
+		return true
+	}
+
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Ptr, reflect.Interface:
+		return v.IsNil()
+	}
+
+	return false
+}
+
+func toString(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case fmt.Stringer:
+		return v.String()
+	}
+
+	return fmt.Sprint(value)
+}
+
+func toList(value interface{}) []interface{} {
+	v := reflect.ValueOf(value)
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return []interface{}{value}
+	}
+
+	list := make([]interface{}, v.Len())
+	for i := 0; i < v.Len(); i++ {
+		list[i] = v.Index(i).Interface()
+	}
+
+	return list
+}
+
+// printMissingAsEmpty pipes the output of the actions of tmpl to toString.
+// Missing map keys evaluate to nil with missingkey=zero, which text/template
+// prints as "<no value>".
+func printMissingAsEmpty(tmpl *template.Template) {
+	for _, t := range tmpl.Templates() {
+		if t.Tree != nil {
+			printMissingAsEmptyIn(t.Tree, t.Tree.Root)
+		}
+	}
+}
+
+func printMissingAsEmptyIn(tree *parse.Tree, node parse.Node) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, child := range n.Nodes {
+			printMissingAsEmptyIn(tree, child)
+		}
+	case *parse.ActionNode:
+		// Declarations print nothing
+		if len(n.Pipe.Decl) > 0 {
+			return
+		}
+
+		identifier := parse.NewIdentifier("toString").SetTree(tree).SetPos(n.Pos)
+		n.Pipe.Cmds = append(n.Pipe.Cmds, &parse.CommandNode{NodeType: parse.NodeCommand, Pos: n.Pos, Args: []parse.Node{identifier}})
+	case *parse.IfNode:
+		printMissingAsEmptyIn(tree, n.List)
+		printMissingAsEmptyIn(tree, n.ElseList)
+	case *parse.RangeNode:
+		printMissingAsEmptyIn(tree, n.List)
+		printMissingAsEmptyIn(tree, n.ElseList)
+	case *parse.WithNode:
+		printMissingAsEmptyIn(tree, n.List)
+		printMissingAsEmptyIn(tree, n.ElseList)
+	}
+}
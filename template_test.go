@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRenderTemplates(t *testing.T) {
+	values := "image: nginx\nreplicas: 2\nports: [80, 443]\nname: web server\n"
+
+	tests := []struct {
+		name     string
+		template string
+		want     string
+		wantErr  error
+	}{
+		{name: "value", template: "image: {{ .Values.image }}", want: "image: nginx"},
+		{name: "missing value", template: "tag: {{ .Values.tag }}", want: "tag: "},
+		{name: "missing value in range", template: "{{ range .Values.ports }}{{ $.Values.prefix }}{{ . }} {{ end }}", want: "80 443 "},
+		{name: "missing value in if", template: "{{ if .Values.image }}[{{ .Values.tag }}]{{ end }}", want: "[]"},
+		{name: "default", template: "tag: {{ .Values.tag | default \"latest\" }}", want: "tag: latest"},
+		{name: "literal no value text", template: "# <no value> stays {{ .Values.replicas }}", want: "# <no value> stays 2"},
+		{name: "declaration", template: "{{ $image := .Values.image }}{{ $image }}", want: "nginx"},
+		{name: "environment", template: "{{ .Env.STACK }} {{ env \"MISSING\" }}.", want: "prod ."},
+		{name: "title", template: "{{ .Values.name | title }}", want: "Web Server"},
+		{name: "required", template: "{{ required \"tag is required\" .Values.tag }}", wantErr: errTemplateRequired},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clonePath := writeTestFiles(t, t.TempDir(), map[string]string{
+				"values.yml":              values,
+				"docker-compose.yml.tmpl": tt.template,
+			})
+
+			paths, err := renderTemplates(clonePath, []string{"docker-compose.yml.tmpl"}, nil, []string{"values.yml"}, []string{"STACK=prod"})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("renderTemplates() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			if len(paths) != 1 || paths[0] != "docker-compose.yml" {
+				t.Fatalf("renderTemplates() = %v, want [docker-compose.yml]", paths)
+			}
+
+			rendered, err := os.ReadFile(filepath.Join(clonePath, "docker-compose.yml"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(rendered) != tt.want {
+				t.Errorf("rendered %q, want %q", rendered, tt.want)
+			}
+		})
+	}
+}
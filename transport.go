@@ -0,0 +1,265 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/go-git/go-git/v5/plumbing/transport/client"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/net/http/httpproxy"
+)
+
+// dockerCertsDir is where the Docker daemon looks up the CAs of the
+// registries, per registry host. It must be mounted from the host for the
+// daemon to see the installed CAs.
+var dockerCertsDir = "/etc/docker/certs.d"
+
+var errInvalidCABundle = errors.New("no PEM certificates found in CA bundle")
+
+// TransportOptions holds the TLS and proxy settings shared by every outgoing
+// HTTP(S) connection made by the unpacker (Git remotes and registries).
+type TransportOptions struct {
+	CAFile        string
+	SkipTLSVerify bool
+	HTTPProxy     string
+	HTTPSProxy    string
+	NoProxy       string
+}
+
+func (cmd *DeployCommand) transportOptions() TransportOptions {
+	return TransportOptions{
+		CAFile:        cmd.CAFile,
+		SkipTLSVerify: cmd.SkipTLSVerify,
+		HTTPProxy:     cmd.HTTPProxy,
+		HTTPSProxy:    cmd.HTTPSProxy,
+		NoProxy:       cmd.NoProxy,
+	}
+}
+
+func (cmd *SwarmDeployCommand) transportOptions() TransportOptions {
+	return TransportOptions{
+		CAFile:        cmd.CAFile,
+		SkipTLSVerify: cmd.SkipTLSVerify,
+		HTTPProxy:     cmd.HTTPProxy,
+		HTTPSProxy:    cmd.HTTPSProxy,
+		NoProxy:       cmd.NoProxy,
+	}
+}
+
+func (cmd *UpdateLockCommand) transportOptions() TransportOptions {
+	return TransportOptions{
+		CAFile:        cmd.CAFile,
+		SkipTLSVerify: cmd.SkipTLSVerify,
+		HTTPProxy:     cmd.HTTPProxy,
+		HTTPSProxy:    cmd.HTTPSProxy,
+		NoProxy:       cmd.NoProxy,
+	}
+}
+
+func (cmd *CheckUpdatesCommand) transportOptions() TransportOptions {
+	return TransportOptions{
+		CAFile:        cmd.CAFile,
+		SkipTLSVerify: cmd.SkipTLSVerify,
+		HTTPProxy:     cmd.HTTPProxy,
+		HTTPSProxy:    cmd.HTTPSProxy,
+		NoProxy:       cmd.NoProxy,
+	}
+}
+
+func (cmd *PushCommand) transportOptions() TransportOptions {
+	return TransportOptions{
+		CAFile:        cmd.CAFile,
+		SkipTLSVerify: cmd.SkipTLSVerify,
+		HTTPProxy:     cmd.HTTPProxy,
+		HTTPSProxy:    cmd.HTTPSProxy,
+		NoProxy:       cmd.NoProxy,
+	}
+}
+
+// newHTTPClient builds an HTTP client trusting the system pool plus the
+// optional CA bundle and routing requests through the configured proxies.
+// Proxy flags take precedence over the HTTP_PROXY/HTTPS_PROXY/NO_PROXY
+// environment variables.
+func newHTTPClient(opts TransportOptions) (*http.Client, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: opts.SkipTLSVerify,
+	}
+
+	if opts.CAFile != "" {
+		bundle, err := os.ReadFile(opts.CAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		rootCAs, _ := x509.SystemCertPool()
+		if rootCAs == nil {
+			rootCAs = x509.NewCertPool()
+		}
+
+		if !rootCAs.AppendCertsFromPEM(bundle) {
+			return nil, errInvalidCABundle
+		}
+
+		tlsConfig.RootCAs = rootCAs
+	}
+
+	proxy := opts.proxyConfig().ProxyFunc()
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	transport.Proxy = func(req *http.Request) (*url.URL, error) {
+		return proxy(req.URL)
+	}
+
+	return &http.Client{Transport: transport}, nil
+}
+
+func (opts TransportOptions) proxyConfig() *httpproxy.Config {
+	config := httpproxy.FromEnvironment()
+	if opts.HTTPProxy != "" {
+		config.HTTPProxy = opts.HTTPProxy
+	}
+	if opts.HTTPSProxy != "" {
+		config.HTTPSProxy = opts.HTTPSProxy
+	}
+	if opts.NoProxy != "" {
+		config.NoProxy = opts.NoProxy
+	}
+
+	return config
+}
+
+// proxyEnv returns the proxy settings as environment variables so that they
+// can be forwarded to the docker binaries.
+func (opts TransportOptions) proxyEnv() []string {
+	config := opts.proxyConfig()
+
+	env := []string{}
+	if config.HTTPProxy != "" {
+		env = append(env, "HTTP_PROXY="+config.HTTPProxy, "http_proxy="+config.HTTPProxy)
+	}
+	if config.HTTPSProxy != "" {
+		env = append(env, "HTTPS_PROXY="+config.HTTPSProxy, "https_proxy="+config.HTTPSProxy)
+	}
+	if config.NoProxy != "" {
+		env = append(env, "NO_PROXY="+config.NoProxy, "no_proxy="+config.NoProxy)
+	}
+
+	return env
+}
+
+// configureGitTransport replaces the go-git HTTP(S) transports with one built
+// from the given options. TLS verification is handled by the installed client,
+// so InsecureSkipTLS must not be set on the clone options afterwards.
+func configureGitTransport(opts TransportOptions) error {
+	httpClient, err := newHTTPClient(opts)
+	if err != nil {
+		log.Error().
+			Err(err).
+			Str("caFile", opts.CAFile).
+			Msg("Failed to configure Git HTTP transport")
+		return err
+	}
+
+	gitClient := githttp.NewClient(httpClient)
+	client.InstallProtocol("http", gitClient)
+	client.InstallProtocol("https", gitClient)
+
+	return nil
+}
+
+// installRegistryCA copies the CA bundle to the Docker certificates directory
+// of each registry host, the registry connections of docker login and of the
+// image pulls being made by the Docker daemon. The directory must be mounted
+// from the host for the daemon to read it. An existing ca.crt is never
+// overwritten. The returned function removes the installed files. Failures
+// are only logged, the daemon may already trust the registries.
+func installRegistryCA(opts TransportOptions, registries []string) func() {
+	installed := []string{}
+	cleanup := func() {
+		for i := len(installed) - 1; i >= 0; i-- {
+			err := os.Remove(installed[i])
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				log.Warn().
+					Err(err).
+					Str("path", installed[i]).
+					Msg("Failed to remove the installed CA bundle")
+			}
+		}
+	}
+
+	if opts.CAFile == "" {
+		return cleanup
+	}
+
+	bundle, err := os.ReadFile(opts.CAFile)
+	if err != nil {
+		log.Warn().
+			Err(err).
+			Str("caFile", opts.CAFile).
+			Msg("Failed to read the CA bundle, registry connections will not trust it")
+		return cleanup
+	}
+
+	for host := range parseRegistryCredentials(registries) {
+		certDir := filepath.Join(dockerCertsDir, host)
+		certPath := filepath.Join(certDir, "ca.crt")
+
+		_, err = os.Lstat(certPath)
+		if err == nil {
+			log.Warn().
+				Str("registry", host).
+				Str("path", certPath).
+				Msg("A CA bundle is already installed for the registry, leaving it in place")
+			continue
+		}
+
+		_, err = os.Stat(certDir)
+		createdDir := errors.Is(err, os.ErrNotExist)
+
+		err = os.MkdirAll(certDir, 0755)
+		if err == nil {
+			if createdDir {
+				installed = append(installed, certDir)
+			}
+
+			err = writeNewFile(certPath, bundle)
+		}
+		if err != nil {
+			log.Warn().
+				Err(err).
+				Str("registry", host).
+				Msg("Failed to install the CA bundle for the registry")
+			continue
+		}
+		installed = append(installed, certPath)
+
+		log.Debug().
+			Str("registry", host).
+			Str("path", certPath).
+			Msg("Installed the CA bundle for the registry")
+	}
+
+	return cleanup
+}
+
+// writeNewFile writes content to path, failing when the file already exists.
+func writeNewFile(path string, content []byte) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(content)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestInstallRegistryCA(t *testing.T) {
+	certsDir := t.TempDir()
+	defer func(dir string) { dockerCertsDir = dir }(dockerCertsDir)
+	dockerCertsDir = certsDir
+
+	writeTestFiles(t, certsDir, map[string]string{
+		"registry.example.com/ca.crt":   "host CA",
+		"mirror.example.com:5000/a.crt": "other",
+	})
+	caFile := filepath.Join(writeTestFiles(t, t.TempDir(), map[string]string{"ca.pem": "bundle"}), "ca.pem")
+
+	removeRegistryCA := installRegistryCA(TransportOptions{CAFile: caFile}, []string{
+		"user:pass:registry.example.com",
+		"user:pass:mirror.example.com:5000",
+		"user:pass:new.example.com",
+	})
+
+	assertTestFiles(t, certsDir, map[string]string{
+		"registry.example.com/ca.crt":    "host CA",
+		"mirror.example.com:5000/ca.crt": "bundle",
+		"new.example.com/ca.crt":         "bundle",
+	})
+
+	removeRegistryCA()
+
+	assertTestFiles(t, certsDir, map[string]string{
+		"registry.example.com/ca.crt":   "host CA",
+		"mirror.example.com:5000/a.crt": "other",
+	})
+	for _, path := range []string{"mirror.example.com:5000/ca.crt", "new.example.com"} {
+		if _, err := os.Stat(filepath.Join(certsDir, path)); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%s left behind: %v", path, err)
+		}
+	}
+}
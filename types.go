@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"path"
+	"time"
 
 	"github.com/portainer/compose-unpacker/log"
 )
@@ -19,54 +20,210 @@ type CommandExecutionContext struct {
 }
 
 type DeployCommand struct {
-	User                     string   `help:"Username for Git authentication." short:"u"`
-	Password                 string   `help:"Password or PAT for Git authentication" short:"p"`
-	Keep                     bool     `help:"Keep stack folder" short:"k"`
-	SkipTLSVerify            bool     `help:"Skip TLS verification for git" name:"skip-tls-verify"`
-	Env                      []string `help:"OS ENV for stack" example:"key=value"`
-	Registry                 []string `help:"Registry credentials" name:"registry"`
-	GitRepository            string   `arg:"" help:"Git repository to deploy from." name:"git-repo"`
-	Reference                string   `arg:"" help:"Reference of Git repository to deploy from." name:"git-ref"`
-	ProjectName              string   `arg:"" help:"Name of the Compose stack." name:"project-name"`
-	Destination              string   `arg:"" help:"Path on disk where the Git repository will be cloned." type:"path" name:"destination"`
-	ComposeRelativeFilePaths []string `arg:"" help:"Relative path to the Compose file."  name:"compose-file-paths"`
+	User                     string        `help:"Username for Git authentication." short:"u"`
+	Password                 string        `help:"Password or PAT for Git authentication" short:"p"`
+	Keep                     bool          `help:"Keep stack folder" short:"k"`
+	SkipTLSVerify            bool          `help:"Skip TLS verification for git" name:"skip-tls-verify"`
+	CAFile                   string        `help:"PEM bundle of additional CAs trusted for Git and registry connections, installed for the Docker daemon under /etc/docker/certs.d which must be mounted from the host" type:"existingfile" name:"git-ca-file"`
+	HTTPProxy                string        `help:"Proxy for HTTP connections, overrides HTTP_PROXY" name:"http-proxy"`
+	HTTPSProxy               string        `help:"Proxy for HTTPS connections, overrides HTTPS_PROXY" name:"https-proxy"`
+	NoProxy                  string        `help:"Hosts excluded from proxying, overrides NO_PROXY" name:"no-proxy"`
+	RecurseSubmodules        bool          `help:"Clone the Git submodules of the repository" name:"recurse-submodules"`
+	SubmoduleCredential      []string      `help:"Git credentials for submodules hosted on another host" example:"host=username:password" name:"submodule-credential"`
+	LFS                      bool          `help:"Fetch the Git LFS objects referenced under the compose file directories" name:"lfs"`
+	CloneDepth               int           `help:"Depth of the Git clone, 0 for the full history" default:"1" name:"clone-depth"`
+	Sparse                   bool          `help:"Only check out the directories of the compose files and the sparse paths, only the git backend also skips fetching the other files" name:"sparse"`
+	SparsePath               []string      `help:"Additional repository path to check out in sparse mode, implies --sparse" name:"sparse-path"`
+	CacheDir                 string        `help:"Directory holding Git mirrors shared between stacks" type:"path" name:"cache-dir"`
+	CacheMaxAge              time.Duration `help:"Remove cached Git mirrors unused for longer than this, 0 to keep them" default:"168h" name:"cache-max-age"`
+	GitBackend               string        `help:"Git implementation, auto uses the git binary for sparse checkouts and falls back to it on go-git protocol errors" default:"auto" enum:"auto,go-git,git" name:"git-backend"`
+	Source                   string        `help:"Type of the stack source, auto detects archive URLs and local paths" default:"auto" enum:"auto,git,archive,local,oci" name:"source"`
+	SHA256                   string        `help:"Expected sha256 checksum of an archive source" name:"sha256"`
+	StripComponents          int           `help:"Number of leading path elements removed from archive entries" name:"strip-components"`
+	FromBundle               string        `help:"Deploy from a bundle created by the bundle command, without Git or registry access" type:"existingfile" name:"from-bundle"`
+	Profile                  []string      `help:"Compose profile to activate" name:"profile"`
+	Service                  []string      `help:"Only deploy this service and its dependencies" name:"service"`
+	ForceRecreate            bool          `help:"Recreate the containers even if their configuration is unchanged" name:"force-recreate"`
+	Env                      []string      `help:"OS ENV for stack" example:"key=value"`
+	Registry                 []string      `help:"Registry credentials" name:"registry"`
+	Workdir                  string        `help:"Directory of the repository the compose file paths are relative to" name:"workdir"`
+	Template                 bool          `help:"Render the compose files ending with .tmpl and the template files as Go templates" name:"template"`
+	TemplateFile             []string      `help:"Additional file to render in template mode, relative to the working directory" name:"template-file"`
+	Values                   []string      `help:"YAML values file for the templates, looked up in the repository first" name:"values"`
+	SkipValidate             bool          `help:"Skip the validation of the compose files before the deployment, which fails on errors" name:"skip-validate"`
+	Policy                   string        `help:"Policy file checked against the resolved compose model before the deployment" type:"existingfile" name:"policy"`
+	AllowedRegistries        []string      `help:"Registries, optionally followed by a repository prefix, the images of the stack must come from" name:"allowed-registries"`
+	RequireDigests           bool          `help:"Reject the images which are not pinned by digest" name:"require-digests"`
+	VerifyImages             bool          `help:"Verify the cosign signatures of the images of the stack before the deployment" name:"verify-images"`
+	CosignKey                []string      `help:"PEM public key the image signatures are verified against" type:"existingfile" name:"cosign-key"`
+	SignatureAnnotation      []string      `help:"Annotation the image signatures must carry" example:"key=value" name:"signature-annotation"`
+	Locked                   bool          `help:"Deploy the image digests of the compose.lock.json of the working directory, or of the previous deployment" xor:"lock" name:"locked"`
+	Lock                     bool          `help:"Fail the deployment when an image cannot be resolved to its current digest, the images being otherwise deployed by tag when the registry cannot be reached" xor:"lock" name:"lock"`
+	HostDestination          string        `help:"Host path of the destination, detected from the mounts of the unpacker container when omitted" name:"host-destination"`
+	GitRepository            string        `arg:"" help:"Git repository, archive URL, local path or oci:// reference to deploy from, ignored with --from-bundle." name:"git-repo"`
+	Reference                string        `arg:"" help:"Reference of Git repository to deploy from, ignored for other sources." name:"git-ref"`
+	ProjectName              string        `arg:"" help:"Name of the Compose stack." name:"project-name"`
+	Destination              string        `arg:"" help:"Path on disk where the Git repository will be cloned." type:"path" name:"destination"`
+	ComposeRelativeFilePaths []string      `arg:"" optional:"" help:"Relative path to the Compose file, discovered in the working directory when omitted." name:"compose-file-paths"`
 }
 
 type SwarmDeployCommand struct {
+	User                     string        `help:"Username for Git authentication." short:"u"`
+	Password                 string        `help:"Password or PAT for Git authentication" short:"p"`
+	Pull                     bool          `help:"Pull Image" short:"f"`
+	Prune                    bool          `help:"Prune services during deployment" short:"r"`
+	Keep                     bool          `help:"Keep stack folder" short:"k"`
+	SkipTLSVerify            bool          `help:"Skip TLS verification for git" name:"skip-tls-verify"`
+	CAFile                   string        `help:"PEM bundle of additional CAs trusted for Git and registry connections, installed for the Docker daemon under /etc/docker/certs.d which must be mounted from the host" type:"existingfile" name:"git-ca-file"`
+	HTTPProxy                string        `help:"Proxy for HTTP connections, overrides HTTP_PROXY" name:"http-proxy"`
+	HTTPSProxy               string        `help:"Proxy for HTTPS connections, overrides HTTPS_PROXY" name:"https-proxy"`
+	NoProxy                  string        `help:"Hosts excluded from proxying, overrides NO_PROXY" name:"no-proxy"`
+	RecurseSubmodules        bool          `help:"Clone the Git submodules of the repository" name:"recurse-submodules"`
+	SubmoduleCredential      []string      `help:"Git credentials for submodules hosted on another host" example:"host=username:password" name:"submodule-credential"`
+	LFS                      bool          `help:"Fetch the Git LFS objects referenced under the compose file directories" name:"lfs"`
+	CloneDepth               int           `help:"Depth of the Git clone, 0 for the full history" default:"100" name:"clone-depth"`
+	Sparse                   bool          `help:"Only check out the directories of the compose files and the sparse paths, only the git backend also skips fetching the other files" name:"sparse"`
+	SparsePath               []string      `help:"Additional repository path to check out in sparse mode, implies --sparse" name:"sparse-path"`
+	CacheDir                 string        `help:"Directory holding Git mirrors shared between stacks" type:"path" name:"cache-dir"`
+	CacheMaxAge              time.Duration `help:"Remove cached Git mirrors unused for longer than this, 0 to keep them" default:"168h" name:"cache-max-age"`
+	GitBackend               string        `help:"Git implementation, auto uses the git binary for sparse checkouts and falls back to it on go-git protocol errors" default:"auto" enum:"auto,go-git,git" name:"git-backend"`
+	Source                   string        `help:"Type of the stack source, auto detects archive URLs and local paths" default:"auto" enum:"auto,git,archive,local,oci" name:"source"`
+	SHA256                   string        `help:"Expected sha256 checksum of an archive source" name:"sha256"`
+	StripComponents          int           `help:"Number of leading path elements removed from archive entries" name:"strip-components"`
+	Env                      []string      `help:"OS ENV for stack."`
+	Registry                 []string      `help:"Registry credentials" name:"registry"`
+	VersionObjects           bool          `help:"Rename file-backed secrets and configs after their content hash so that changes roll out" default:"true" negatable:"" name:"version-objects"`
+	ObjectRetention          int           `help:"Number of superseded secret and config versions kept for rollbacks" default:"2" name:"object-retention"`
+	UpdateParallelism        int           `help:"Number of tasks updated at once, for the services without an update_config" name:"update-parallelism"`
+	UpdateDelay              time.Duration `help:"Delay between the updates of groups of tasks, for the services without an update_config" name:"update-delay"`
+	UpdateOrder              string        `help:"Order of the task updates, start-first or stop-first, for the services without an update_config" name:"update-order"`
+	UpdateFailureAction      string        `help:"Action on task update failures, pause, continue or rollback, for the services without an update_config" name:"update-failure-action"`
+	Monitor                  time.Duration `help:"Time to monitor each task for failures after its update, for the services without an update_config" name:"monitor"`
+	ConvergeTimeout          time.Duration `help:"Time to wait for the service updates, paused updates being rolled back, 0 to skip the check" default:"5m" name:"converge-timeout"`
+	Workdir                  string        `help:"Directory of the repository the compose file paths are relative to" name:"workdir"`
+	Template                 bool          `help:"Render the compose files ending with .tmpl and the template files as Go templates" name:"template"`
+	TemplateFile             []string      `help:"Additional file to render in template mode, relative to the working directory" name:"template-file"`
+	Values                   []string      `help:"YAML values file for the templates, looked up in the repository first" name:"values"`
+	SkipValidate             bool          `help:"Skip the validation of the compose files before the deployment, which fails on errors" name:"skip-validate"`
+	Policy                   string        `help:"Policy file checked against the resolved compose model before the deployment" type:"existingfile" name:"policy"`
+	AllowedRegistries        []string      `help:"Registries, optionally followed by a repository prefix, the images of the stack must come from" name:"allowed-registries"`
+	RequireDigests           bool          `help:"Reject the images which are not pinned by digest" name:"require-digests"`
+	VerifyImages             bool          `help:"Verify the cosign signatures of the images of the stack before the deployment" name:"verify-images"`
+	CosignKey                []string      `help:"PEM public key the image signatures are verified against" type:"existingfile" name:"cosign-key"`
+	SignatureAnnotation      []string      `help:"Annotation the image signatures must carry" example:"key=value" name:"signature-annotation"`
+	Locked                   bool          `help:"Deploy the image digests of the compose.lock.json of the working directory, or of the previous deployment" xor:"lock" name:"locked"`
+	Lock                     bool          `help:"Fail the deployment when an image cannot be resolved to its current digest, the images being otherwise deployed by tag when the registry cannot be reached" xor:"lock" name:"lock"`
+	HostDestination          string        `help:"Host path of the destination, detected from the mounts of the unpacker container when omitted" name:"host-destination"`
+	GitRepository            string        `arg:"" help:"Git repository, archive URL, local path or oci:// reference to deploy from." name:"git-repo"`
+	Reference                string        `arg:"" help:"Reference of Git repository to deploy from, ignored for other sources." name:"git-ref"`
+	ProjectName              string        `arg:"" help:"Name of the Swarm stack." name:"project-name"`
+	Destination              string        `arg:"" help:"Path on disk where the Git repository will be cloned." type:"path" name:"destination"`
+	ComposeRelativeFilePaths []string      `arg:"" optional:"" help:"Relative path to the Compose file, discovered in the working directory when omitted." name:"compose-file-paths"`
+}
+
+type UndeployCommand struct {
+	Keep          bool          `help:"Keep stack folder" short:"k"`
+	Volumes       bool          `help:"Remove the named volumes of the stack and the anonymous volumes of its containers" name:"volumes"`
+	RemoveImages  string        `help:"Remove the images of the stack, local only removes the images without a custom tag" default:"none" enum:"none,local,all" name:"rmi"`
+	Timeout       time.Duration `help:"Shutdown timeout of the containers, the compose default is used when not set" name:"timeout"`
+	RemoveOrphans bool          `help:"Remove the containers of services no longer defined in the compose files" default:"true" negatable:"" name:"remove-orphans"`
+
+	ProjectName string `arg:"" help:"Name of the Compose stack." name:"project-name"`
+	Destination string `arg:"" help:"Path on disk where the Git repository was cloned." type:"path" name:"destination"`
+}
+
+type SwarmUndeployCommand struct {
+	Keep        bool          `help:"Keep stack folder" short:"k"`
+	Timeout     time.Duration `help:"Time to wait for the resources of the stack to be removed, 0 to return right away" default:"5m" name:"timeout"`
+	ProjectName string        `arg:"" help:"Name of the Compose (Swarm) stack." name:"project-name"`
+	Destination string        `arg:"" help:"Path on disk where the Git repository will be cloned." type:"path" name:"destination"`
+}
+
+type BundleCommand struct {
 	User                     string   `help:"Username for Git authentication." short:"u"`
 	Password                 string   `help:"Password or PAT for Git authentication" short:"p"`
-	Pull                     bool     `help:"Pull Image" short:"f"`
-	Prune                    bool     `help:"Prune services during deployment" short:"r"`
-	Keep                     bool     `help:"Keep stack folder" short:"k"`
 	SkipTLSVerify            bool     `help:"Skip TLS verification for git" name:"skip-tls-verify"`
-	Env                      []string `help:"OS ENV for stack."`
+	CAFile                   string   `help:"PEM bundle of additional CAs trusted for Git and registry connections, installed for the Docker daemon under /etc/docker/certs.d which must be mounted from the host" type:"existingfile" name:"git-ca-file"`
+	HTTPProxy                string   `help:"Proxy for HTTP connections, overrides HTTP_PROXY" name:"http-proxy"`
+	HTTPSProxy               string   `help:"Proxy for HTTPS connections, overrides HTTPS_PROXY" name:"https-proxy"`
+	NoProxy                  string   `help:"Hosts excluded from proxying, overrides NO_PROXY" name:"no-proxy"`
+	RecurseSubmodules        bool     `help:"Clone the Git submodules of the repository" name:"recurse-submodules"`
+	SubmoduleCredential      []string `help:"Git credentials for submodules hosted on another host" example:"host=username:password" name:"submodule-credential"`
+	LFS                      bool     `help:"Fetch the Git LFS objects referenced under the compose file directories" name:"lfs"`
+	GitBackend               string   `help:"Git implementation, auto uses the git binary for sparse checkouts and falls back to it on go-git protocol errors" default:"auto" enum:"auto,go-git,git" name:"git-backend"`
+	Env                      []string `help:"OS ENV used to resolve the images of the stack" example:"key=value"`
 	Registry                 []string `help:"Registry credentials" name:"registry"`
-	GitRepository            string   `arg:"" help:"Git repository to deploy from." name:"git-repo"`
-	Reference                string   `arg:"" help:"Reference of Git repository to deploy from." name:"git-ref"`
-	ProjectName              string   `arg:"" help:"Name of the Swarm stack." name:"project-name"`
-	Destination              string   `arg:"" help:"Path on disk where the Git repository will be cloned." type:"path" name:"destination"`
-	ComposeRelativeFilePaths []string `arg:"" help:"Relative path to the Compose file."  name:"compose-file-paths"`
+	Workdir                  string   `help:"Directory of the repository the compose file paths are relative to" name:"workdir"`
+	GitRepository            string   `arg:"" help:"Git repository to bundle." name:"git-repo"`
+	Reference                string   `arg:"" help:"Reference of Git repository to bundle." name:"git-ref"`
+	Output                   string   `arg:"" help:"Path of the bundle archive to create." type:"path" name:"output"`
+	ComposeRelativeFilePaths []string `arg:"" optional:"" help:"Relative path to the Compose file, discovered in the working directory when omitted." name:"compose-file-paths"`
 }
 
-type UndeployCommand struct {
-	User     string `help:"Username for Git authentication." short:"u"`
-	Password string `help:"Password or PAT for Git authentication" short:"p"`
-	Keep     bool   `help:"Keep stack folder" short:"k"`
-
-	GitRepository            string   `arg:"" help:"Git repository to deploy from." name:"git-repo"`
-	ProjectName              string   `arg:"" help:"Name of the Compose stack." name:"project-name"`
-	Destination              string   `arg:"" help:"Path on disk where the Git repository will be cloned." type:"path" name:"destination"`
-	ComposeRelativeFilePaths []string `arg:"" help:"Relative path to the Compose file." name:"compose-file-path"`
+type ValidateCommand struct {
+	Format                   string   `help:"Output format of the findings" default:"text" enum:"text,json" name:"format"`
+	Strict                   bool     `help:"Fail on warnings too" name:"strict"`
+	Policy                   string   `help:"Policy file checked against the resolved compose model" type:"existingfile" name:"policy"`
+	Env                      []string `help:"OS ENV used to resolve the variables of the compose files" example:"key=value"`
+	Workdir                  string   `help:"Directory of the repository the compose file paths are relative to" name:"workdir"`
+	Directory                string   `arg:"" help:"Directory holding the stack files." type:"existingdir" name:"directory"`
+	ComposeRelativeFilePaths []string `arg:"" optional:"" help:"Relative path to the Compose file, discovered in the working directory when omitted." name:"compose-file-paths"`
 }
 
-type SwarmUndeployCommand struct {
-	Keep        bool   `help:"Keep stack folder" short:"k"`
-	ProjectName string `arg:"" help:"Name of the Compose (Swarm) stack." name:"project-name"`
-	Destination string `arg:"" help:"Path on disk where the Git repository will be cloned." type:"path" name:"destination"`
+type UpdateLockCommand struct {
+	Registry                 []string `help:"Registry credentials" name:"registry"`
+	SkipTLSVerify            bool     `help:"Skip TLS verification for the registries" name:"skip-tls-verify"`
+	CAFile                   string   `help:"PEM bundle of additional CAs trusted for the registries" type:"existingfile" name:"ca-file"`
+	HTTPProxy                string   `help:"Proxy for HTTP connections, overrides HTTP_PROXY" name:"http-proxy"`
+	HTTPSProxy               string   `help:"Proxy for HTTPS connections, overrides HTTPS_PROXY" name:"https-proxy"`
+	NoProxy                  string   `help:"Hosts excluded from proxying, overrides NO_PROXY" name:"no-proxy"`
+	Env                      []string `help:"OS ENV used to resolve the images of the stack" example:"key=value"`
+	Workdir                  string   `help:"Directory of the repository the compose file paths are relative to" name:"workdir"`
+	Output                   string   `help:"Path of the lock file, compose.lock.json in the working directory by default" type:"path" name:"output"`
+	Directory                string   `arg:"" help:"Directory holding the stack files." type:"existingdir" name:"directory"`
+	ComposeRelativeFilePaths []string `arg:"" optional:"" help:"Relative path to the Compose file, discovered in the working directory when omitted." name:"compose-file-paths"`
+}
+
+type CheckUpdatesCommand struct {
+	Registry      []string      `help:"Registry credentials" name:"registry"`
+	SkipTLSVerify bool          `help:"Skip TLS verification for the registries" name:"skip-tls-verify"`
+	CAFile        string        `help:"PEM bundle of additional CAs trusted for the registries, installed for the Docker daemon under /etc/docker/certs.d which must be mounted from the host" type:"existingfile" name:"ca-file"`
+	HTTPProxy     string        `help:"Proxy for HTTP connections, overrides HTTP_PROXY" name:"http-proxy"`
+	HTTPSProxy    string        `help:"Proxy for HTTPS connections, overrides HTTPS_PROXY" name:"https-proxy"`
+	NoProxy       string        `help:"Hosts excluded from proxying, overrides NO_PROXY" name:"no-proxy"`
+	Swarm         bool          `help:"Check the services of a Swarm stack instead of the containers of a Compose stack" name:"swarm"`
+	Redeploy      bool          `help:"Redeploy the stale services, pulling their images" name:"redeploy"`
+	Interval      time.Duration `help:"Keep checking at this interval until interrupted, 0 to check once" name:"interval"`
+	Env           []string      `help:"OS ENV for the redeployment of a Compose stack" example:"key=value"`
+	ProjectName   string        `arg:"" help:"Name of the Compose (Swarm) stack." name:"project-name"`
+	Destination   string        `arg:"" optional:"" help:"Path on disk where the stack was deployed, required to redeploy a Compose stack." type:"path" name:"destination"`
+}
+
+type GCCommand struct {
+	Images      bool          `help:"Also collect the images used by no container nor Swarm service" name:"images"`
+	KeepImages  int           `help:"Number of most recent unused images kept per repository" default:"2" name:"keep-images"`
+	MinAge      time.Duration `help:"Skip the stack directories modified more recently than this, their stack may not be created yet" default:"1h" name:"min-age"`
+	Yes         bool          `help:"Remove the orphaned stack directories and unused images, they are only reported otherwise" short:"y" name:"yes"`
+	Destination string        `arg:"" help:"Path on disk holding the stack directories." type:"existingdir" name:"destination"`
+}
+
+type PushCommand struct {
+	Registry      []string `help:"Registry credentials" name:"registry"`
+	SkipTLSVerify bool     `help:"Skip TLS verification for the registry" name:"skip-tls-verify"`
+	CAFile        string   `help:"PEM bundle of additional CAs trusted for the registry" type:"existingfile" name:"ca-file"`
+	HTTPProxy     string   `help:"Proxy for HTTP connections, overrides HTTP_PROXY" name:"http-proxy"`
+	HTTPSProxy    string   `help:"Proxy for HTTPS connections, overrides HTTPS_PROXY" name:"https-proxy"`
+	NoProxy       string   `help:"Hosts excluded from proxying, overrides NO_PROXY" name:"no-proxy"`
+	Directory     string   `arg:"" help:"Directory holding the compose files and assets." type:"existingdir" name:"directory"`
+	Reference     string   `arg:"" help:"Artifact reference, e.g. oci://registry/repository:tag." name:"reference"`
 }
 
 type RemoveDirCommand struct {
-	Path string `arg:"" help:"The path be removed." name:"path"`
+	Root      string        `help:"Directory the removed paths must be under, after symlink resolution, nothing being removed without it" type:"path" env:"UNPACKER_ROOT" name:"root"`
+	DryRun    bool          `help:"List the directories which would be removed without removing them" name:"dry-run"`
+	OlderThan time.Duration `help:"Remove the stack directories of the root not modified for longer than this" name:"older-than"`
+	Glob      string        `help:"Remove the stack directories of the root whose name matches this pattern" name:"glob"`
+	Path      string        `arg:"" optional:"" help:"The path be removed." name:"path"`
 }
 
 var cli struct {
@@ -76,7 +233,13 @@ var cli struct {
 	Undeploy      UndeployCommand      `cmd:"" help:"Remove a stack from a Git repository."`
 	SwarmDeploy   SwarmDeployCommand   `cmd:"" help:"Deploy a Swarm stack from a Git repository."`
 	SwarmUndeploy SwarmUndeployCommand `cmd:"" help:"Remove a Swarm stack from a Git repository."`
+	Bundle        BundleCommand        `cmd:"" help:"Export a stack and its images into an archive for air-gapped deployments."`
+	Validate      ValidateCommand      `cmd:"" help:"Validate the compose files of a stack directory."`
+	UpdateLock    UpdateLockCommand    `cmd:"" help:"Resolve the images of a stack directory to digests in its lock file."`
+	CheckUpdates  CheckUpdatesCommand  `cmd:"" help:"List the services of a stack whose image tag points to a new digest."`
+	Push          PushCommand          `cmd:"" help:"Push a stack directory to a registry as an OCI artifact."`
 	RemoveDir     RemoveDirCommand     `cmd:"" help:"Remove a directory."`
+	GC            GCCommand            `cmd:"" name:"gc" help:"Remove the orphaned stack directories and the unused images."`
 }
 
 func NewCommandExecutionContext(ctx context.Context) *CommandExecutionContext {
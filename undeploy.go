@@ -1,45 +1,46 @@
 package main
 
 import (
+	"math"
 	"os"
-	"path"
-	"runtime"
+	"path/filepath"
+	"strconv"
 	"strings"
 
-	"github.com/portainer/portainer/pkg/libstack"
-	"github.com/portainer/portainer/pkg/libstack/compose"
 	"github.com/rs/zerolog/log"
 )
 
 func (cmd *UndeployCommand) Run(cmdCtx *CommandExecutionContext) error {
 	log.Info().
-		Str("repository", cmd.GitRepository).
-		Strs("composePath", cmd.ComposeRelativeFilePaths).
-		Msg("Undeploying Compose stack from Git repository")
+		Str("projectName", cmd.ProjectName).
+		Str("destination", cmd.Destination).
+		Msg("Undeploying Compose stack")
 
-	i := strings.LastIndex(cmd.GitRepository, "/")
-	if i == -1 {
+	err := validateStackName(cmd.ProjectName)
+	if err != nil {
 		log.Error().
-			Str("repository", cmd.GitRepository).
-			Msg("Invalid Git repository URL")
-
+			Err(err).
+			Msg("Invalid stack parameters")
 		return errDeployComposeFailure
 	}
 
 	mountPath := makeWorkingDir(cmd.Destination, cmd.ProjectName)
 
-	deployer, err := compose.NewComposeDeployer(BIN_PATH, PORTAINER_DOCKER_CONFIG_PATH)
-	if err != nil {
-		log.Error().Err(err).Msg("Failed to create Compose deployer")
-
-		return errDeployComposeFailure
+	args := []string{"down"}
+	if cmd.Volumes {
+		args = append(args, "--volumes")
+	}
+	if cmd.RemoveImages != "none" {
+		args = append(args, "--rmi", cmd.RemoveImages)
+	}
+	if cmd.Timeout > 0 {
+		args = append(args, "--timeout", strconv.Itoa(int(math.Ceil(cmd.Timeout.Seconds()))))
+	}
+	if cmd.RemoveOrphans {
+		args = append(args, "--remove-orphans")
 	}
 
-	log.Debug().
-		Str("projectName", cmd.ProjectName).
-		Msg("Undeploying Compose stack")
-
-	err = deployer.Remove(cmdCtx.context, cmd.ProjectName, nil, libstack.Options{})
+	err = composeDown(cmdCtx, mountPath, cmd.ProjectName, args)
 	if err != nil {
 		log.Error().
 			Err(err).
@@ -61,24 +62,87 @@ func (cmd *UndeployCommand) Run(cmdCtx *CommandExecutionContext) error {
 	return nil
 }
 
+// composeDown tears the stack down from the compose files recorded at deploy
+// time when they are still on disk, so that the volumes, networks and images
+// they declare are known to compose. It falls back to the project name
+// otherwise.
+func composeDown(cmdCtx *CommandExecutionContext, mountPath, projectName string, args []string) error {
+	state, err := readStackState(mountPath)
+	if err != nil {
+		log.Warn().
+			Err(err).
+			Msg("Failed to read the stack state, removing the stack by project name")
+	}
+
+	if state != nil {
+		clonePath := filepath.Join(mountPath, state.Directory)
+
+		composeFilePaths := []string{}
+		for _, composeFile := range state.ComposeFiles {
+			composeFilePath := filepath.Join(clonePath, filepath.FromSlash(composeFile))
+			if _, err := os.Stat(composeFilePath); err == nil {
+				composeFilePaths = append(composeFilePaths, composeFilePath)
+			}
+		}
+
+		if len(composeFilePaths) > 0 && len(composeFilePaths) == len(state.ComposeFiles) {
+			var env []string
+			if len(state.Profiles) > 0 {
+				env = append(env, "COMPOSE_PROFILES="+strings.Join(state.Profiles, ","))
+			}
+
+			log.Debug().
+				Strs("composeFilePaths", composeFilePaths).
+				Str("projectName", projectName).
+				Msg("Removing Compose stack using its compose files")
+
+			_, err = runComposeCommand(cmdCtx.context, filepath.Join(clonePath, state.WorkingDir), projectName, composeFilePaths, env, args...)
+			if err == nil {
+				return nil
+			}
+
+			log.Warn().
+				Err(err).
+				Msg("Failed to remove the stack using its compose files, removing it by project name")
+		}
+	}
+
+	log.Debug().
+		Str("projectName", projectName).
+		Msg("Removing Compose stack by project name")
+
+	_, err = runComposeCommand(cmdCtx.context, "", projectName, nil, nil, args...)
+	return err
+}
+
 func (cmd *SwarmUndeployCommand) Run(cmdCtx *CommandExecutionContext) error {
 	log.Info().
 		Str("stack name", cmd.ProjectName).
 		Str("destination", cmd.Destination).
 		Msg("Undeploying Swarm stack from Git repository")
 
-	command := path.Join(BIN_PATH, "docker")
-	if runtime.GOOS == "windows" {
-		command = path.Join(BIN_PATH, "docker.exe")
+	err := validateStackName(cmd.ProjectName)
+	if err != nil {
+		log.Error().
+			Err(err).
+			Msg("Invalid stack parameters")
+		return err
 	}
 
-	args := make([]string, 0)
-	args = append(args, "stack", "rm", cmd.ProjectName)
-	err := runCommandAndCaptureStdErr(command, args, nil, "")
+	command := getDockerBinaryPath()
+	args := []string{"--config", PORTAINER_DOCKER_CONFIG_PATH, "stack", "rm", cmd.ProjectName}
+	err = runCommandAndCaptureStdErr(command, args, nil, "")
 	if err != nil {
 		return err
 	}
 
+	if cmd.Timeout > 0 {
+		err = waitForSwarmStackRemoval(cmdCtx, cmd.ProjectName, cmd.Timeout)
+		if err != nil {
+			return err
+		}
+	}
+
 	mountPath := makeWorkingDir(cmd.Destination, cmd.ProjectName)
 	if !cmd.Keep { //stack stop request
 		err = os.RemoveAll(mountPath)
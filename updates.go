@@ -0,0 +1,428 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	composeProjectLabel = "com.docker.compose.project"
+	composeServiceLabel = "com.docker.compose.service"
+)
+
+var errStackStateNotFound = errors.New("stack deployed without state")
+
+// staleService is a service whose deployed image digest differs from the
+// current registry digest of its tag.
+type staleService struct {
+	// ID is the Swarm service ID, empty for Compose services
+	ID       string
+	Service  string
+	Image    string
+	Deployed string
+	Latest   string
+}
+
+func (s staleService) String() string {
+	return fmt.Sprintf("%s\t%s\t%s -> %s", s.Service, s.Image, s.Deployed, s.Latest)
+}
+
+// deployedImage is the image of a container or service with the digests it
+// was pulled with.
+type deployedImage struct {
+	id      string
+	service string
+	image   string
+	digests []string
+}
+
+func (cmd *CheckUpdatesCommand) Run(cmdCtx *CommandExecutionContext) error {
+	err := validateStackName(cmd.ProjectName)
+	if err != nil {
+		return err
+	}
+
+	transportOpts := cmd.transportOptions()
+
+	client, err := newRegistryClient(transportOpts, cmd.Registry)
+	if err != nil {
+		return err
+	}
+
+	if cmd.Redeploy {
+		removeRegistryCA := installRegistryCA(transportOpts, cmd.Registry)
+		defer removeRegistryCA()
+		defer dockerLogout(cmd.Registry, transportOpts)
+		err = dockerLogin(cmd.Registry, transportOpts)
+		if err != nil {
+			return err
+		}
+	}
+
+	for {
+		err = cmd.check(cmdCtx, client)
+		if err != nil || cmd.Interval <= 0 {
+			return err
+		}
+
+		select {
+		case <-cmdCtx.context.Done():
+			return nil
+		case <-time.After(cmd.Interval):
+		}
+	}
+}
+
+func (cmd *CheckUpdatesCommand) check(cmdCtx *CommandExecutionContext, client *registryClient) error {
+	log.Info().
+		Str("projectName", cmd.ProjectName).
+		Bool("swarm", cmd.Swarm).
+		Msg("Checking the stack images for updates")
+
+	var deployed []deployedImage
+	var err error
+	if cmd.Swarm {
+		deployed, err = swarmDeployedImages(cmd.ProjectName)
+	} else {
+		deployed, err = composeDeployedImages(cmd.ProjectName)
+	}
+	if err != nil {
+		log.Error().
+			Err(err).
+			Msg("Failed to inspect the deployed images")
+		return err
+	}
+
+	stale := staleServices(cmdCtx.context, client, deployed)
+	if len(stale) == 0 {
+		log.Info().Msg("Stack images are up to date")
+		return nil
+	}
+
+	names := make([]string, len(stale))
+	for i, service := range stale {
+		names[i] = service.Service
+		fmt.Println(service)
+	}
+
+	log.Info().
+		Strs("services", names).
+		Msg("Stale services found")
+
+	if !cmd.Redeploy {
+		return nil
+	}
+
+	if cmd.Swarm {
+		return redeploySwarmServices(stale)
+	}
+
+	return cmd.redeployComposeServices(cmdCtx, names)
+}
+
+// staleServices returns the services, sorted by name, whose image was not
+// pulled with the current registry digest of its tag. Images unknown to the
+// registries are skipped.
+func staleServices(ctx context.Context, client *registryClient, deployed []deployedImage) []staleService {
+	latestDigests := make(map[string]string)
+	stale := make(map[string]staleService)
+
+	for _, d := range deployed {
+		ref, err := parseImageReference(d.image)
+		if err != nil || ref.Tag == "" {
+			continue
+		}
+		ref.Digest = ""
+
+		latest, ok := latestDigests[ref.String()]
+		if !ok {
+			latest, err = client.HeadManifest(ctx, ref)
+			if err != nil {
+				log.Warn().
+					Err(err).
+					Str("service", d.service).
+					Str("image", d.image).
+					Msg("Failed to resolve the registry digest of the image")
+			}
+			latestDigests[ref.String()] = latest
+		}
+
+		if latest == "" {
+			continue
+		}
+
+		if len(d.digests) == 0 {
+			log.Debug().
+				Str("service", d.service).
+				Str("image", d.image).
+				Msg("Skipping image without registry digest")
+			continue
+		}
+
+		if !containsString(d.digests, latest) {
+			stale[d.service] = staleService{ID: d.id, Service: d.service, Image: ref.String(), Deployed: d.digests[0], Latest: latest}
+		}
+	}
+
+	services := make([]staleService, 0, len(stale))
+	for _, service := range stale {
+		services = append(services, service)
+	}
+	sort.Slice(services, func(i, j int) bool {
+		return services[i].Service < services[j].Service
+	})
+
+	return services
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// repoDigests returns the digests of the repo digests, e.g.
+// nginx@sha256:..., of the repository of image.
+func repoDigests(image string, digests []string) []string {
+	ref, err := parseImageReference(image)
+	if err != nil {
+		return nil
+	}
+
+	matching := []string{}
+	for _, repoDigest := range digests {
+		digestRef, err := parseImageReference(repoDigest)
+		if err == nil && digestRef.Name() == ref.Name() && digestRef.Digest != "" {
+			matching = append(matching, digestRef.Digest)
+		}
+	}
+
+	return matching
+}
+
+// composeDeployedImages returns the images of the running containers of the
+// Compose project.
+func composeDeployedImages(projectName string) ([]deployedImage, error) {
+	command := getDockerBinaryPath()
+
+	output, err := runCommand(command, []string{
+		"--config", PORTAINER_DOCKER_CONFIG_PATH, "ps", "-q",
+		"--filter", fmt.Sprintf("label=%s=%s", composeProjectLabel, projectName),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	containerIDs := splitLines(output)
+	if len(containerIDs) == 0 {
+		return nil, nil
+	}
+
+	output, err = runCommand(command, append([]string{"--config", PORTAINER_DOCKER_CONFIG_PATH, "container", "inspect"}, containerIDs...))
+	if err != nil {
+		return nil, err
+	}
+
+	var containers []struct {
+		Image  string
+		Config struct {
+			Image  string
+			Labels map[string]string
+		}
+	}
+	err = json.Unmarshal([]byte(output), &containers)
+	if err != nil {
+		return nil, err
+	}
+
+	imageIDs := make([]string, len(containers))
+	for i, container := range containers {
+		imageIDs[i] = container.Image
+	}
+
+	digests, err := localRepoDigests(imageIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	deployed := make([]deployedImage, 0, len(containers))
+	for _, container := range containers {
+		// Images pinned by digest, e.g. in locked mode, never go stale
+		if ref, err := parseImageReference(container.Config.Image); err != nil || ref.Digest != "" {
+			continue
+		}
+
+		deployed = append(deployed, deployedImage{
+			service: container.Config.Labels[composeServiceLabel],
+			image:   container.Config.Image,
+			digests: repoDigests(container.Config.Image, digests[container.Image]),
+		})
+	}
+
+	return deployed, nil
+}
+
+// localRepoDigests returns the repo digests of the local images, by image.
+// Unknown images are left out.
+func localRepoDigests(images []string) (map[string][]string, error) {
+	digests := make(map[string][]string)
+
+	for _, image := range images {
+		if _, ok := digests[image]; ok {
+			continue
+		}
+
+		output, err := runCommand(getDockerBinaryPath(), []string{"--config", PORTAINER_DOCKER_CONFIG_PATH, "image", "inspect", "--format", "{{json .RepoDigests}}", image})
+		if err != nil {
+			log.Debug().
+				Err(err).
+				Str("image", image).
+				Msg("Failed to inspect local image")
+			continue
+		}
+
+		var imageDigests []string
+		err = json.Unmarshal([]byte(strings.TrimSpace(output)), &imageDigests)
+		if err != nil {
+			return nil, err
+		}
+
+		digests[image] = imageDigests
+	}
+
+	return digests, nil
+}
+
+// swarmDeployedImages returns the images of the services of the Swarm stack.
+// The digest is part of the image of the service spec when the image was
+// resolved at deploy time, the local image of the node is looked up
+// otherwise.
+func swarmDeployedImages(projectName string) ([]deployedImage, error) {
+	services, err := inspectStackServices(projectName)
+	if err != nil {
+		return nil, err
+	}
+
+	unresolved := []string{}
+	for _, service := range services {
+		if ref, err := parseImageReference(service.Spec.TaskTemplate.ContainerSpec.Image); err == nil && ref.Digest == "" {
+			unresolved = append(unresolved, service.Spec.TaskTemplate.ContainerSpec.Image)
+		}
+	}
+
+	digests, err := localRepoDigests(unresolved)
+	if err != nil {
+		return nil, err
+	}
+
+	deployed := make([]deployedImage, 0, len(services))
+	for _, service := range services {
+		image := service.Spec.TaskTemplate.ContainerSpec.Image
+
+		ref, err := parseImageReference(image)
+		if err != nil {
+			continue
+		}
+
+		d := deployedImage{id: service.ID, service: service.Spec.Name, image: image}
+		if ref.Digest != "" {
+			d.digests = []string{ref.Digest}
+		} else {
+			d.digests = repoDigests(image, digests[image])
+		}
+
+		deployed = append(deployed, d)
+	}
+
+	return deployed, nil
+}
+
+// redeploySwarmServices updates the stale services to the current digest of
+// their tag.
+func redeploySwarmServices(stale []staleService) error {
+	failed := []string{}
+	for _, service := range stale {
+		log.Info().
+			Str("service", service.Service).
+			Str("image", service.Image).
+			Msg("Updating Swarm service image")
+
+		_, err := runCommand(getDockerBinaryPath(), []string{
+			"--config", PORTAINER_DOCKER_CONFIG_PATH, "service", "update",
+			"--detach", "--with-registry-auth", "--resolve-image=always",
+			"--image", service.Image, service.ID,
+		})
+		if err != nil {
+			log.Error().
+				Err(err).
+				Str("service", service.Service).
+				Msg("Failed to update Swarm service")
+
+			failed = append(failed, service.Service)
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("%w: %s", errSwarmUpdateFailed, strings.Join(failed, ", "))
+	}
+
+	return nil
+}
+
+// redeployComposeServices pulls the images of the services and recreates
+// them, without their dependencies, from the compose files recorded at
+// deploy time.
+func (cmd *CheckUpdatesCommand) redeployComposeServices(cmdCtx *CommandExecutionContext, services []string) error {
+	if cmd.Destination == "" {
+		return fmt.Errorf("%w: the destination of the stack is required to redeploy it", errStackStateNotFound)
+	}
+
+	mountPath := makeWorkingDir(cmd.Destination, cmd.ProjectName)
+	state, err := readStackState(mountPath)
+	if err != nil {
+		return err
+	}
+	if state == nil {
+		return fmt.Errorf("%w in %s", errStackStateNotFound, mountPath)
+	}
+
+	clonePath := filepath.Join(mountPath, state.Directory)
+	composeFilePaths := make([]string, len(state.ComposeFiles))
+	for i, composeFile := range state.ComposeFiles {
+		composeFilePaths[i] = filepath.Join(clonePath, filepath.FromSlash(composeFile))
+	}
+
+	env := cmd.Env
+	if len(state.Profiles) > 0 {
+		env = append(env, "COMPOSE_PROFILES="+strings.Join(state.Profiles, ","))
+	}
+
+	log.Info().
+		Strs("services", services).
+		Msg("Redeploying stale services")
+
+	args := append([]string{"up", "-d", "--pull", "always", "--no-deps"}, services...)
+	_, err = runComposeCommand(cmdCtx.context, path.Join(clonePath, state.WorkingDir), cmd.ProjectName, composeFilePaths, env, args...)
+	if err != nil {
+		log.Error().
+			Err(err).
+			Msg("Failed to redeploy stale services")
+		return errDeployComposeFailure
+	}
+
+	log.Info().Msg("Stale services redeployed")
+	return nil
+}
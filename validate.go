@@ -0,0 +1,585 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/compose-spec/compose-go/dotenv"
+	"github.com/compose-spec/compose-go/loader"
+	"github.com/compose-spec/compose-go/template"
+	"github.com/compose-spec/compose-go/types"
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	findingError   = "error"
+	findingWarning = "warning"
+
+	validateFormatJSON = "json"
+)
+
+var errValidationFailed = errors.New("compose validation failure")
+
+var (
+	yamlErrorLinePattern   = regexp.MustCompile(`line (\d+)`)
+	composePathPattern     = regexp.MustCompile(`\b((?:services|networks|volumes|configs|secrets)\.[^\s:]+)`)
+	composeServicePattern  = regexp.MustCompile(`service "([^"]+)"`)
+	composePropertyPattern = regexp.MustCompile(`Additional property (\S+) is not allowed`)
+)
+
+// validationFinding is a problem found in a compose file.
+type validationFinding struct {
+	File     string `json:"file,omitempty"`
+	Service  string `json:"service,omitempty"`
+	Line     int    `json:"line,omitempty"`
+	Column   int    `json:"column,omitempty"`
+	Severity string `json:"severity"`
+	Rule     string `json:"rule"`
+	Message  string `json:"message"`
+}
+
+func (f validationFinding) String() string {
+	location := f.File
+	switch {
+	case location == "" && f.Service != "":
+		location = "service " + f.Service
+	case location == "":
+		location = "compose"
+	}
+	if f.Line > 0 {
+		location += ":" + strconv.Itoa(f.Line)
+	}
+	if f.Line > 0 && f.Column > 0 {
+		location += ":" + strconv.Itoa(f.Column)
+	}
+
+	return fmt.Sprintf("%s: %s: %s [%s]", location, f.Severity, f.Message, f.Rule)
+}
+
+func hasValidationErrors(findings []validationFinding) bool {
+	for _, finding := range findings {
+		if finding.Severity == findingError {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (cmd *ValidateCommand) Run(cmdCtx *CommandExecutionContext) error {
+	composeRelativeFilePaths, err := resolveComposeFiles(cmd.Directory, cmd.Workdir, cmd.ComposeRelativeFilePaths)
+	if err != nil {
+		return err
+	}
+
+	workingDir := path.Join(cmd.Directory, cmd.Workdir)
+	findings := validateComposeFiles(cmd.Directory, workingDir, composeRelativeFilePaths, cmd.Env)
+
+	if cmd.Policy != "" && !hasValidationErrors(findings) {
+		composeFilePaths := make([]string, len(composeRelativeFilePaths))
+		for i := 0; i < len(composeRelativeFilePaths); i++ {
+			composeFilePaths[i] = path.Join(cmd.Directory, composeRelativeFilePaths[i])
+		}
+
+		policy, err := loadPolicy(cmd.Policy)
+		if err != nil {
+			return err
+		}
+
+		policyFindings, err := checkPolicy(cmdCtx.context, policy, workingDir, composeFilePaths, cmd.Env, []string{cmd.Directory})
+		if err != nil {
+			return err
+		}
+
+		locateServiceFindings(cmd.Directory, composeRelativeFilePaths, policyFindings)
+		findings = append(findings, policyFindings...)
+	}
+
+	switch cmd.Format {
+	case validateFormatJSON:
+		content, err := json.MarshalIndent(findings, "", "  ")
+		if err != nil {
+			return err
+		}
+
+		fmt.Println(string(content))
+	default:
+		for _, finding := range findings {
+			fmt.Println(finding)
+		}
+	}
+
+	if hasValidationErrors(findings) || (cmd.Strict && len(findings) > 0) {
+		return errValidationFailed
+	}
+
+	return nil
+}
+
+// preDeployValidation validates the compose files before a deployment and
+// logs the findings, it fails on errors only.
+func preDeployValidation(clonePath, workingDir string, composeRelativeFilePaths, env []string) error {
+	findings := validateComposeFiles(clonePath, workingDir, composeRelativeFilePaths, env)
+
+	for _, finding := range findings {
+		event := log.Warn()
+		if finding.Severity == findingError {
+			event = log.Error()
+		}
+
+		event.
+			Str("file", finding.File).
+			Int("line", finding.Line).
+			Str("rule", finding.Rule).
+			Msg(finding.Message)
+	}
+
+	if hasValidationErrors(findings) {
+		return errValidationFailed
+	}
+
+	return nil
+}
+
+// validateComposeFiles loads the compose files, relative to clonePath, with
+// the compose-go loader and reports its parsing and schema errors, the unset
+// variables and the missing env_file or bind mount sources inside the clone.
+// workingDir is the project directory holding the .env file.
+func validateComposeFiles(clonePath, workingDir string, composeRelativeFilePaths, env []string) []validationFinding {
+	findings := []validationFinding{}
+
+	environment, err := composeEnv(workingDir, env)
+	if err != nil {
+		finding := validationFinding{File: relativeToClone(clonePath, filepath.Join(workingDir, ".env")), Severity: findingError, Rule: "env", Message: err.Error()}
+		if match := yamlErrorLinePattern.FindStringSubmatch(err.Error()); match != nil {
+			finding.Line, _ = strconv.Atoi(match[1])
+		}
+
+		return append(findings, finding)
+	}
+
+	documents := composeDocuments{roots: make(map[string]*yaml.Node)}
+	configFiles := make([]types.ConfigFile, 0, len(composeRelativeFilePaths))
+	for _, composeRelativeFilePath := range composeRelativeFilePaths {
+		content, err := os.ReadFile(filepath.Join(clonePath, filepath.FromSlash(composeRelativeFilePath)))
+		if err != nil {
+			findings = append(findings, validationFinding{File: composeRelativeFilePath, Severity: findingError, Rule: "file", Message: err.Error()})
+			continue
+		}
+
+		dict, err := loader.ParseYAML(content)
+		if err != nil {
+			finding := validationFinding{File: composeRelativeFilePath, Severity: findingError, Rule: "yaml", Message: err.Error()}
+			if match := yamlErrorLinePattern.FindStringSubmatch(err.Error()); match != nil {
+				finding.Line, _ = strconv.Atoi(match[1])
+			}
+
+			findings = append(findings, finding)
+			continue
+		}
+
+		var document yaml.Node
+		err = yaml.Unmarshal(content, &document)
+		if err != nil || len(document.Content) == 0 {
+			document = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode, Line: 1, Column: 1}}}
+		}
+		documents.files = append(documents.files, composeRelativeFilePath)
+		documents.roots[composeRelativeFilePath] = document.Content[0]
+
+		findings = append(findings, checkVariables(composeRelativeFilePath, document.Content[0], dict, environment)...)
+		configFiles = append(configFiles, types.ConfigFile{
+			Filename: filepath.Join(clonePath, filepath.FromSlash(composeRelativeFilePath)),
+			Content:  content,
+		})
+	}
+
+	if hasValidationErrors(findings) {
+		sortFindings(findings)
+		return findings
+	}
+
+	project, err := loader.Load(types.ConfigDetails{
+		WorkingDir:  workingDir,
+		ConfigFiles: configFiles,
+		Environment: environment,
+	}, func(options *loader.Options) {
+		options.SetProjectName(loader.NormalizeProjectName(filepath.Base(workingDir)), false)
+		options.SkipResolveEnvironment = true
+	})
+	if err != nil {
+		findings = append(findings, loaderFinding(clonePath, documents, err))
+		sortFindings(findings)
+		return findings
+	}
+
+	for _, service := range project.Services {
+		findings = append(findings, checkServiceSources(clonePath, workingDir, documents, service)...)
+	}
+
+	sortFindings(findings)
+	return findings
+}
+
+// composeEnv returns the variables available for interpolation: the process
+// environment, the .env file of the project directory and the --env entries.
+func composeEnv(workingDir string, env []string) (map[string]string, error) {
+	environment := make(map[string]string)
+	for _, entry := range os.Environ() {
+		key, value, _ := strings.Cut(entry, "=")
+		environment[key] = value
+	}
+
+	dotEnv, err := dotenv.GetEnvFromFile(environment, workingDir, nil)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range dotEnv {
+		environment[key] = value
+	}
+
+	for _, entry := range env {
+		key, value, _ := strings.Cut(entry, "=")
+		environment[strings.TrimSpace(key)] = value
+	}
+
+	return environment, nil
+}
+
+// checkVariables reports the variables of a compose file used without default
+// value which are not set, compose replacing them with an empty string, or
+// failing for the ${NAME?error} forms. The findings are located at the first
+// use of the variable in root.
+func checkVariables(composeRelativeFilePath string, root *yaml.Node, dict map[string]interface{}, environment map[string]string) []validationFinding {
+	findings := []validationFinding{}
+	for name, variable := range template.ExtractVariables(dict, nil) {
+		if _, ok := environment[name]; ok {
+			continue
+		}
+
+		finding := validationFinding{File: composeRelativeFilePath}
+		switch {
+		case variable.Required:
+			finding.Severity = findingError
+			finding.Rule = "required-variable"
+			finding.Message = fmt.Sprintf("required variable %s is not set", name)
+		case variable.DefaultValue == "" && variable.PresenceValue == "":
+			finding.Severity = findingWarning
+			finding.Rule = "unset-variable"
+			finding.Message = fmt.Sprintf("variable %s is not set and has no default value", name)
+		default:
+			continue
+		}
+
+		usage := regexp.MustCompile(`\$\{?` + regexp.QuoteMeta(name) + `(?:[^A-Za-z0-9_]|$)`)
+		node := findScalar(root, usage.MatchString)
+		if node == nil {
+			node = root
+		}
+		finding.Line, finding.Column = node.Line, node.Column
+
+		findings = append(findings, finding)
+	}
+
+	sortFindings(findings)
+	return findings
+}
+
+// loaderFinding turns an error of the compose-go loader into a finding,
+// attributed to the compose file it names and located at the compose path or
+// the service it mentions.
+func loaderFinding(clonePath string, documents composeDocuments, err error) validationFinding {
+	finding := validationFinding{Severity: findingError, Rule: "compose", Message: err.Error()}
+
+	for _, prefix := range []string{"validating ", "parsing "} {
+		if !strings.HasPrefix(finding.Message, prefix) {
+			continue
+		}
+
+		composeFilePath, message, ok := strings.Cut(strings.TrimPrefix(finding.Message, prefix), ": ")
+		if !ok {
+			break
+		}
+
+		finding.File = relativeToClone(clonePath, composeFilePath)
+		finding.Message = message
+		if prefix == "validating " {
+			finding.Rule = "schema"
+		}
+	}
+
+	var keys []string
+	if match := composePathPattern.FindStringSubmatch(finding.Message); match != nil {
+		keys = strings.Split(match[1], ".")
+		if property := composePropertyPattern.FindStringSubmatch(finding.Message); property != nil {
+			keys = append(keys, property[1])
+		}
+	} else if match := composeServicePattern.FindStringSubmatch(finding.Message); match != nil {
+		keys = []string{"services", match[1]}
+	}
+	if match := composeServicePattern.FindStringSubmatch(finding.Message); match != nil {
+		finding.Service = match[1]
+	} else if len(keys) > 1 && keys[0] == "services" {
+		finding.Service = keys[1]
+	}
+
+	if finding.File == "" {
+		finding.File = documents.find(keys...)
+	}
+	finding.Line, finding.Column, _ = documents.locate(finding.File, keys...)
+
+	return finding
+}
+
+// checkServiceSources reports the env files of a service outside of the clone
+// or missing, and its bind mount sources inside the clone which do not exist.
+// The paths are absolute, resolved by the loader against the project
+// directory.
+func checkServiceSources(clonePath, workingDir string, documents composeDocuments, service types.ServiceConfig) []validationFinding {
+	findings := []validationFinding{}
+
+	// sourceFinding locates the entry of the key of the service whose
+	// source resolves to p
+	sourceFinding := func(key, p string) validationFinding {
+		finding := validationFinding{Service: service.Name, Severity: findingError, Rule: key}
+
+		keys := []string{"services", service.Name, key}
+		finding.File = documents.find(keys...)
+		for _, file := range documents.files {
+			if node := findSourceEntry(documents.node(file, keys...), workingDir, p); node != nil {
+				finding.File = file
+				finding.Line, finding.Column = node.Line, node.Column
+				return finding
+			}
+		}
+
+		finding.Line, finding.Column, _ = documents.locate(finding.File, keys...)
+		return finding
+	}
+
+	for _, envFile := range service.EnvFile {
+		switch _, err := os.Stat(envFile); {
+		case !isWithin(clonePath, envFile):
+			finding := sourceFinding("env_file", envFile)
+			finding.Rule = "env-file"
+			finding.Message = fmt.Sprintf("env_file %s of service %s is outside of the repository", envFile, service.Name)
+			findings = append(findings, finding)
+		case errors.Is(err, os.ErrNotExist):
+			finding := sourceFinding("env_file", envFile)
+			finding.Rule = "env-file"
+			finding.Message = fmt.Sprintf("env_file %s of service %s does not exist", relativeToClone(clonePath, envFile), service.Name)
+			findings = append(findings, finding)
+		}
+	}
+
+	for _, volume := range service.Volumes {
+		if volume.Type != types.VolumeTypeBind || !isWithin(clonePath, volume.Source) {
+			continue
+		}
+
+		if _, err := os.Stat(volume.Source); !errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+
+		// The short syntax creates the missing source as a directory
+		finding := sourceFinding("volumes", volume.Source)
+		finding.Rule = "bind-source"
+		finding.Message = fmt.Sprintf("bind mount source %s of service %s does not exist", relativeToClone(clonePath, volume.Source), service.Name)
+		if volume.Bind != nil && volume.Bind.CreateHostPath {
+			finding.Severity = findingWarning
+			finding.Message += " and will be created as a directory"
+		}
+
+		findings = append(findings, finding)
+	}
+
+	return findings
+}
+
+// locateServiceFindings sets the compose file and the position of the findings
+// only attributed to a service, as the policy ones, to the service definition.
+func locateServiceFindings(clonePath string, composeRelativeFilePaths []string, findings []validationFinding) {
+	documents := composeDocuments{roots: make(map[string]*yaml.Node)}
+	_ = readComposeFiles(clonePath, composeRelativeFilePaths, func(composeFilePath string, root *yaml.Node) error {
+		composeRelativeFilePath := relativeToClone(clonePath, composeFilePath)
+		documents.files = append(documents.files, composeRelativeFilePath)
+		documents.roots[composeRelativeFilePath] = root
+		return nil
+	})
+
+	for i, finding := range findings {
+		if finding.File != "" || finding.Service == "" {
+			continue
+		}
+
+		keys := []string{"services", finding.Service}
+		findings[i].File = documents.find(keys...)
+		findings[i].Line, findings[i].Column, _ = documents.locate(findings[i].File, keys...)
+	}
+}
+
+// findSourceEntry returns the entry of an env_file or volumes node whose path
+// or bind source, resolved against workingDir, is p.
+func findSourceEntry(entries *yaml.Node, workingDir, p string) *yaml.Node {
+	if entries == nil {
+		return nil
+	}
+
+	candidates := []*yaml.Node{entries}
+	if entries.Kind == yaml.SequenceNode {
+		candidates = entries.Content
+	}
+
+	for _, entry := range candidates {
+		source := entry
+		switch {
+		case entry.Kind == yaml.MappingNode && mappingValue(entry, "source") != nil:
+			source = mappingValue(entry, "source")
+		case entry.Kind == yaml.MappingNode:
+			source = mappingValue(entry, "path")
+		}
+		if source == nil || source.Kind != yaml.ScalarNode {
+			continue
+		}
+
+		value := source.Value
+		if source == entry && entries.Kind == yaml.SequenceNode && strings.Contains(value, ":") {
+			// Short syntax of a volume, source:target[:mode]
+			value, _, _ = strings.Cut(value, ":")
+		}
+		if !filepath.IsAbs(value) {
+			value = filepath.Join(workingDir, filepath.FromSlash(value))
+		}
+
+		if filepath.Clean(value) == filepath.Clean(p) {
+			return entry
+		}
+	}
+
+	return nil
+}
+
+// composeDocuments holds the parsed compose files, keyed by their path
+// relative to the clone, to locate the findings.
+type composeDocuments struct {
+	files []string
+	roots map[string]*yaml.Node
+}
+
+// node returns the node at the path of mapping keys and sequence indexes in
+// the compose file, nil when it does not exist.
+func (d composeDocuments) node(file string, keys ...string) *yaml.Node {
+	node, _, depth := d.walk(file, keys...)
+	if depth != len(keys) {
+		return nil
+	}
+
+	return node
+}
+
+// locate returns the position of the deepest node of the path in the compose
+// file and the number of keys matched. Mapping entries are located at their
+// key.
+func (d composeDocuments) locate(file string, keys ...string) (int, int, int) {
+	_, position, depth := d.walk(file, keys...)
+	if position == nil {
+		return 0, 0, 0
+	}
+
+	return position.Line, position.Column, depth
+}
+
+// walk follows the path in the compose file as far as it exists. It returns
+// the node reached, the node holding its position, the key of a mapping
+// entry, and the number of keys matched.
+func (d composeDocuments) walk(file string, keys ...string) (*yaml.Node, *yaml.Node, int) {
+	node := d.roots[file]
+	if node == nil {
+		return nil, nil, 0
+	}
+
+	position := node
+	for depth, key := range keys {
+		next, nextPosition := (*yaml.Node)(nil), (*yaml.Node)(nil)
+		switch node.Kind {
+		case yaml.MappingNode:
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				if node.Content[i].Value == key {
+					next, nextPosition = node.Content[i+1], node.Content[i]
+					break
+				}
+			}
+		case yaml.SequenceNode:
+			if i, err := strconv.Atoi(key); err == nil && i >= 0 && i < len(node.Content) {
+				next, nextPosition = node.Content[i], node.Content[i]
+			}
+		}
+		if next == nil {
+			return node, position, depth
+		}
+
+		node, position = next, nextPosition
+	}
+
+	return node, position, len(keys)
+}
+
+// find returns the compose file matching most of the path, the first one on
+// a tie.
+func (d composeDocuments) find(keys ...string) string {
+	found, foundDepth := "", -1
+	for _, file := range d.files {
+		if _, _, depth := d.locate(file, keys...); depth > foundDepth {
+			found, foundDepth = file, depth
+		}
+	}
+
+	return found
+}
+
+// findScalar returns the first scalar of node, keys included, for which match
+// returns true.
+func findScalar(node *yaml.Node, match func(string) bool) *yaml.Node {
+	if node.Kind == yaml.ScalarNode && match(node.Value) {
+		return node
+	}
+
+	for _, child := range node.Content {
+		if found := findScalar(child, match); found != nil {
+			return found
+		}
+	}
+
+	return nil
+}
+
+// relativeToClone returns the slash separated path of p inside clonePath.
+func relativeToClone(clonePath, p string) string {
+	relativePath, err := filepath.Rel(clonePath, p)
+	if err != nil {
+		return p
+	}
+
+	return filepath.ToSlash(relativePath)
+}
+
+// sortFindings orders the findings by file and position.
+func sortFindings(findings []validationFinding) {
+	sort.SliceStable(findings, func(i, j int) bool {
+		if findings[i].File != findings[j].File {
+			return findings[i].File < findings[j].File
+		}
+		if findings[i].Line != findings[j].Line {
+			return findings[i].Line < findings[j].Line
+		}
+		return findings[i].Column < findings[j].Column
+	})
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestValidateComposeFiles(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+		paths []string
+		env   []string
+		want  []validationFinding
+	}{
+		{
+			name:  "valid stack",
+			files: map[string]string{"docker-compose.yml": "services:\n  web:\n    image: nginx:${TAG:-latest}\n    env_file: web.env\n    volumes:\n      - ./conf:/etc/nginx\n", "web.env": "A=b\n", "conf/nginx.conf": ""},
+			want:  []validationFinding{},
+		},
+		{
+			name:  "yaml error",
+			files: map[string]string{"docker-compose.yml": "services:\n  web:\n    image: [nginx\n"},
+			want:  []validationFinding{{File: "docker-compose.yml", Line: 2, Severity: findingError, Rule: "yaml"}},
+		},
+		{
+			name:  "unknown service key",
+			files: map[string]string{"docker-compose.yml": "services:\n  web:\n    image: nginx\n    imagee: nginx\n"},
+			want:  []validationFinding{{File: "docker-compose.yml", Service: "web", Line: 4, Severity: findingError, Rule: "schema"}},
+		},
+		{
+			name:  "service without image",
+			files: map[string]string{"docker-compose.yml": "services:\n  web:\n    restart: always\n"},
+			want:  []validationFinding{{File: "docker-compose.yml", Service: "web", Line: 2, Severity: findingError, Rule: "compose"}},
+		},
+		{
+			name:  "unset variable",
+			files: map[string]string{"docker-compose.yml": "services:\n  web:\n    image: nginx:${UNPACKER_TEST_TAG}\n"},
+			want:  []validationFinding{{File: "docker-compose.yml", Line: 3, Severity: findingWarning, Rule: "unset-variable"}},
+		},
+		{
+			name:  "variable set by env",
+			files: map[string]string{"docker-compose.yml": "services:\n  web:\n    image: nginx:${UNPACKER_TEST_TAG?tag}\n"},
+			env:   []string{"UNPACKER_TEST_TAG=1"},
+			want:  []validationFinding{},
+		},
+		{
+			name:  "variable set by .env",
+			files: map[string]string{"docker-compose.yml": "services:\n  web:\n    image: nginx:${UNPACKER_TEST_TAG?tag}\n", ".env": "UNPACKER_TEST_TAG=1\n"},
+			want:  []validationFinding{},
+		},
+		{
+			name:  "required variable",
+			files: map[string]string{"docker-compose.yml": "services:\n  web:\n    image: nginx:${UNPACKER_TEST_TAG?tag}\n"},
+			want:  []validationFinding{{File: "docker-compose.yml", Line: 3, Severity: findingError, Rule: "required-variable"}},
+		},
+		{
+			name:  "missing env file",
+			files: map[string]string{"docker-compose.yml": "services:\n  web:\n    image: nginx\n    env_file: web.env\n"},
+			want:  []validationFinding{{File: "docker-compose.yml", Service: "web", Line: 4, Severity: findingError, Rule: "env-file"}},
+		},
+		{
+			name:  "env file outside of the repository",
+			files: map[string]string{"docker-compose.yml": "services:\n  web:\n    image: nginx\n    env_file: ../web.env\n"},
+			want:  []validationFinding{{File: "docker-compose.yml", Service: "web", Line: 4, Severity: findingError, Rule: "env-file"}},
+		},
+		{
+			name:  "missing bind mount sources",
+			files: map[string]string{"docker-compose.yml": "services:\n  web:\n    image: nginx\n    volumes:\n      - ./data:/data\n      - type: bind\n        source: ./conf\n        target: /conf\n      - /var/run/docker.sock:/var/run/docker.sock\n"},
+			want: []validationFinding{
+				{File: "docker-compose.yml", Service: "web", Line: 5, Severity: findingWarning, Rule: "bind-source"},
+				{File: "docker-compose.yml", Service: "web", Line: 6, Severity: findingError, Rule: "bind-source"},
+			},
+		},
+		{
+			name: "findings of an override file",
+			files: map[string]string{
+				"docker-compose.yml":          "services:\n  web:\n    image: nginx\n    volumes:\n      - ./conf:/conf\n",
+				"docker-compose.override.yml": "services:\n  web:\n    environment:\n      TAG: ${UNPACKER_TEST_TAG}\n    env_file:\n      - web.env\n    volumes:\n      - ./data:/data\n",
+				"conf/nginx.conf":             "",
+			},
+			paths: []string{"docker-compose.yml", "docker-compose.override.yml"},
+			want: []validationFinding{
+				{File: "docker-compose.override.yml", Line: 4, Severity: findingWarning, Rule: "unset-variable"},
+				{File: "docker-compose.override.yml", Service: "web", Line: 6, Severity: findingError, Rule: "env-file"},
+				{File: "docker-compose.override.yml", Service: "web", Line: 8, Severity: findingWarning, Rule: "bind-source"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clonePath := writeTestFiles(t, t.TempDir(), tt.files)
+
+			paths := tt.paths
+			if paths == nil {
+				paths = []string{"docker-compose.yml"}
+			}
+
+			findings := validateComposeFiles(clonePath, clonePath, paths, tt.env)
+			if len(findings) != len(tt.want) {
+				t.Fatalf("validateComposeFiles() = %v, want %d findings", findings, len(tt.want))
+			}
+
+			for i, finding := range findings {
+				want := tt.want[i]
+				if finding.File != want.File || finding.Service != want.Service || finding.Line != want.Line || finding.Severity != want.Severity || finding.Rule != want.Rule {
+					t.Errorf("finding %d = %v, want %v", i, finding, want)
+				}
+			}
+		})
+	}
+}
+
+func TestLocateServiceFindings(t *testing.T) {
+	clonePath := writeTestFiles(t, t.TempDir(), map[string]string{
+		"docker-compose.yml":          "services:\n  web:\n    image: nginx\n",
+		"docker-compose.override.yml": "services:\n  web:\n    privileged: true\n  db:\n    image: postgres\n",
+	})
+
+	findings := []validationFinding{
+		{Service: "db", Rule: "policy/privileged"},
+		{Service: "web", Rule: "policy/privileged"},
+		{File: "docker-compose.yml", Line: 3, Rule: "schema"},
+	}
+	locateServiceFindings(clonePath, []string{"docker-compose.yml", "docker-compose.override.yml"}, findings)
+
+	want := []validationFinding{
+		{File: "docker-compose.override.yml", Service: "db", Line: 4, Column: 3, Rule: "policy/privileged"},
+		{File: "docker-compose.yml", Service: "web", Line: 2, Column: 3, Rule: "policy/privileged"},
+		{File: "docker-compose.yml", Line: 3, Rule: "schema"},
+	}
+	for i := range want {
+		if findings[i] != want[i] {
+			t.Errorf("finding %d = %+v, want %+v", i, findings[i], want[i])
+		}
+	}
+}